@@ -5,21 +5,37 @@ import (
 	"log"
 	"net"
 	"net/http"
-	"net/rpc"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/matrix-org/complement-crypto/internal/config"
+	"github.com/matrix-org/complement-crypto/internal/config/timing"
 	"github.com/matrix-org/complement-crypto/internal/deploy"
 )
 
 func main() {
+	// we inherit the env vars of the test process, so use the same timing profile.
+	timing.Set(config.NewTimingProfileFromEnvVars())
 	srv := deploy.NewRPCServer()
-	rpc.Register(srv)
-	rpc.HandleHTTP()
-	listener, err := net.Listen("tcp", ":0")
+	// graceful terminations close all clients before exiting, so they can write logs and persist state.
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGTERM)
+	go func() {
+		<-sigterm
+		fmt.Println("RPC server received SIGTERM, closing clients")
+		srv.Shutdown()
+		os.Exit(0)
+	}()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		log.Fatal("Listener error: ", err)
 	}
 	// tell the parent process what port we are listening on.
 	port := listener.Addr().(*net.TCPAddr).Port
 	fmt.Println(port)
-	fmt.Println(http.Serve(listener, nil))
+	mux := http.NewServeMux()
+	mux.Handle("/", deploy.NewJSONRPCHandler(srv))
+	mux.Handle("/notifications", srv.Notifications())
+	fmt.Println(http.Serve(listener, mux))
 }
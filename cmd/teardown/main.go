@@ -0,0 +1,23 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/matrix-org/complement-crypto/internal/deploy"
+)
+
+var stateFile = flag.String("state", os.Getenv("COMPLEMENT_CRYPTO_DEPLOYMENT_STATE_FILE"), "The path to the deployment state file. Defaults to COMPLEMENT_CRYPTO_DEPLOYMENT_STATE_FILE")
+
+// Tears down a reusable deployment made by setting COMPLEMENT_CRYPTO_DEPLOYMENT_STATE_FILE.
+func main() {
+	flag.Parse()
+	if *stateFile == "" {
+		log.Fatal("no state file provided, use -state or set COMPLEMENT_CRYPTO_DEPLOYMENT_STATE_FILE")
+	}
+	if err := deploy.TeardownReusableDeployment(*stateFile); err != nil {
+		log.Fatalf("failed to teardown deployment: %s", err)
+	}
+	log.Printf("deployment torn down")
+}
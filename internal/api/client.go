@@ -11,6 +11,15 @@ import (
 type ClientType struct {
 	Lang ClientTypeLang // rust or js
 	HS   string         // hs1 or hs2
+	// If true, the client runs in a separate process and is controlled via RPC.
+	Multiprocess bool
+}
+
+func (c ClientType) String() string {
+	if c.Multiprocess {
+		return fmt.Sprintf("{%s_rpc %s}", c.Lang, c.HS)
+	}
+	return fmt.Sprintf("{%s %s}", c.Lang, c.HS)
 }
 
 // Client represents a generic crypto client.
@@ -25,6 +34,14 @@ type Client interface {
 	// sending SIGKILL. This is typically useful for tests which want to explicitly test
 	// unclean shutdowns.
 	ForceClose(t ct.TestLike)
+	// Suspend should freeze the client e.g sending SIGSTOP, like iOS does to apps in the background.
+	// Requests which are in flight do not complete until the client is resumed.
+	Suspend(t ct.TestLike)
+	// Resume should unfreeze a suspended client e.g sending SIGCONT.
+	Resume(t ct.TestLike)
+	// Terminate should shut down the client's process. If graceful, the client is asked to shut
+	// down e.g sending SIGTERM, like Android does. If not graceful, this is the same as ForceClose.
+	Terminate(t ct.TestLike, graceful bool)
 	// Remove any persistent storage, if it was enabled.
 	DeletePersistentStorage(t ct.TestLike)
 	Login(t ct.TestLike, opts ClientCreationOpts) error
@@ -46,9 +63,10 @@ type Client interface {
 	SendMessage(t ct.TestLike, roomID, text string) (eventID string)
 	// TrySendMessage tries to send the message, but can fail.
 	TrySendMessage(t ct.TestLike, roomID, text string) (eventID string, err error)
-	// Wait until an event is seen in the given room. The checker functions can be custom or you can use
-	// a pre-defined one like api.CheckEventHasMembership, api.CheckEventHasBody, or api.CheckEventHasEventID.
-	WaitUntilEventInRoom(t ct.TestLike, roomID string, checker func(e Event) bool) Waiter
+	// Wait until an event is seen in the given room. The checker can be an api.EventMatcher e.g from
+	// api.CheckEventHasMembership, api.CheckEventHasBody, or api.CheckEventHasEventID, or a custom
+	// api.CheckerFunc. Matchers are preferred, as they can be evaluated by clients in another process.
+	WaitUntilEventInRoom(t ct.TestLike, roomID string, checker EventChecker) Waiter
 	// Backpaginate in this room by `count` events.
 	MustBackpaginate(t ct.TestLike, roomID string, count int)
 	// MustGetEvent will return the client's view of this event, or fail the test if the event cannot be found.
@@ -73,7 +91,7 @@ type Client interface {
 
 type Notification struct {
 	Event
-	HasMentions *bool
+	HasMentions *bool `json:"has_mentions"`
 }
 
 type LoggedClient struct {
@@ -105,6 +123,24 @@ func (c *LoggedClient) ForceClose(t ct.TestLike) {
 	c.Client.ForceClose(t)
 }
 
+func (c *LoggedClient) Suspend(t ct.TestLike) {
+	t.Helper()
+	c.Logf(t, "%s Suspend", c.logPrefix())
+	c.Client.Suspend(t)
+}
+
+func (c *LoggedClient) Resume(t ct.TestLike) {
+	t.Helper()
+	c.Logf(t, "%s Resume", c.logPrefix())
+	c.Client.Resume(t)
+}
+
+func (c *LoggedClient) Terminate(t ct.TestLike, graceful bool) {
+	t.Helper()
+	c.Logf(t, "%s Terminate(graceful=%v)", c.logPrefix(), graceful)
+	c.Client.Terminate(t, graceful)
+}
+
 func (c *LoggedClient) MustGetEvent(t ct.TestLike, roomID, eventID string) Event {
 	t.Helper()
 	c.Logf(t, "%s MustGetEvent(%s, %s)", c.logPrefix(), roomID, eventID)
@@ -149,9 +185,13 @@ func (c *LoggedClient) SendMessage(t ct.TestLike, roomID, text string) (eventID
 	return
 }
 
-func (c *LoggedClient) WaitUntilEventInRoom(t ct.TestLike, roomID string, checker func(e Event) bool) Waiter {
+func (c *LoggedClient) WaitUntilEventInRoom(t ct.TestLike, roomID string, checker EventChecker) Waiter {
 	t.Helper()
-	c.Logf(t, "%s WaitUntilEventInRoom %s", c.logPrefix(), roomID)
+	if matcher, ok := checker.(EventMatcher); ok {
+		c.Logf(t, "%s WaitUntilEventInRoom %s %s", c.logPrefix(), roomID, matcher)
+	} else {
+		c.Logf(t, "%s WaitUntilEventInRoom %s", c.logPrefix(), roomID)
+	}
 	return c.Client.WaitUntilEventInRoom(t, roomID, checker)
 }
 
@@ -201,24 +241,25 @@ const ProcessNameNSE string = "NSE"
 // options which are only supported in some clients. These are clearly documented.
 type ClientCreationOpts struct {
 	// Required. The base URL of the homeserver.
-	BaseURL string
+	BaseURL string `json:"base_url"`
 	// Required. The user to login as.
-	UserID string
+	UserID string `json:"user_id"`
 	// Required. The password for this account.
-	Password string
+	Password string `json:"password"`
 
 	// Optional. If true, persistent storage will be used for the same user|device ID.
-	PersistentStorage bool
-	// Required for rust clients. The URL of the sliding sync proxy.
-	SlidingSyncURL string
+	PersistentStorage bool `json:"persistent_storage"`
+	// Required for rust clients. The URL to use for sliding sync. This is either a sliding sync proxy
+	// or the homeserver itself, if it supports sliding sync natively.
+	SlidingSyncURL string `json:"sliding_sync_url"`
 	// Optional. Set this to login with this device ID.
-	DeviceID string
+	DeviceID string `json:"device_id"`
 
 	// Rust only. If set, enables the cross process refresh lock on the FFI client with the process name provided.
-	EnableCrossProcessRefreshLockProcessName string
+	EnableCrossProcessRefreshLockProcessName string `json:"enable_cross_process_refresh_lock_process_name"`
 	// Rust only. If set with EnableCrossProcessRefreshLockProcessName=ProcessNameNSE, the client will be seeded
 	// with a logged in session.
-	AccessToken string
+	AccessToken string `json:"access_token"`
 }
 
 func NewClientCreationOpts(c *client.CSAPI) ClientCreationOpts {
@@ -231,14 +272,14 @@ func NewClientCreationOpts(c *client.CSAPI) ClientCreationOpts {
 }
 
 type Event struct {
-	ID     string
-	Text   string // FFI bindings don't expose the content object
-	Sender string
+	ID     string `json:"event_id"`
+	Text   string `json:"text"` // FFI bindings don't expose the content object
+	Sender string `json:"sender"`
 	// FFI bindings don't expose state key
-	Target string
+	Target string `json:"target"`
 	// FFI bindings don't expose type
-	Membership      string
-	FailedToDecrypt bool
+	Membership      string `json:"membership"`
+	FailedToDecrypt bool   `json:"failed_to_decrypt"`
 }
 
 type Waiter interface {
@@ -250,20 +291,14 @@ type Waiter interface {
 	TryWaitf(t ct.TestLike, s time.Duration, format string, args ...any) error
 }
 
-func CheckEventHasBody(body string) func(e Event) bool {
-	return func(e Event) bool {
-		return e.Text == body
-	}
+func CheckEventHasBody(body string) EventMatcher {
+	return MatchBody(body)
 }
 
-func CheckEventHasMembership(target, membership string) func(e Event) bool {
-	return func(e Event) bool {
-		return e.Membership == membership && e.Target == target
-	}
+func CheckEventHasMembership(target, membership string) EventMatcher {
+	return MatchMembership(target, membership)
 }
 
-func CheckEventHasEventID(eventID string) func(e Event) bool {
-	return func(e Event) bool {
-		return e.ID == eventID
-	}
+func CheckEventHasEventID(eventID string) EventMatcher {
+	return MatchEventID(eventID)
 }
@@ -13,6 +13,7 @@ import (
 
 	"github.com/matrix-org/complement-crypto/internal/api"
 	"github.com/matrix-org/complement-crypto/internal/api/js/chrome"
+	"github.com/matrix-org/complement-crypto/internal/config/timing"
 	"github.com/matrix-org/complement/ct"
 	"github.com/matrix-org/complement/must"
 	"github.com/tidwall/gjson"
@@ -267,6 +268,28 @@ func (c *JSClient) ForceClose(t ct.TestLike) {
 	c.Close(t)
 }
 
+func (c *JSClient) Suspend(t ct.TestLike) {
+	t.Helper()
+	t.Fatalf("Cannot suspend a JS client, use an RPC client instead.")
+}
+
+func (c *JSClient) Resume(t ct.TestLike) {
+	t.Helper()
+	t.Fatalf("Cannot resume a JS client, use an RPC client instead.")
+}
+
+// Terminate closes the client if graceful, as the browser is in the test process. If not graceful, this is the
+// same as ForceClose.
+func (c *JSClient) Terminate(t ct.TestLike, graceful bool) {
+	t.Helper()
+	if !graceful {
+		c.ForceClose(t)
+		return
+	}
+	t.Logf("gracefully terminating a JS client is the same as a normal close (closing browser)")
+	c.Close(t)
+}
+
 // Close is called to clean up resources.
 // Specifically, we need to shut off existing browsers and any FFI bindings.
 // If we get callbacks/events after this point, tests may panic if the callbacks
@@ -359,16 +382,17 @@ func (c *JSClient) StartSyncing(t ct.TestLike) (stopSyncing func(), err error) {
 		close(ch)
 	})
 	chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, `await window.__client.startClient({});`)
+	tp := timing.Get()
 	select {
-	case <-time.After(5 * time.Second):
-		return nil, fmt.Errorf("[%s](js) took >5s to StartSyncing", c.userID)
+	case <-time.After(tp.StartSyncingTimeout):
+		return nil, fmt.Errorf("[%s](js) took >%v to StartSyncing", c.userID, tp.StartSyncingTimeout)
 	case <-ch:
 	}
 	cancel()
 	// we need to wait for rust crypto's outgoing request loop to finish.
 	// There's no callbacks for that yet, so sleep and pray.
 	// See https://github.com/matrix-org/matrix-js-sdk/blob/v29.1.0/src/rust-crypto/rust-crypto.ts#L1483
-	time.Sleep(500 * time.Millisecond)
+	time.Sleep(tp.SyncSettleDelay)
 	return func() {
 		chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, `await window.__client.stopClient();`)
 	}, nil
@@ -433,7 +457,7 @@ func (c *JSClient) MustBackupKeys(t ct.TestLike) (recoveryKey string) {
 	// the backup loop which sends keys will wait between 0-10s before uploading keys...
 	// See https://github.com/matrix-org/matrix-js-sdk/blob/49624d5d7308e772ebee84322886a39d2e866869/src/rust-crypto/backup.ts#L319
 	// Ideally this would be configurable..
-	time.Sleep(11 * time.Second)
+	time.Sleep(timing.Get().KeyBackupUploadDelay)
 	return *key
 }
 
@@ -459,7 +483,7 @@ func (c *JSClient) LoadBackup(t ct.TestLike, recoveryKey string) error {
 	return err
 }
 
-func (c *JSClient) WaitUntilEventInRoom(t ct.TestLike, roomID string, checker func(e api.Event) bool) api.Waiter {
+func (c *JSClient) WaitUntilEventInRoom(t ct.TestLike, roomID string, checker api.EventChecker) api.Waiter {
 	t.Helper()
 	return &jsTimelineWaiter{
 		roomID:  roomID,
@@ -495,7 +519,7 @@ func (c *JSClient) listenForUpdates(callback func(roomID string, ev api.Event))
 
 type jsTimelineWaiter struct {
 	roomID  string
-	checker func(e api.Event) bool
+	checker api.EventChecker
 	client  *JSClient
 }
 
@@ -514,7 +538,7 @@ func (w *jsTimelineWaiter) TryWaitf(t ct.TestLike, s time.Duration, format strin
 		if w.roomID != roomID {
 			return
 		}
-		if !w.checker(ev) {
+		if !w.checker.Check(ev) {
 			return
 		}
 		updates <- true
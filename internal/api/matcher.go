@@ -0,0 +1,149 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EventChecker decides whether an event is the one being waited for, see Client.WaitUntilEventInRoom.
+type EventChecker interface {
+	Check(e Event) bool
+}
+
+// CheckerFunc is an EventChecker which runs an arbitrary function. It cannot be serialised, so clients in
+// another process send every event back to the test process to be checked. Prefer EventMatcher where possible.
+type CheckerFunc func(e Event) bool
+
+func (f CheckerFunc) Check(e Event) bool {
+	return f(e)
+}
+
+// EventMatcher is an EventChecker which can be serialised, so clients in another process can check events
+// themselves. An event matches if it matches every field which is set. The zero value matches every event.
+type EventMatcher struct {
+	Body            *string        `json:"body,omitempty"`
+	Sender          *string        `json:"sender,omitempty"`
+	Target          *string        `json:"target,omitempty"`
+	Membership      *string        `json:"membership,omitempty"`
+	EventID         *string        `json:"event_id,omitempty"`
+	FailedToDecrypt *bool          `json:"failed_to_decrypt,omitempty"`
+	And             []EventMatcher `json:"and,omitempty"` // every matcher must match
+	Or              []EventMatcher `json:"or,omitempty"`  // at least one matcher must match
+	Not             *EventMatcher  `json:"not,omitempty"` // the matcher must not match
+}
+
+func (m EventMatcher) Check(e Event) bool {
+	if m.Body != nil && e.Text != *m.Body {
+		return false
+	}
+	if m.Sender != nil && e.Sender != *m.Sender {
+		return false
+	}
+	if m.Target != nil && e.Target != *m.Target {
+		return false
+	}
+	if m.Membership != nil && e.Membership != *m.Membership {
+		return false
+	}
+	if m.EventID != nil && e.ID != *m.EventID {
+		return false
+	}
+	if m.FailedToDecrypt != nil && e.FailedToDecrypt != *m.FailedToDecrypt {
+		return false
+	}
+	for _, and := range m.And {
+		if !and.Check(e) {
+			return false
+		}
+	}
+	if len(m.Or) > 0 {
+		matched := false
+		for _, or := range m.Or {
+			if or.Check(e) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if m.Not != nil && m.Not.Check(e) {
+		return false
+	}
+	return true
+}
+
+func (m EventMatcher) String() string {
+	var parts []string
+	for _, field := range []struct {
+		name string
+		val  *string
+	}{
+		{"body", m.Body}, {"sender", m.Sender}, {"target", m.Target}, {"membership", m.Membership}, {"event_id", m.EventID},
+	} {
+		if field.val != nil {
+			parts = append(parts, fmt.Sprintf("%s=%q", field.name, *field.val))
+		}
+	}
+	if m.FailedToDecrypt != nil {
+		parts = append(parts, fmt.Sprintf("failed_to_decrypt=%v", *m.FailedToDecrypt))
+	}
+	for _, and := range m.And {
+		parts = append(parts, and.String())
+	}
+	if len(m.Or) > 0 {
+		ors := make([]string, len(m.Or))
+		for i := range m.Or {
+			ors[i] = m.Or[i].String()
+		}
+		parts = append(parts, "("+strings.Join(ors, " OR ")+")")
+	}
+	if m.Not != nil {
+		parts = append(parts, "NOT "+m.Not.String())
+	}
+	if len(parts) == 0 {
+		return "*"
+	}
+	return strings.Join(parts, " AND ")
+}
+
+// MatchBody matches events with this body.
+func MatchBody(body string) EventMatcher {
+	return EventMatcher{Body: &body}
+}
+
+// MatchSender matches events sent by this user.
+func MatchSender(userID string) EventMatcher {
+	return EventMatcher{Sender: &userID}
+}
+
+// MatchMembership matches membership events for this target user with this membership e.g "join".
+func MatchMembership(target, membership string) EventMatcher {
+	return EventMatcher{Target: &target, Membership: &membership}
+}
+
+// MatchEventID matches the event with this event ID.
+func MatchEventID(eventID string) EventMatcher {
+	return EventMatcher{EventID: &eventID}
+}
+
+// MatchFailedToDecrypt matches events which failed to decrypt, or if false, events which did not fail to decrypt.
+func MatchFailedToDecrypt(failedToDecrypt bool) EventMatcher {
+	return EventMatcher{FailedToDecrypt: &failedToDecrypt}
+}
+
+// MatchAll matches events which match every matcher.
+func MatchAll(matchers ...EventMatcher) EventMatcher {
+	return EventMatcher{And: matchers}
+}
+
+// MatchAny matches events which match at least one matcher.
+func MatchAny(matchers ...EventMatcher) EventMatcher {
+	return EventMatcher{Or: matchers}
+}
+
+// MatchNot matches events which do not match the matcher.
+func MatchNot(matcher EventMatcher) EventMatcher {
+	return EventMatcher{Not: &matcher}
+}
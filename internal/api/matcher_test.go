@@ -0,0 +1,55 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/complement/must"
+)
+
+func TestEventMatcher(t *testing.T) {
+	msg := Event{ID: "$msg", Text: "hello", Sender: "@alice:hs1"}
+	utd := Event{ID: "$utd", Sender: "@alice:hs1", FailedToDecrypt: true}
+	join := Event{ID: "$join", Sender: "@bob:hs1", Target: "@bob:hs1", Membership: "join"}
+	testCases := []struct {
+		name    string
+		matcher EventMatcher
+		json    string
+		matches []Event
+	}{
+		{"zero", EventMatcher{}, `{}`, []Event{msg, utd, join}},
+		{"body", MatchBody("hello"), `{"body":"hello"}`, []Event{msg}},
+		{"sender", MatchSender("@alice:hs1"), `{"sender":"@alice:hs1"}`, []Event{msg, utd}},
+		{"membership", MatchMembership("@bob:hs1", "join"), `{"target":"@bob:hs1","membership":"join"}`, []Event{join}},
+		{"event_id", MatchEventID("$utd"), `{"event_id":"$utd"}`, []Event{utd}},
+		{"failed_to_decrypt", MatchFailedToDecrypt(false), `{"failed_to_decrypt":false}`, []Event{msg, join}},
+		{
+			"and", MatchAll(MatchSender("@alice:hs1"), MatchFailedToDecrypt(true)),
+			`{"and":[{"sender":"@alice:hs1"},{"failed_to_decrypt":true}]}`, []Event{utd},
+		},
+		{
+			"or", MatchAny(MatchEventID("$msg"), MatchEventID("$join")),
+			`{"or":[{"event_id":"$msg"},{"event_id":"$join"}]}`, []Event{msg, join},
+		},
+		{"not", MatchNot(MatchSender("@alice:hs1")), `{"not":{"sender":"@alice:hs1"}}`, []Event{join}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// matchers must survive being sent to another process
+			b, err := json.Marshal(tc.matcher)
+			must.NotError(t, "failed to marshal", err)
+			must.Equal(t, string(b), tc.json, "JSON")
+			var m EventMatcher
+			must.NotError(t, "failed to unmarshal", json.Unmarshal(b, &m))
+			for _, ev := range []Event{msg, utd, join} {
+				want := false
+				for _, match := range tc.matches {
+					if match.ID == ev.ID {
+						want = true
+					}
+				}
+				must.Equal(t, m.Check(ev), want, "Check "+ev.ID)
+			}
+		})
+	}
+}
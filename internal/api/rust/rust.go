@@ -11,6 +11,7 @@ import (
 
 	"github.com/matrix-org/complement-crypto/internal/api"
 	"github.com/matrix-org/complement-crypto/internal/api/rust/matrix_sdk_ffi"
+	"github.com/matrix-org/complement-crypto/internal/config/timing"
 	"github.com/matrix-org/complement/ct"
 	"github.com/matrix-org/complement/must"
 	"golang.org/x/exp/slices"
@@ -210,6 +211,28 @@ func (c *RustClient) ForceClose(t ct.TestLike) {
 	t.Fatalf("Cannot force close a rust client, use an RPC client instead.")
 }
 
+func (c *RustClient) Suspend(t ct.TestLike) {
+	t.Helper()
+	t.Fatalf("Cannot suspend a rust client, use an RPC client instead.")
+}
+
+func (c *RustClient) Resume(t ct.TestLike) {
+	t.Helper()
+	t.Fatalf("Cannot resume a rust client, use an RPC client instead.")
+}
+
+// Terminate closes the client if graceful, as the client is in the test process. If not graceful, this is the
+// same as ForceClose.
+func (c *RustClient) Terminate(t ct.TestLike, graceful bool) {
+	t.Helper()
+	if !graceful {
+		c.ForceClose(t)
+		return
+	}
+	t.Logf("gracefully terminating a rust client is the same as a normal close")
+	c.Close(t)
+}
+
 func (c *RustClient) Close(t ct.TestLike) {
 	t.Helper()
 	c.roomsMu.Lock()
@@ -337,11 +360,12 @@ func (c *RustClient) StartSyncing(t ct.TestLike) (stopSyncing func(), err error)
 	c.allRooms.Entries(allRoomsListener)
 
 	isSyncing := false
+	startSyncingTimeout := timing.Get().StartSyncingTimeout
 
 	for !isSyncing {
 		select {
-		case <-time.After(5 * time.Second):
-			return nil, fmt.Errorf("[%s](rust) timed out after 5s StartSyncing", c.userID)
+		case <-time.After(startSyncingTimeout):
+			return nil, fmt.Errorf("[%s](rust) timed out after %v StartSyncing", c.userID, startSyncingTimeout)
 		case state := <-genericListener.ch:
 			switch state.(type) {
 			case matrix_sdk_ffi.RoomListLoadingStateLoaded:
@@ -388,6 +412,7 @@ func (c *RustClient) MustBackupKeys(t ct.TestLike) (recoveryKey string) {
 	defer e.Destroy()
 	recoveryKey, err := e.EnableRecovery(true, listener)
 	must.NotError(t, "Encryption.EnableRecovery", err)
+	keyBackupTimeout := timing.Get().KeyBackupTimeout
 	for !genericListener.isClosed.Load() {
 		select {
 		case s := <-genericListener.ch:
@@ -402,8 +427,8 @@ func (c *RustClient) MustBackupKeys(t ct.TestLike) (recoveryKey string) {
 				t.Logf("MustBackupKeys: state=Done")
 				genericListener.Close() // break the loop
 			}
-		case <-time.After(5 * time.Second):
-			ct.Fatalf(t, "timed out enabling backup keys")
+		case <-time.After(keyBackupTimeout):
+			ct.Fatalf(t, "timed out enabling backup keys after %v", keyBackupTimeout)
 		}
 	}
 	return recoveryKey
@@ -421,7 +446,7 @@ func (c *RustClient) MustLoadBackup(t ct.TestLike, recoveryKey string) {
 	c.LoadBackup(t, recoveryKey)
 }
 
-func (c *RustClient) WaitUntilEventInRoom(t ct.TestLike, roomID string, checker func(api.Event) bool) api.Waiter {
+func (c *RustClient) WaitUntilEventInRoom(t ct.TestLike, roomID string, checker api.EventChecker) api.Waiter {
 	t.Helper()
 	c.ensureListening(t, roomID)
 	return &timelineWaiter{
@@ -491,9 +516,10 @@ func (c *RustClient) TrySendMessage(t ct.TestLike, roomID, text string) (eventID
 		return
 	}
 	timeline.Send(matrix_sdk_ffi.MessageEventContentFromHtml(text, text))
+	sendMessageTimeout := timing.Get().SendMessageTimeout
 	select {
-	case <-time.After(11 * time.Second):
-		err = fmt.Errorf("SendMessage(rust) %s: timed out after 11s", c.userID)
+	case <-time.After(sendMessageTimeout):
+		err = fmt.Errorf("SendMessage(rust) %s: timed out after %v", c.userID, sendMessageTimeout)
 		return
 	case <-ch:
 		return
@@ -712,7 +738,7 @@ func (c *RustClient) ensureListening(t ct.TestLike, roomID string) {
 
 type timelineWaiter struct {
 	roomID  string
-	checker func(e api.Event) bool
+	checker api.EventChecker
 	client  *RustClient
 }
 
@@ -739,7 +765,7 @@ func (w *timelineWaiter) TryWaitf(t ct.TestLike, s time.Duration, format string,
 			if ev == nil {
 				continue
 			}
-			if w.checker(*ev) {
+			if w.checker.Check(*ev) {
 				t.Logf("%s: Wait[%s]: event exists in the timeline", w.client.userID, w.roomID)
 				return true
 			}
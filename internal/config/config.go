@@ -2,10 +2,13 @@ package config
 
 import (
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/matrix-org/complement-crypto/internal/api"
 	"github.com/matrix-org/complement-crypto/internal/api/langs"
+	"github.com/matrix-org/complement-crypto/internal/config/timing"
 )
 
 // The config for running Complement Crypto. This is configured using environment variables. The comments
@@ -22,11 +25,14 @@ type ComplementCrypto struct {
 	//  - `r`: Run a Rust SDK FFI client on hs1.
 	//  - `J`: Run a JS SDK client on hs2.
 	//  - `R`: Run a Rust SDK FFI client on hs2.
+	//  - `+`: Modifier: run the preceding client in a separate process via RPC. Requires COMPLEMENT_CRYPTO_RPC_BINARY.
+	//    The test process still needs bindings for the language, as tests for a single language create some clients in-process.
 	// ```
 	// For example, for a simple "Alice and Bob" test:
 	// ```
 	//  - `rj,rr`: Run the test twice. Run 1: Alice=rust, Bob=JS. Run 2: Alice=rust, Bob=rust. All on HS1.
 	//  - `jJ`: Run the test once. Run 1: Alice=JS on HS1, Bob=JS on HS2. Tests federation.
+	//  - `r+j`: Run the test once. Run 1: Alice=rust in a separate process, Bob=JS. All on HS1.
 	// ```
 	// If the matrix only consists of one letter (e.g all j's) then rust-specific tests will not run and vice versa.
 	TestClientMatrix [][2]api.ClientType
@@ -34,6 +40,12 @@ type ComplementCrypto struct {
 	// Which languages should be tested in ForEachClientType tests.
 	// Derived from TestClientMatrix
 	clientLangs map[api.ClientTypeLang]bool
+	// Which languages should be tested in-process, i.e. need language bindings in this process.
+	// Derived from TestClientMatrix
+	inProcessLangs map[api.ClientTypeLang]bool
+	// Which languages should be tested in a separate process via RPC.
+	// Derived from TestClientMatrix
+	multiprocessLangs map[api.ClientTypeLang]bool
 
 	// Name: COMPLEMENT_CRYPTO_MITMDUMP
 	// Default: ""
@@ -47,14 +59,123 @@ type ComplementCrypto struct {
 	// This binary is used when running multiprocess tests. If this environment variable is not supplied, tests which try to use multiprocess
 	// clients will be skipped, making this environment variable optional.
 	RPCBinaryPath string
+
+	// Name: COMPLEMENT_CRYPTO_SLIDING_SYNC_MODE
+	// Default: proxy
+	// Description: How sliding sync is provided to clients.
+	// ```
+	// Valid values are:
+	//  - `proxy`: Run a sliding sync proxy (and postgres) for each homeserver. Clients use the proxy for sliding sync.
+	//  - `native`: Clients use the sliding sync implementation on the homeserver itself (MSC4186). No proxy or postgres
+	//    containers are run. The homeserver images must support and enable native sliding sync.
+	// ```
+	SlidingSyncMode string
+
+	// Name: COMPLEMENT_CRYPTO_BASE_IMAGE_*
+	// Default: ""
+	// Description: The homeserver image to use for a particular named homeserver. If unset, the image given by
+	// COMPLEMENT_BASE_IMAGE is used. For example, `COMPLEMENT_CRYPTO_BASE_IMAGE_HS2=complement-dendrite:latest` would
+	// use `complement-dendrite:latest` for `hs2` but not `hs1`. Matching is case-insensitive. This allows E2EE federation
+	// tests between different homeserver implementations. Homeservers are allowed to listen on different ports.
+	HomeserverImages map[string]string
+
+	// Name: COMPLEMENT_CRYPTO_DEPLOYMENT_STATE_FILE
+	// Default: ""
+	// Description: If set, the deployment (homeservers, sliding sync proxies, postgres and mitmproxy) is left running
+	// when the tests finish, and the URLs and container IDs are written to this file. Subsequent test runs will reuse
+	// the deployment if it is still healthy and uses the same homeserver images, which is useful when iterating on a
+	// single test. Test packages which share the file wait for each other to deploy. Homeservers are not
+	// deployed via Complement in this mode, but images must still be Complement-compatible. Tear the deployment
+	// down with `go run ./cmd/teardown -state $COMPLEMENT_CRYPTO_DEPLOYMENT_STATE_FILE`.
+	DeploymentStateFile string
+
+	// Name: COMPLEMENT_CRYPTO_FEDERATION_PROXY
+	// Default: true
+	// Description: If true, homeservers are configured to send federation traffic via mitmproxy, by setting
+	// `HTTPS_PROXY` on them, so tests can intercept it. This uses COMPLEMENT_SHARE_ENV_PREFIX, and does not overwrite a
+	// `HTTPS_PROXY` which is already set under that prefix. Set this to false for homeserver images which already set
+	// `HTTPS_PROXY` or do not support it. Tests which intercept federation traffic are skipped when this is false,
+	// and fail if no federation traffic goes via mitmproxy when this is true.
+	FederationProxy bool
+
+	// Name: COMPLEMENT_CRYPTO_TIMING_PROFILE
+	// Default: local
+	// Description: The timing profile to use. This controls how long language bindings and deployment components
+	// wait for things to happen, e.g how long to wait for the initial sync or for the RPC server to start. Slow
+	// machines should use a profile with a larger multiplier rather than patching timeouts.
+	// ```
+	// Valid values are:
+	//  - `local`: A developer machine (x1).
+	//  - `ci`: Shared CI runners e.g Github Actions (x2).
+	//  - `debug`: Clients built with heavy instrumentation e.g valgrind (x10).
+	// ```
+	// The effective values are printed when the test suite starts.
+	TimingProfile timing.Profile
+
+	// Name: COMPLEMENT_CRYPTO_TIMING_MULTIPLIER
+	// Default: the profile's multiplier
+	// Description: If set, overrides the multiplier of the timing profile given by COMPLEMENT_CRYPTO_TIMING_PROFILE.
+	// If unset, the profile's own multiplier is used, which is 1 for the default `local` profile.
+	// For example, `COMPLEMENT_CRYPTO_TIMING_MULTIPLIER=3.5` would make all durations 3.5x longer than the base durations.
+	TimingMultiplier float64
 }
 
+var hsImageRegex = regexp.MustCompile(`^COMPLEMENT_CRYPTO_BASE_IMAGE_(.+)=(.+)$`)
+
+const (
+	SlidingSyncModeProxy  = "proxy"
+	SlidingSyncModeNative = "native"
+)
+
 func (c *ComplementCrypto) ShouldTest(lang api.ClientTypeLang) bool {
 	return c.clientLangs[lang]
 }
 
+// ShouldTestInProcess returns true if clients in this language should be run in the test process.
+func (c *ComplementCrypto) ShouldTestInProcess(lang api.ClientTypeLang) bool {
+	return c.inProcessLangs[lang]
+}
+
+// ShouldTestMultiprocess returns true if clients in this language should be run in a separate process via RPC.
+func (c *ComplementCrypto) ShouldTestMultiprocess(lang api.ClientTypeLang) bool {
+	return c.multiprocessLangs[lang]
+}
+
+// ExportHomeserverImages configures Complement to use the images in HomeserverImages. Complement reads its
+// configuration from environment variables when the test package starts, so this must be called prior to
+// complement.TestMain.
+func (c *ComplementCrypto) ExportHomeserverImages() {
+	for hsName, image := range c.HomeserverImages {
+		// Complement looks up images by the exact HS name e.g "hs1", so don't upper-case it.
+		os.Setenv("COMPLEMENT_BASE_IMAGE_"+hsName, image)
+		// Complement requires a base image, even if every HS has its own image.
+		if os.Getenv("COMPLEMENT_BASE_IMAGE") == "" {
+			os.Setenv("COMPLEMENT_BASE_IMAGE", image)
+		}
+	}
+}
+
+// ExportHomeserverEnv configures Complement to set the given environment variables on the homeservers it deploys,
+// via COMPLEMENT_SHARE_ENV_PREFIX. If the prefix is already set, the variables are added under it, but variables
+// which are already set under the prefix are not overwritten. Like ExportHomeserverImages, this must be called
+// prior to complement.TestMain.
+func (c *ComplementCrypto) ExportHomeserverEnv(env map[string]string) {
+	prefix := os.Getenv("COMPLEMENT_SHARE_ENV_PREFIX")
+	if prefix == "" {
+		prefix = "COMPLEMENT_CRYPTO_SHARE_ENV_"
+		os.Setenv("COMPLEMENT_SHARE_ENV_PREFIX", prefix)
+	}
+	for k, v := range env {
+		if _, exists := os.LookupEnv(prefix + k); exists {
+			continue
+		}
+		os.Setenv(prefix+k, v)
+	}
+}
+
 // Bindings returns all the known language bindings for this particular complement-crypto configuration. Panics on
-// unknown bindings.
+// unknown bindings. Languages which are only tested in a separate process are included, as tests which only run
+// for a given language (e.g `ShouldTest(api.ClientTypeRust)`) create some of their clients in the test process.
 func (c *ComplementCrypto) Bindings() []api.LanguageBindings {
 	bindings := make([]api.LanguageBindings, 0, len(c.clientLangs))
 	for l := range c.clientLangs {
@@ -74,43 +195,55 @@ func NewComplementCryptoConfigFromEnvVars() *ComplementCrypto {
 	}
 	segs := strings.Split(matrix, ",")
 	clientLangs := make(map[api.ClientTypeLang]bool)
+	inProcessLangs := make(map[api.ClientTypeLang]bool)
+	multiprocessLangs := make(map[api.ClientTypeLang]bool)
 	var testClientMatrix [][2]api.ClientType
-	for _, val := range segs { // e.g val == 'rj'
-		if len(val) != 2 {
-			panic("COMPLEMENT_CRYPTO_TEST_CLIENT_MATRIX bad value: " + val)
-		}
-		testCase := [2]api.ClientType{}
-		for i, ch := range val {
+	for _, val := range segs { // e.g val == 'rj' or 'r+j'
+		var clientTypes []api.ClientType
+		for _, ch := range val {
 			switch ch {
 			case 'r':
-				testCase[i] = api.ClientType{
+				clientTypes = append(clientTypes, api.ClientType{
 					Lang: api.ClientTypeRust,
 					HS:   "hs1",
-				}
-				clientLangs[api.ClientTypeRust] = true
+				})
 			case 'j':
-				testCase[i] = api.ClientType{
+				clientTypes = append(clientTypes, api.ClientType{
 					Lang: api.ClientTypeJS,
 					HS:   "hs1",
-				}
-				clientLangs[api.ClientTypeJS] = true
+				})
 			case 'J':
-				testCase[i] = api.ClientType{
+				clientTypes = append(clientTypes, api.ClientType{
 					Lang: api.ClientTypeJS,
 					HS:   "hs2",
-				}
-				clientLangs[api.ClientTypeJS] = true
+				})
 			case 'R':
-				testCase[i] = api.ClientType{
+				clientTypes = append(clientTypes, api.ClientType{
 					Lang: api.ClientTypeRust,
 					HS:   "hs2",
+				})
+			case '+':
+				// modifies the previous client
+				if len(clientTypes) == 0 || clientTypes[len(clientTypes)-1].Multiprocess {
+					panic("COMPLEMENT_CRYPTO_TEST_CLIENT_MATRIX bad value: " + val)
 				}
-				clientLangs[api.ClientTypeRust] = true
+				clientTypes[len(clientTypes)-1].Multiprocess = true
 			default:
 				panic("COMPLEMENT_CRYPTO_TEST_CLIENT_MATRIX bad value: " + val)
 			}
 		}
-		testClientMatrix = append(testClientMatrix, testCase)
+		if len(clientTypes) != 2 {
+			panic("COMPLEMENT_CRYPTO_TEST_CLIENT_MATRIX bad value: " + val)
+		}
+		for _, ct := range clientTypes {
+			clientLangs[ct.Lang] = true
+			if ct.Multiprocess {
+				multiprocessLangs[ct.Lang] = true
+			} else {
+				inProcessLangs[ct.Lang] = true
+			}
+		}
+		testClientMatrix = append(testClientMatrix, [2]api.ClientType{clientTypes[0], clientTypes[1]})
 	}
 	if len(testClientMatrix) == 0 {
 		panic("COMPLEMENT_CRYPTO_TEST_CLIENT_MATRIX: no tests will run as no matrix values are set")
@@ -120,11 +253,71 @@ func NewComplementCryptoConfigFromEnvVars() *ComplementCrypto {
 		if _, err := os.Stat(rpcBinaryPath); err != nil {
 			panic("COMPLEMENT_CRYPTO_RPC_BINARY must be the absolute path to a binary file: " + err.Error())
 		}
+	} else if len(multiprocessLangs) > 0 {
+		panic("COMPLEMENT_CRYPTO_TEST_CLIENT_MATRIX: multiprocess clients ('+') require COMPLEMENT_CRYPTO_RPC_BINARY to be set")
 	}
+	slidingSyncMode := os.Getenv("COMPLEMENT_CRYPTO_SLIDING_SYNC_MODE")
+	switch slidingSyncMode {
+	case "":
+		slidingSyncMode = SlidingSyncModeProxy
+	case SlidingSyncModeProxy, SlidingSyncModeNative:
+	default:
+		panic("COMPLEMENT_CRYPTO_SLIDING_SYNC_MODE bad value: " + slidingSyncMode)
+	}
+	homeserverImages := make(map[string]string)
+	for _, env := range os.Environ() {
+		if matches := hsImageRegex.FindStringSubmatch(env); len(matches) == 3 {
+			homeserverImages[strings.ToLower(matches[1])] = matches[2]
+		}
+	}
+	federationProxy := true
+	if federationProxyStr := os.Getenv("COMPLEMENT_CRYPTO_FEDERATION_PROXY"); federationProxyStr != "" {
+		var err error
+		federationProxy, err = strconv.ParseBool(federationProxyStr)
+		if err != nil {
+			panic("COMPLEMENT_CRYPTO_FEDERATION_PROXY must be true or false, got: " + federationProxyStr)
+		}
+	}
+	timingMultiplier := timingMultiplierFromEnvVars()
 	return &ComplementCrypto{
-		MITMDump:         os.Getenv("COMPLEMENT_CRYPTO_MITMDUMP"),
-		RPCBinaryPath:    rpcBinaryPath,
-		TestClientMatrix: testClientMatrix,
-		clientLangs:      clientLangs,
+		MITMDump:            os.Getenv("COMPLEMENT_CRYPTO_MITMDUMP"),
+		RPCBinaryPath:       rpcBinaryPath,
+		SlidingSyncMode:     slidingSyncMode,
+		DeploymentStateFile: os.Getenv("COMPLEMENT_CRYPTO_DEPLOYMENT_STATE_FILE"),
+		HomeserverImages:    homeserverImages,
+		FederationProxy:     federationProxy,
+		TestClientMatrix:    testClientMatrix,
+		TimingProfile:       NewTimingProfileFromEnvVars(),
+		TimingMultiplier:    timingMultiplier,
+		clientLangs:         clientLangs,
+		inProcessLangs:      inProcessLangs,
+		multiprocessLangs:   multiprocessLangs,
+	}
+}
+
+// NewTimingProfileFromEnvVars returns the timing profile configured via COMPLEMENT_CRYPTO_TIMING_PROFILE
+// and COMPLEMENT_CRYPTO_TIMING_MULTIPLIER. This is separate to NewComplementCryptoConfigFromEnvVars so
+// child processes (e.g the RPC server) can use the same timing profile as the test process.
+func NewTimingProfileFromEnvVars() timing.Profile {
+	profileName := os.Getenv("COMPLEMENT_CRYPTO_TIMING_PROFILE")
+	if profileName == "" {
+		profileName = "local"
+	}
+	profile, err := timing.NewProfile(profileName, timingMultiplierFromEnvVars())
+	if err != nil {
+		panic("COMPLEMENT_CRYPTO_TIMING_PROFILE: " + err.Error())
+	}
+	return profile
+}
+
+func timingMultiplierFromEnvVars() float64 {
+	multiplierStr := os.Getenv("COMPLEMENT_CRYPTO_TIMING_MULTIPLIER")
+	if multiplierStr == "" {
+		return 0
+	}
+	multiplier, err := strconv.ParseFloat(multiplierStr, 64)
+	if err != nil || multiplier <= 0 {
+		panic("COMPLEMENT_CRYPTO_TIMING_MULTIPLIER must be a positive number, got: " + multiplierStr)
 	}
+	return multiplier
 }
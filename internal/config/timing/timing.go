@@ -0,0 +1,154 @@
+// Package timing contains the timing profile, which controls how long language bindings and
+// deployment components wait for things to happen. It is separate from the config package so
+// that language bindings can read it without an import cycle.
+package timing
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Profile is the set of durations used by language bindings and deployment components
+// when waiting for things to happen. Slow machines (e.g shared CI runners, or clients built with
+// debug instrumentation) can select a profile with a larger multiplier rather than patching code.
+//
+// All durations in a Profile are effective values: the profile multiplier has already
+// been applied to them. Use NewProfile to make a profile.
+type Profile struct {
+	// The name of the profile e.g "local", "ci", "debug".
+	Name string
+	// The multiplier applied to the base durations to produce this profile.
+	Multiplier float64
+
+	// How long StartSyncing waits for the initial sync to complete.
+	StartSyncingTimeout time.Duration
+	// How long TrySendMessage waits for the sent event to come down the timeline.
+	SendMessageTimeout time.Duration
+	// How long to sleep after the initial sync to let outgoing requests (e.g /keys/upload) go out,
+	// for clients which have no callback for this.
+	SyncSettleDelay time.Duration
+	// How long to wait for key backups to be created.
+	KeyBackupTimeout time.Duration
+	// How long to sleep after creating a key backup to let the client upload keys to it,
+	// for clients which have no callback for this.
+	KeyBackupUploadDelay time.Duration
+	// How long the RPC server process can go without receiving a command, or having the test process connected
+	// to its notification stream, before it terminates.
+	RPCInactivityThreshold time.Duration
+	// How long to wait for the RPC server process to echo its port number on startup.
+	RPCStartupTimeout time.Duration
+	// How long to wait for the RPC server process to exit after a graceful termination, before killing it.
+	RPCTerminateTimeout time.Duration
+	// How long to wait for a single RPC call to the RPC server process e.g if it was left suspended.
+	RPCCallTimeout time.Duration
+	// How long to wait for requests to the mitmproxy controller.
+	MITMClientTimeout time.Duration
+	// How long to wait for all deployment containers to start.
+	DeploymentTimeout time.Duration
+}
+
+// The base durations, before any multiplier is applied. These are tuned for a reasonably fast
+// developer machine.
+var baseProfile = Profile{
+	Name:                   "local",
+	Multiplier:             1,
+	StartSyncingTimeout:    5 * time.Second,
+	SendMessageTimeout:     11 * time.Second,
+	SyncSettleDelay:        500 * time.Millisecond,
+	KeyBackupTimeout:       5 * time.Second,
+	KeyBackupUploadDelay:   11 * time.Second,
+	RPCInactivityThreshold: 30 * time.Second,
+	RPCStartupTimeout:      time.Second,
+	RPCTerminateTimeout:    10 * time.Second,
+	RPCCallTimeout:         60 * time.Second,
+	MITMClientTimeout:      5 * time.Second,
+	DeploymentTimeout:      60 * time.Second,
+}
+
+// ProfileMultipliers are the known timing profile names and their multipliers.
+var ProfileMultipliers = map[string]float64{
+	"local": 1,  // a developer machine
+	"ci":    2,  // shared CI runners e.g GHA
+	"debug": 10, // clients built with heavy instrumentation e.g valgrind, sanitizers
+}
+
+// NewProfile creates a timing profile with the given name. If multiplier is > 0, it is used instead
+// of the profile's own multiplier. Returns an error if the profile name is unknown.
+func NewProfile(name string, multiplier float64) (Profile, error) {
+	profileMultiplier, ok := ProfileMultipliers[name]
+	if !ok {
+		return Profile{}, fmt.Errorf("unknown timing profile '%s', valid profiles: %s", name, strings.Join(profileNames(), ","))
+	}
+	if multiplier > 0 {
+		profileMultiplier = multiplier
+	}
+	scale := func(d time.Duration) time.Duration {
+		return time.Duration(float64(d) * profileMultiplier)
+	}
+	b := baseProfile
+	return Profile{
+		Name:                   name,
+		Multiplier:             profileMultiplier,
+		StartSyncingTimeout:    scale(b.StartSyncingTimeout),
+		SendMessageTimeout:     scale(b.SendMessageTimeout),
+		SyncSettleDelay:        scale(b.SyncSettleDelay),
+		KeyBackupTimeout:       scale(b.KeyBackupTimeout),
+		KeyBackupUploadDelay:   scale(b.KeyBackupUploadDelay),
+		RPCInactivityThreshold: scale(b.RPCInactivityThreshold),
+		RPCStartupTimeout:      scale(b.RPCStartupTimeout),
+		RPCTerminateTimeout:    scale(b.RPCTerminateTimeout),
+		RPCCallTimeout:         scale(b.RPCCallTimeout),
+		MITMClientTimeout:      scale(b.MITMClientTimeout),
+		DeploymentTimeout:      scale(b.DeploymentTimeout),
+	}, nil
+}
+
+// Scale multiplies an arbitrary duration by this profile's multiplier. Useful for tests which
+// have their own timeouts.
+func (p Profile) Scale(d time.Duration) time.Duration {
+	return time.Duration(float64(d) * p.Multiplier)
+}
+
+func (p Profile) String() string {
+	return fmt.Sprintf(
+		"timing profile '%s' (x%v): StartSyncingTimeout=%v SendMessageTimeout=%v SyncSettleDelay=%v "+
+			"KeyBackupTimeout=%v KeyBackupUploadDelay=%v RPCInactivityThreshold=%v RPCStartupTimeout=%v "+
+			"RPCTerminateTimeout=%v RPCCallTimeout=%v MITMClientTimeout=%v DeploymentTimeout=%v",
+		p.Name, p.Multiplier, p.StartSyncingTimeout, p.SendMessageTimeout, p.SyncSettleDelay,
+		p.KeyBackupTimeout, p.KeyBackupUploadDelay, p.RPCInactivityThreshold, p.RPCStartupTimeout,
+		p.RPCTerminateTimeout, p.RPCCallTimeout, p.MITMClientTimeout, p.DeploymentTimeout,
+	)
+}
+
+func profileNames() []string {
+	names := make([]string, 0, len(ProfileMultipliers))
+	for name := range ProfileMultipliers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var (
+	currentProfile   = baseProfile
+	currentProfileMu = &sync.RWMutex{}
+)
+
+// Set sets the timing profile used by all language bindings and deployment components
+// in this process. This should be called once on startup, before any clients are made.
+func Set(p Profile) {
+	currentProfileMu.Lock()
+	defer currentProfileMu.Unlock()
+	currentProfile = p
+}
+
+// Get returns the timing profile for this process. Defaults to the "local" profile
+// if Set was never called.
+func Get() Profile {
+	currentProfileMu.RLock()
+	defer currentProfileMu.RUnlock()
+	return currentProfile
+}
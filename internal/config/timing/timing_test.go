@@ -0,0 +1,32 @@
+package timing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/must"
+)
+
+func TestNewProfile(t *testing.T) {
+	local, err := NewProfile("local", 0)
+	must.NotError(t, "NewProfile(local)", err)
+	must.Equal(t, local.StartSyncingTimeout, 5*time.Second, "local StartSyncingTimeout")
+	must.Equal(t, local.Scale(time.Second), time.Second, "local Scale")
+
+	ci, err := NewProfile("ci", 0)
+	must.NotError(t, "NewProfile(ci)", err)
+	must.Equal(t, ci.Multiplier, 2.0, "ci Multiplier")
+	must.Equal(t, ci.StartSyncingTimeout, 10*time.Second, "ci StartSyncingTimeout")
+	must.Equal(t, ci.SyncSettleDelay, time.Second, "ci SyncSettleDelay")
+
+	// multiplier overrides the profile's own multiplier
+	overridden, err := NewProfile("ci", 0.5)
+	must.NotError(t, "NewProfile(ci, 0.5)", err)
+	must.Equal(t, overridden.Name, "ci", "overridden Name")
+	must.Equal(t, overridden.RPCInactivityThreshold, 15*time.Second, "overridden RPCInactivityThreshold")
+
+	_, err = NewProfile("bogus", 0)
+	if err == nil {
+		t.Fatalf("NewProfile(bogus) did not return an error")
+	}
+}
@@ -0,0 +1,87 @@
+package deploy
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+)
+
+// WithMITMAddons validates the addon options and executes inner() whilst they are in effect. The test fails
+// if the options are invalid. See WithMITMOptions.
+func (d *SlidingSyncDeployment) WithMITMAddons(t *testing.T, addons []mitm.Addon, inner func()) {
+	t.Helper()
+	d.WithScopedMITMAddons(t, MITMScope{}, addons, inner)
+}
+
+// WithScopedMITMAddons is like WithMITMAddons but the options only apply to flows in the scope.
+func (d *SlidingSyncDeployment) WithScopedMITMAddons(t *testing.T, scope MITMScope, addons []mitm.Addon, inner func()) {
+	t.Helper()
+	options, err := mitm.Options(addons...)
+	if err != nil {
+		t.Fatalf("WithMITMAddons: %s", err)
+	}
+	d.WithScopedMITMOptions(t, scope, options, inner)
+}
+
+// WithRewrittenBodies applies JSON patch operations to the JSON bodies of requests or responses which match
+// the filter, whilst inner() executes. Bodies which are not JSON are not modified. For example, to remove the
+// OTK counts from all /sync responses:
+//
+//	deployment.WithRewrittenBodies(t, mitm.RewriteOptions{
+//		Filter:  mitm.PathContains("/sync"),
+//		Patches: []mitm.JSONPatch{mitm.PatchRemove("/device_one_time_keys_count")},
+//	}, func() { ... })
+func (d *SlidingSyncDeployment) WithRewrittenBodies(t *testing.T, opts mitm.RewriteOptions, inner func()) {
+	t.Helper()
+	d.WithMITMAddons(t, []mitm.Addon{opts}, inner)
+}
+
+// WithLatency delays requests or responses which match the filter whilst inner() executes. This can be used
+// to test behaviour when the server is slow to respond, e.g when /keys/claim is slower than a send timeout.
+func (d *SlidingSyncDeployment) WithLatency(t *testing.T, opts mitm.LatencyOptions, inner func()) {
+	t.Helper()
+	d.WithMITMAddons(t, []mitm.Addon{opts}, inner)
+}
+
+// WithChaos fails a random percentage of flows which match the filter whilst inner() executes. opts.Chaos must
+// be set. If the chaos seed is 0, a seed is picked at random. The seed is always logged so failures can be reproduced.
+func (d *SlidingSyncDeployment) WithChaos(t *testing.T, opts mitm.StatusCodeOptions, inner func()) {
+	t.Helper()
+	if opts.Chaos == nil {
+		t.Fatalf("WithChaos: no chaos options provided")
+	}
+	chaos := *opts.Chaos
+	if chaos.Seed == 0 {
+		chaos.Seed = rand.Int63()
+	}
+	opts.Chaos = &chaos
+	t.Logf("WithChaos: failing %d%% of flows with %v seed=%d", chaos.Percent, chaos.StatusCodes, chaos.Seed)
+	d.WithMITMAddons(t, []mitm.Addon{opts}, inner)
+}
+
+// WithRateLimits rate limits requests which match the filter whilst inner() executes. Rate limited requests do not
+// reach the server.
+func (d *SlidingSyncDeployment) WithRateLimits(t *testing.T, opts mitm.RateLimitOptions, inner func()) {
+	t.Helper()
+	d.WithMITMAddons(t, []mitm.Addon{opts}, inner)
+}
+
+// WithFaults injects connection-level faults into responses which match the filter whilst inner() executes.
+// Unlike WithMITMOptions with the statuscode addon, the client sees a broken or slow connection rather than an
+// HTTP error e.g a connection reset part way through the body of a /sync response.
+func (d *SlidingSyncDeployment) WithFaults(t *testing.T, opts mitm.FaultOptions, inner func()) {
+	t.Helper()
+	d.WithMITMAddons(t, []mitm.Addon{opts}, inner)
+}
+
+// RateLimitClient returns a rate limit for the client's user. The limit applies to all of the user's devices
+// and access tokens.
+func RateLimitClient(client api.Client, perSecond float64, burst int) mitm.RateLimit {
+	return mitm.RateLimit{
+		UserID:    client.UserID(),
+		PerSecond: perSecond,
+		Burst:     burst,
+	}
+}
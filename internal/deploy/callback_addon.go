@@ -1,22 +1,21 @@
 package deploy
 
 import (
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
-	"strings"
 	"testing"
 	"time"
 
 	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement-crypto/internal/config/timing"
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
 	"github.com/matrix-org/complement/ct"
 	"github.com/matrix-org/complement/must"
 )
 
-var lastTestName string
-
 type CallbackData struct {
 	Method       string          `json:"method"`
 	URL          string          `json:"url"`
@@ -24,20 +23,73 @@ type CallbackData struct {
 	ResponseCode int             `json:"response_code"`
 	ResponseBody json.RawMessage `json:"response_body"`
 	RequestBody  json.RawMessage `json:"request_body"`
+	// True if this is a server-server request. The AccessToken is empty for federation requests.
+	Federation bool `json:"federation"`
+	// The sending and receiving server names for federation requests, from the X-Matrix Authorization header.
+	Origin      string `json:"origin"`
+	Destination string `json:"destination"`
+	// The user and device which sent this client-server request, resolved from the access token by mitmproxy.
+	// Empty if the access token could not be resolved.
+	UserID   string `json:"user_id"`
+	DeviceID string `json:"device_id"`
+	// The total delay added to this flow by the Latency addon, in milliseconds.
+	LatencyMS float64 `json:"latency_ms"`
+	// The fault injected into this flow by the Fault addon, or empty if it was not faulted.
+	Fault mitm.FaultMode `json:"fault"`
+	// Unix timestamps in seconds of when mitmproxy finished reading the request from the client, and when it
+	// started reading the response from the server. Latency added to requests falls between the two.
+	RequestTimestamp  float64 `json:"request_timestamp"`
+	ResponseTimestamp float64 `json:"response_timestamp"`
+	// The sequence number of this flow. Only set for flows returned by FlowsSince.
+	Seq int64 `json:"seq"`
 }
 
 func (cd CallbackData) String() string {
+	if cd.Federation {
+		return fmt.Sprintf("%s %s (federation %s=>%s) req_len=%d => HTTP %v", cd.Method, cd.URL, cd.Origin, cd.Destination, len(cd.RequestBody), cd.ResponseCode)
+	}
+	if cd.UserID != "" {
+		return fmt.Sprintf("%s %s (%s|%s) req_len=%d => HTTP %v", cd.Method, cd.URL, cd.UserID, cd.DeviceID, len(cd.RequestBody), cd.ResponseCode)
+	}
 	return fmt.Sprintf("%s %s (token=%s) req_len=%d => HTTP %v", cd.Method, cd.URL, cd.AccessToken, len(cd.RequestBody), cd.ResponseCode)
 }
 
+// Verdict decides what happens to an intercepted response before it is forwarded to the client.
+// A nil *Verdict forwards the response unmodified.
+type Verdict struct {
+	// If non-zero, replace the response status code.
+	StatusCode int
+	// If non-nil, replace the response body with this JSON.
+	Body json.RawMessage
+	// If non-zero, delay delivery of the response by this duration.
+	Delay time.Duration
+}
+
+func (v Verdict) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		StatusCode int             `json:"status_code,omitempty"`
+		Body       json.RawMessage `json:"body,omitempty"`
+		DelayMS    int64           `json:"delay_ms,omitempty"`
+	}{
+		StatusCode: v.StatusCode,
+		Body:       v.Body,
+		DelayMS:    v.Delay.Milliseconds(),
+	})
+}
+
 // NewCallbackServer runs a local HTTP server that can read callbacks from mitmproxy.
 // Returns the URL of the callback server for use with WithMITMOptions, along with a close function
 // which should be called when the test finishes to shut down the HTTP server.
 func NewCallbackServer(t *testing.T, deployment complement.Deployment, cb func(CallbackData)) (callbackURL string, close func()) {
-	if lastTestName != "" {
-		t.Logf("WARNING[%s]: NewCallbackServer called without closing the last one. Check test '%s'", t.Name(), lastTestName)
-	}
-	lastTestName = t.Name()
+	return newCallbackServer(t, deployment, func(data CallbackData) interface{} {
+		cb(data)
+		return nil
+	})
+}
+
+// newCallbackServer is like NewCallbackServer but the callback can return a value, which is sent back to
+// mitmproxy as a JSON response body.
+func newCallbackServer(t *testing.T, deployment complement.Deployment, cb func(CallbackData) interface{}) (callbackURL string, close func()) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		var data CallbackData
@@ -46,16 +98,15 @@ func NewCallbackServer(t *testing.T, deployment complement.Deployment, cb func(C
 			w.WriteHeader(500)
 			return
 		}
-		localpart := ""
-		if strings.HasPrefix(data.AccessToken, "syt_") {
-			maybeLocalpart, _ := base64.RawStdEncoding.DecodeString(strings.Split(data.AccessToken, "_")[1])
-			if maybeLocalpart != nil {
-				localpart = string(maybeLocalpart)
-			}
+		t.Logf("CallbackServer[%s]: %v %s", t.Name(), time.Now(), data)
+		res := cb(data)
+		if res == nil {
+			w.WriteHeader(200)
+			return
 		}
-		t.Logf("CallbackServer[%s]%s: %v %s", t.Name(), localpart, time.Now(), data)
-		cb(data)
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(res)
 	})
 	// listen on a random high numbered port
 	ln, err := net.Listen("tcp", ":0") //nolint
@@ -67,7 +118,11 @@ func NewCallbackServer(t *testing.T, deployment complement.Deployment, cb func(C
 	}
 	go srv.Serve(ln)
 	return fmt.Sprintf("http://%s:%d", deployment.GetConfig().HostnameRunningComplement, port), func() {
-		srv.Close()
-		lastTestName = ""
+		// let in-flight callbacks write their responses, as mitmproxy may be waiting on them
+		ctx, cancel := context.WithTimeout(context.Background(), timing.Get().Scale(5*time.Second))
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			srv.Close()
+		}
 	}
 }
@@ -0,0 +1,203 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/matrix-org/complement-crypto/internal/config/timing"
+	"github.com/matrix-org/complement/ct"
+	testcontainers "github.com/testcontainers/testcontainers-go"
+)
+
+// StopServer gracefully stops a server in this deployment. The name can be a homeserver (hs1, hs2), a sliding sync
+// proxy (ssproxy1, ssproxy2) or postgres. Unlike complement.Deployment.StopServer, the reverse proxy URLs of the
+// server are preserved so existing clients continue to work when the server is started again via StartServer.
+func (d *SlidingSyncDeployment) StopServer(t ct.TestLike, name string) {
+	t.Helper()
+	if d.isHomeserver(name) {
+		d.Deployment.StopServer(t, name)
+		return
+	}
+	t.Logf("StopServer %s", name)
+	containerID := d.serverContainerID(t, name)
+	withDockerClient(t, func(ctx context.Context, dockerClient *testcontainers.DockerClient) error {
+		return dockerClient.ContainerStop(ctx, containerID, container.StopOptions{})
+	})
+}
+
+// KillServer uncleanly stops a server in this deployment by sending SIGKILL. The name can be any name accepted by
+// StopServer. The server can be started again via StartServer.
+func (d *SlidingSyncDeployment) KillServer(t ct.TestLike, name string) {
+	t.Helper()
+	t.Logf("KillServer %s", name)
+	containerID := d.serverContainerID(t, name)
+	withDockerClient(t, func(ctx context.Context, dockerClient *testcontainers.DockerClient) error {
+		return dockerClient.ContainerKill(ctx, containerID, "SIGKILL")
+	})
+}
+
+// StartServer starts a server previously stopped via StopServer or KillServer, and waits for it to be ready.
+// The server keeps its DNS alias on the docker network, and its reverse proxy URL.
+func (d *SlidingSyncDeployment) StartServer(t ct.TestLike, name string) {
+	t.Helper()
+	if d.isHomeserver(name) {
+		d.Deployment.StartServer(t, name)
+		d.waitForServer(t, name)
+		return
+	}
+	t.Logf("StartServer %s", name)
+	containerID := d.serverContainerID(t, name)
+	withDockerClient(t, func(ctx context.Context, dockerClient *testcontainers.DockerClient) error {
+		return dockerClient.ContainerStart(ctx, containerID, types.ContainerStartOptions{})
+	})
+	d.waitForServer(t, name)
+}
+
+// PauseServer suspends a running server via `docker pause`, preserving its state in memory. The name can be
+// any name accepted by StopServer.
+func (d *SlidingSyncDeployment) PauseServer(t ct.TestLike, name string) {
+	t.Helper()
+	if d.isHomeserver(name) {
+		d.Deployment.PauseServer(t, name)
+		return
+	}
+	t.Logf("PauseServer %s", name)
+	containerID := d.serverContainerID(t, name)
+	withDockerClient(t, func(ctx context.Context, dockerClient *testcontainers.DockerClient) error {
+		return dockerClient.ContainerPause(ctx, containerID)
+	})
+}
+
+// UnpauseServer resumes a server previously paused via PauseServer.
+func (d *SlidingSyncDeployment) UnpauseServer(t ct.TestLike, name string) {
+	t.Helper()
+	if d.isHomeserver(name) {
+		d.Deployment.UnpauseServer(t, name)
+		return
+	}
+	t.Logf("UnpauseServer %s", name)
+	containerID := d.serverContainerID(t, name)
+	withDockerClient(t, func(ctx context.Context, dockerClient *testcontainers.DockerClient) error {
+		return dockerClient.ContainerUnpause(ctx, containerID)
+	})
+}
+
+func (d *SlidingSyncDeployment) isHomeserver(name string) bool {
+	return name == "hs1" || name == "hs2"
+}
+
+// serverContainerID returns the container ID for the named server, failing the test if the name is unknown.
+// mitmproxy cannot be controlled this way, as tests rely on it to control the deployment.
+func (d *SlidingSyncDeployment) serverContainerID(t ct.TestLike, name string) string {
+	t.Helper()
+	if d.isHomeserver(name) {
+		return d.Deployment.ContainerID(t, name)
+	}
+	containerID, ok := d.containerIDs[name]
+	if !ok || name == "mitmproxy" {
+		ct.Fatalf(t, "unknown server '%s'", name)
+	}
+	return containerID
+}
+
+// waitForServer waits until the named server is serving requests, failing the test if it does not do so
+// within the deployment timeout.
+func (d *SlidingSyncDeployment) waitForServer(t ct.TestLike, name string) {
+	t.Helper()
+	var isReady func() error
+	switch {
+	case d.isHomeserver(name):
+		isReady = d.httpReadyCheck(name, "/_matrix/client/versions")
+	case strings.HasPrefix(name, "ssproxy"):
+		isReady = d.httpReadyCheck(name, "/")
+	case name == "postgres":
+		containerID := d.serverContainerID(t, name)
+		isReady = func() error {
+			return execInContainer(containerID, []string{"pg_isready"})
+		}
+	default:
+		return
+	}
+	deadline := time.Now().Add(timing.Get().DeploymentTimeout)
+	for {
+		err := isReady()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			ct.Fatalf(t, "%s did not become ready: %s", name, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// httpReadyCheck returns a function which hits the server via mitmproxy. mitmproxy returns HTTP 502 when it
+// cannot reach the server.
+func (d *SlidingSyncDeployment) httpReadyCheck(name, path string) func() error {
+	httpClient := &http.Client{Timeout: timing.Get().Scale(time.Second)}
+	return func() error {
+		d.mu.RLock()
+		u := d.dnsToReverseProxyURL[name] + path
+		d.mu.RUnlock()
+		res, err := httpClient.Get(u)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode == http.StatusBadGateway || res.StatusCode == http.StatusServiceUnavailable {
+			return fmt.Errorf("GET %s returned HTTP %d", u, res.StatusCode)
+		}
+		return nil
+	}
+}
+
+// withDockerClient calls fn with a new docker client, failing the test if fn returns an error.
+func withDockerClient(t ct.TestLike, fn func(ctx context.Context, dockerClient *testcontainers.DockerClient) error) {
+	t.Helper()
+	ctx := context.Background()
+	dockerClient, err := testcontainers.NewDockerClientWithOpts(ctx)
+	if err != nil {
+		ct.Fatalf(t, "failed to make docker client: %s", err)
+	}
+	defer dockerClient.Close()
+	if err = fn(ctx, dockerClient); err != nil {
+		ct.Fatalf(t, "docker: %s", err)
+	}
+}
+
+// execInContainer runs the command in the container and returns an error if it does not exit with 0.
+func execInContainer(containerID string, cmd []string) error {
+	ctx := context.Background()
+	dockerClient, err := testcontainers.NewDockerClientWithOpts(ctx)
+	if err != nil {
+		return err
+	}
+	defer dockerClient.Close()
+	execID, err := dockerClient.ContainerExecCreate(ctx, containerID, types.ExecConfig{
+		Cmd: cmd,
+	})
+	if err != nil {
+		return err
+	}
+	if err = dockerClient.ContainerExecStart(ctx, execID.ID, types.ExecStartCheck{}); err != nil {
+		return err
+	}
+	for {
+		inspect, err := dockerClient.ContainerExecInspect(ctx, execID.ID)
+		if err != nil {
+			return err
+		}
+		if !inspect.Running {
+			if inspect.ExitCode != 0 {
+				return fmt.Errorf("%v exited with code %d", cmd, inspect.ExitCode)
+			}
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,84 @@
+package deploy
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// The directory HAR files are written to, relative to the tests directory.
+const harDir = "./logs"
+
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// RecordHAR records the flows through mitmproxy which were made by this test until it finishes. When the test
+// finishes, the flows are written as a HAR file to ./logs/<test name>.har, which can be opened in the
+// devtools of any browser. Flows are attributed to the test by the users registered in it, so tests can run
+// in parallel. Federation traffic is not recorded, as it cannot be attributed to a test. If a subtest also calls
+// RecordHAR, the users it registers are recorded in its own HAR file instead. Calling this more than once in
+// the same test has no effect.
+func (d *SlidingSyncDeployment) RecordHAR(t *testing.T) {
+	t.Helper()
+	testName := t.Name()
+	d.harTestsMu.Lock()
+	if d.harTests == nil {
+		d.harTests = make(map[string]bool)
+	}
+	recording := d.harTests[testName]
+	d.harTests[testName] = true
+	d.harTestsMu.Unlock()
+	if recording {
+		return
+	}
+	var res struct{}
+	d.doMITMRequest(t, "/tests/start", map[string]interface{}{
+		"test_name": testName,
+	}, &res)
+	// runs after all other cleanup functions, so flows made whilst cleaning up are included
+	t.Cleanup(func() {
+		d.harTestsMu.Lock()
+		delete(d.harTests, testName)
+		d.harTestsMu.Unlock()
+		var har json.RawMessage
+		d.doMITMRequest(t, "/tests/end", map[string]interface{}{
+			"test_name": testName,
+		}, &har)
+		if err := os.MkdirAll(harDir, 0755); err != nil {
+			t.Logf("RecordHAR: failed to create %s: %s", harDir, err)
+			return
+		}
+		filename := filepath.Join(harDir, unsafeFilenameChars.ReplaceAllString(testName, "_")+".har")
+		if err := os.WriteFile(filename, har, 0644); err != nil {
+			t.Logf("RecordHAR: failed to write %s: %s", filename, err)
+		}
+	})
+}
+
+// claimUserForHAR records the user's flows in the HAR file of the closest test which is recording, if any.
+func (d *SlidingSyncDeployment) claimUserForHAR(t ct.TestLike, userID string) {
+	t.Helper()
+	testName := t.Name()
+	d.harTestsMu.Lock()
+	for testName != "" && !d.harTests[testName] {
+		parent := strings.LastIndex(testName, "/")
+		if parent == -1 {
+			testName = ""
+		} else {
+			testName = testName[:parent]
+		}
+	}
+	d.harTestsMu.Unlock()
+	if testName == "" {
+		return
+	}
+	var res struct{}
+	d.doMITMRequest(t, "/tests/claim", map[string]interface{}{
+		"test_name": testName,
+		"user_id":   userID,
+	}, &res)
+}
@@ -0,0 +1,57 @@
+package deploy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/complement/must"
+)
+
+func TestClaimUserForHAR(t *testing.T) {
+	var mu sync.Mutex
+	claims := make(map[string]string) // user_id => test_name
+	// acts as mitmproxy: requests to the controller are proxied, so have absolute URLs
+	controller := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.String() == magicMITMURL+"/tests/claim" {
+			var body struct {
+				TestName string `json:"test_name"`
+				UserID   string `json:"user_id"`
+			}
+			must.NotError(t, "failed to decode claim", json.NewDecoder(r.Body).Decode(&body))
+			mu.Lock()
+			claims[body.UserID] = body.TestName
+			mu.Unlock()
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer controller.Close()
+	d := &SlidingSyncDeployment{
+		mitmClient: newMITMClient(t, controller.URL),
+	}
+
+	// not recording, so nothing is claimed
+	d.claimUserForHAR(t, "@nobody:hs1")
+
+	d.harTests = map[string]bool{t.Name(): true}
+	d.claimUserForHAR(t, "@parent:hs1")
+	t.Run("nested", func(t *testing.T) {
+		// subtests which don't record belong to the closest test which does
+		d.claimUserForHAR(t, "@child:hs1")
+		t.Run("recording", func(t *testing.T) {
+			d.harTestsMu.Lock()
+			d.harTests[t.Name()] = true
+			d.harTestsMu.Unlock()
+			d.claimUserForHAR(t, "@grandchild:hs1")
+		})
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	must.Equal(t, len(claims), 3, "number of claims")
+	must.Equal(t, claims["@parent:hs1"], "TestClaimUserForHAR", "parent claim")
+	must.Equal(t, claims["@child:hs1"], "TestClaimUserForHAR", "child claim")
+	must.Equal(t, claims["@grandchild:hs1"], "TestClaimUserForHAR/nested/recording", "grandchild claim")
+}
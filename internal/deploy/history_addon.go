@@ -0,0 +1,94 @@
+package deploy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/config/timing"
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/must"
+)
+
+// FlowMark is a point in the history of flows through mitmproxy.
+type FlowMark int64
+
+// MarkFlows returns a mark for use with FlowsSince. The mark is after all flows which have completed so far.
+func (d *SlidingSyncDeployment) MarkFlows(t *testing.T) FlowMark {
+	t.Helper()
+	var res struct {
+		Seq int64 `json:"seq"`
+	}
+	d.doMITMRequest(t, "/flows/mark", map[string]interface{}{}, &res)
+	return FlowMark(res.Seq)
+}
+
+// FlowsSince returns all flows which completed after the mark, in the order they completed, which match the
+// mitmproxy filter. If the filter is the zero value, all flows are returned. The test fails if the filter is invalid. Flows which have not completed yet are not
+// included. mitmproxy only remembers a bounded number of flows, so marks should not be held for long. This allows
+// tests to make assertions on traffic after the fact, without registering a callback server up front:
+//
+//	mark := deployment.MarkFlows(t)
+//	... do something ...
+//	for _, flow := range deployment.FlowsSince(t, mark, mitm.PathContains("/sendToDevice")) { ... }
+func (d *SlidingSyncDeployment) FlowsSince(t *testing.T, mark FlowMark, filter mitm.Filter) []CallbackData {
+	t.Helper()
+	if err := filter.Validate(); err != nil {
+		t.Fatalf("FlowsSince: invalid filter: %s", err)
+	}
+	var res struct {
+		Flows []CallbackData `json:"flows"`
+	}
+	d.doMITMRequest(t, "/flows/since", map[string]interface{}{
+		"seq":    int64(mark),
+		"filter": filter.String(),
+	}, &res)
+	return res.Flows
+}
+
+// WaitForFlows polls FlowsSince until pred returns true for the flows which match the filter, then returns those
+// flows. The test fails if pred does not return true within the timing profile's scaled 10s. This is for traffic which
+// is sent asynchronously, where the flow may not have completed by the time the client call returns:
+//
+//	flows := deployment.WaitForFlows(t, mark, mitm.PathContains("/keys/upload"), func(flows []deploy.CallbackData) bool {
+//		return len(flows) >= 2
+//	})
+func (d *SlidingSyncDeployment) WaitForFlows(t *testing.T, mark FlowMark, filter mitm.Filter, pred func(flows []CallbackData) bool) []CallbackData {
+	t.Helper()
+	timeout := timing.Get().Scale(10 * time.Second)
+	deadline := time.Now().Add(timeout)
+	for {
+		flows := d.FlowsSince(t, mark, filter)
+		if pred(flows) {
+			return flows
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("WaitForFlows: timed out after %s waiting for flows matching '%s', saw %d matching flows", timeout, filter, len(flows))
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// doMITMRequest POSTs the JSON body to the mitmproxy controller and decodes the JSON response into res.
+func (d *SlidingSyncDeployment) doMITMRequest(t ct.TestLike, path string, body interface{}, res interface{}) {
+	t.Helper()
+	jsonBody, err := json.Marshal(body)
+	must.NotError(t, "failed to marshal body", err)
+	req, err := http.NewRequest("POST", magicMITMURL+path, bytes.NewBuffer(jsonBody))
+	must.NotError(t, "failed to prepare request", err)
+	req.Header.Set("Content-Type", "application/json")
+	httpRes, err := d.mitmClient.Do(req)
+	must.NotError(t, "failed to POST "+path, err)
+	defer httpRes.Body.Close()
+	resBody, err := io.ReadAll(httpRes.Body)
+	must.NotError(t, "failed to read response", err)
+	if httpRes.StatusCode != 200 {
+		t.Fatalf("controller returned HTTP %d for %s: %s", httpRes.StatusCode, path, string(resBody))
+	}
+	must.NotError(t, "failed to decode response", json.Unmarshal(resBody, res))
+}
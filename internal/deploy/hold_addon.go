@@ -0,0 +1,85 @@
+package deploy
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+)
+
+// HoldResponses parks responses which match the mitmproxy filter, after the server has processed the request but
+// before the client sees the response. Each held response is sent to the held channel. Held responses (and any
+// which match after this point) are delivered to the client when release() is called, or the connection is
+// killed when abort() is called. Only the first call to release() or abort() has any effect.
+//
+// This makes it possible to deterministically reproduce races such as a client being killed after the server has
+// committed a /keys/upload request:
+//
+//	release, _, held := deployment.HoldResponses(t, mitm.PathContains("/keys/upload"))
+//	... cause alice to upload keys ...
+//	<-held
+//	alice.ForceClose(t)
+//	release()
+//
+// The mitmproxy options are locked until release() or abort() is called. If neither are called, the responses
+// are released when the test finishes.
+func (d *SlidingSyncDeployment) HoldResponses(t *testing.T, filter mitm.Filter) (release func(), abort func(), held <-chan CallbackData) {
+	t.Helper()
+	heldCh := make(chan CallbackData, 100)
+	// guards the fields below. Holds which arrive after release() or abort() get the verdict immediately.
+	var mu sync.Mutex
+	cond := sync.NewCond(&mu)
+	finished := false
+	aborted := false
+	inFlight := 0
+	callbackURL, closeCallbackServer := newCallbackServer(t, d, func(data CallbackData) interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		if !finished {
+			inFlight++
+			select {
+			case heldCh <- data:
+			default:
+				t.Logf("HoldResponses: held channel is full, not notifying for %s", data)
+			}
+			for !finished {
+				cond.Wait()
+			}
+			inFlight--
+			cond.Broadcast()
+		}
+		return map[string]interface{}{
+			"abort": aborted,
+		}
+	})
+	options, err := mitm.Options(mitm.HoldOptions{
+		CallbackURL: callbackURL,
+		Filter:      filter,
+	})
+	if err != nil {
+		closeCallbackServer()
+		t.Fatalf("HoldResponses: %s", err)
+	}
+	lockID := d.lockOptions(t, options)
+	var once sync.Once
+	finish := func(abort bool) {
+		once.Do(func() {
+			mu.Lock()
+			finished = true
+			aborted = abort
+			cond.Broadcast()
+			// wait for held callbacks to pick up the verdict before closing the server, else mitmproxy will
+			// see a connection error and release the response regardless of the verdict.
+			for inFlight > 0 {
+				cond.Wait()
+			}
+			mu.Unlock()
+			d.unlockOptions(t, lockID)
+			closeCallbackServer()
+		})
+	}
+	t.Cleanup(func() {
+		finish(false)
+	})
+	return func() { finish(false) }, func() { finish(true) }, heldCh
+}
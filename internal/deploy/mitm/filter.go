@@ -0,0 +1,187 @@
+// Package mitm contains typed builders for the options of the mitmproxy addons in tests/mitmproxy_addons, along with
+// a small DSL for mitmproxy filters. Options and filters are validated in Go before they are sent to mitmproxy, as
+// mistakes would otherwise show up as silent non-matches inside the container.
+package mitm
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Filter is a mitmproxy filter. See https://docs.mitmproxy.org/stable/concepts-filters/
+// The zero value matches all flows.
+type Filter struct {
+	expr string
+	err  error
+}
+
+// String returns the filter in mitmproxy filter syntax. Returns "" for the zero value. Panics if the filter
+// could not be built e.g it was given an empty device ID, as "" would otherwise match every flow: call Validate
+// first, or use the filter with WithMITMAddons which does.
+func (f Filter) String() string {
+	if f.err != nil {
+		panic(fmt.Sprintf("mitm: String called on an invalid filter: %s", f.err))
+	}
+	return f.expr
+}
+
+// IsZero returns true if this filter matches all flows.
+func (f Filter) IsZero() bool {
+	return f.expr == "" && f.err == nil
+}
+
+// Validate returns an error if the filter is invalid.
+func (f Filter) Validate() error {
+	if f.err != nil {
+		return f.err
+	}
+	if f.expr == "" {
+		return nil
+	}
+	return ValidateFilter(f.expr)
+}
+
+// RawFilter makes a filter from a string in mitmproxy filter syntax. The filter is validated when Validate is called.
+func RawFilter(expr string) Filter {
+	return Filter{expr: expr}
+}
+
+// Method matches requests with this HTTP method e.g "POST".
+func Method(method string) Filter {
+	if method == "" || strings.ToUpper(method) != method || strings.ContainsAny(method, " \t()\"'~") {
+		return Filter{err: fmt.Errorf("Method: invalid HTTP method '%s'", method)}
+	}
+	return Filter{expr: "~m " + method}
+}
+
+// URLRegex matches requests whose URL matches this regular expression. The URL includes the scheme and host.
+func URLRegex(re string) Filter {
+	if _, err := regexp.Compile(re); err != nil {
+		return Filter{err: fmt.Errorf("URLRegex: %s", err)}
+	}
+	return Filter{expr: "~u " + quote(re)}
+}
+
+// PathContains matches requests whose URL contains this string e.g "/keys/query".
+func PathContains(s string) Filter {
+	return URLRegex(regexp.QuoteMeta(s))
+}
+
+// Host matches requests to this host e.g "hs1".
+func Host(host string) Filter {
+	if host == "" {
+		return Filter{err: fmt.Errorf("Host: empty host")}
+	}
+	return Filter{expr: "~d " + quote("^"+regexp.QuoteMeta(host)+"$")}
+}
+
+// Header matches requests with this header, whose value matches the regular expression.
+// The header name is case-insensitive.
+func Header(name, valueRegex string) Filter {
+	if name == "" || strings.ContainsAny(name, ": \t") {
+		return Filter{err: fmt.Errorf("Header: invalid header name '%s'", name)}
+	}
+	re := "(?i:" + regexp.QuoteMeta(name) + "): " + valueRegex
+	if _, err := regexp.Compile(re); err != nil {
+		return Filter{err: fmt.Errorf("Header: %s", err)}
+	}
+	return Filter{expr: "~hq " + quote(re)}
+}
+
+// AccessToken matches requests which use this access token.
+func AccessToken(token string) Filter {
+	if token == "" {
+		return Filter{err: fmt.Errorf("AccessToken: empty access token")}
+	}
+	return Header("Authorization", "Bearer "+regexp.QuoteMeta(token)+"$")
+}
+
+// UserID matches client-server requests from this user. Access tokens are resolved to users by mitmproxy,
+// so this keeps matching if the user's access token changes.
+func UserID(userID string) Filter {
+	if userID == "" {
+		return Filter{err: fmt.Errorf("UserID: empty user ID")}
+	}
+	return metadata("user_id", userID)
+}
+
+// DeviceID matches client-server requests from this device. Access tokens are resolved to devices by mitmproxy,
+// so this keeps matching if the device's access token changes, and can be used before the device logs in.
+func DeviceID(deviceID string) Filter {
+	if deviceID == "" {
+		return Filter{err: fmt.Errorf("DeviceID: empty device ID")}
+	}
+	return metadata("device_id", deviceID)
+}
+
+// metadata matches flows with this flow metadata. mitmproxy matches metadata one "key: value" line at a time.
+func metadata(key, value string) Filter {
+	return Filter{expr: "~meta " + quote("^"+key+": "+regexp.QuoteMeta(value)+"$")}
+}
+
+// StatusCode matches responses with this HTTP status code.
+func StatusCode(code int) Filter {
+	if code < 100 || code > 599 {
+		return Filter{err: fmt.Errorf("StatusCode: invalid status code %d", code)}
+	}
+	return Filter{expr: "~c " + strconv.Itoa(code)}
+}
+
+// Federation matches server-server requests.
+func Federation() Filter {
+	return URLRegex("/_matrix/(federation|key)/")
+}
+
+// Client matches client-server requests.
+func Client() Filter {
+	return Not(Federation())
+}
+
+// All matches flows which match all of the filters.
+func All(filters ...Filter) Filter {
+	return combine("&", filters)
+}
+
+// Any matches flows which match any of the filters.
+func Any(filters ...Filter) Filter {
+	return combine("|", filters)
+}
+
+// Not matches flows which do not match the filter.
+func Not(f Filter) Filter {
+	if f.err != nil {
+		return f
+	}
+	if f.expr == "" {
+		return Filter{err: fmt.Errorf("Not: cannot negate a filter which matches all flows")}
+	}
+	return Filter{expr: "!(" + f.expr + ")"}
+}
+
+func combine(op string, filters []Filter) Filter {
+	for _, f := range filters {
+		if f.err != nil {
+			return f
+		}
+	}
+	var exprs []string
+	for _, f := range filters {
+		if f.expr == "" {
+			if op == "|" {
+				return Filter{} // matches all flows
+			}
+			continue
+		}
+		exprs = append(exprs, "("+f.expr+")")
+	}
+	return Filter{expr: strings.Join(exprs, " "+op+" ")}
+}
+
+// quote a filter argument. mitmproxy unescapes backslashes in quoted strings, so they need escaping.
+func quote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
@@ -0,0 +1,103 @@
+package mitm
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/must"
+)
+
+func TestFilterBuilders(t *testing.T) {
+	testCases := []struct {
+		name   string
+		filter Filter
+		want   string
+	}{
+		{"Method", Method("POST"), `~m POST`},
+		{"PathContains", PathContains("/keys/query"), `~u "/keys/query"`},
+		{"PathContains escapes", PathContains("/foo.bar"), `~u "/foo\\.bar"`},
+		{"Host", Host("hs1"), `~d "^hs1$"`},
+		{"AccessToken", AccessToken("syt_abc"), `~hq "(?i:Authorization): Bearer syt_abc$"`},
+		{"UserID", UserID("@alice:hs1"), `~meta "^user_id: @alice:hs1$"`},
+		{"DeviceID", DeviceID("ALICE.2"), `~meta "^device_id: ALICE\\.2$"`},
+		{"StatusCode", StatusCode(429), `~c 429`},
+		{"All", All(PathContains("/sync"), Method("GET")), `(~u "/sync") & (~m GET)`},
+		{"All skips zero", All(Filter{}, Method("GET")), `(~m GET)`},
+		{"Any", Any(Method("GET"), Method("PUT")), `(~m GET) | (~m PUT)`},
+		{"Any with zero matches all", Any(Filter{}, Method("PUT")), ``},
+		{"Client", Client(), `!(~u "/_matrix/(federation|key)/")`},
+	}
+	for _, tc := range testCases {
+		must.Equal(t, tc.filter.String(), tc.want, tc.name)
+		must.NotError(t, tc.name+" Validate", tc.filter.Validate())
+	}
+}
+
+func TestFilterBuilderErrors(t *testing.T) {
+	testCases := []struct {
+		name   string
+		filter Filter
+	}{
+		{"lowercase method", Method("post")},
+		{"bad regex", URLRegex("/foo(")},
+		{"empty host", Host("")},
+		{"bad header name", Header("Authorization:", ".*")},
+		{"empty access token", AccessToken("")},
+		{"empty user ID", UserID("")},
+		{"empty device ID", DeviceID("")},
+		{"bad status code", StatusCode(42)},
+		{"not all", Not(Filter{})},
+		{"error propagates through All", All(Method("GET"), Method(""))},
+		{"error propagates through Any", Any(Filter{}, Method(""))},
+	}
+	for _, tc := range testCases {
+		if err := tc.filter.Validate(); err == nil {
+			t.Errorf("%s: expected error, got filter '%s'", tc.name, tc.filter)
+		}
+		mustPanic(t, tc.name+" String", func() {
+			_ = tc.filter.String()
+		})
+	}
+}
+
+// mustPanic fails the test if fn does not panic. An invalid filter must not stringify to "", as that matches all flows.
+func mustPanic(t *testing.T, msg string, fn func()) {
+	t.Helper()
+	defer func() {
+		if recover() == nil {
+			t.Errorf("%s: did not panic", msg)
+		}
+	}()
+	fn()
+}
+
+func TestValidateFilter(t *testing.T) {
+	valid := []string{
+		`~u .*\/keys\/query.* ~m POST`,
+		`~u .*/keys/upload.* ~hq syt_abc_123`,
+		`~u "/_matrix/(federation|key)/"`,
+		`!(~u "/_matrix/(federation|key)/")`,
+		`(~m GET | ~m PUT) & ~c 200`,
+		`~all`,
+		`~q & !~s`,
+		`.`,
+	}
+	for _, expr := range valid {
+		must.NotError(t, expr, ValidateFilter(expr))
+	}
+	invalid := []string{
+		`~u`,
+		`~m POST ~bogus foo`,
+		`(~m POST`,
+		`~m POST)`,
+		`~u "/keys/query`,
+		`~c abc`,
+		`~u "(?=lookahead)"`,
+		`~m POST &`,
+		`| ~m POST`,
+	}
+	for _, expr := range invalid {
+		if err := ValidateFilter(expr); err == nil {
+			t.Errorf("ValidateFilter(%s): expected error", expr)
+		}
+	}
+}
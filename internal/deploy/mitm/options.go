@@ -0,0 +1,316 @@
+package mitm
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Addon is the options for one of the addons in tests/mitmproxy_addons.
+type Addon interface {
+	// The name of the mitmproxy option for this addon e.g "statuscode".
+	OptionName() string
+	// The value of the mitmproxy option, or an error if the options are invalid.
+	OptionValue() (map[string]interface{}, error)
+}
+
+// Options validates the addon options and returns them in the form expected by the mitmproxy controller.
+func Options(addons ...Addon) (map[string]interface{}, error) {
+	options := make(map[string]interface{}, len(addons))
+	for _, addon := range addons {
+		name := addon.OptionName()
+		if _, exists := options[name]; exists {
+			return nil, fmt.Errorf("%s: options set more than once", name)
+		}
+		val, err := addon.OptionValue()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		options[name] = val
+	}
+	return options, nil
+}
+
+// Target is which part of a flow an addon acts on.
+type Target string
+
+const (
+	TargetRequest  Target = "request"
+	TargetResponse Target = "response"
+)
+
+func (t Target) orDefault() (Target, error) {
+	switch t {
+	case "":
+		return TargetResponse, nil
+	case TargetRequest, TargetResponse:
+		return t, nil
+	}
+	return "", fmt.Errorf("invalid target '%s'", t)
+}
+
+// withFilter validates the filter and adds it to the option value, if it is set.
+func withFilter(val map[string]interface{}, f Filter) (map[string]interface{}, error) {
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+	if !f.IsZero() {
+		val["filter"] = f.String()
+	}
+	return val, nil
+}
+
+// StatusCodeOptions configures the statuscode addon, which replaces responses with the given status code.
+type StatusCodeOptions struct {
+	Filter Filter
+	// The status code to return. Required unless Chaos is set.
+	ReturnStatus int
+	// If true, the request does not reach the server.
+	BlockRequest bool
+	// How many flows to replace. If 0, all matching flows are replaced.
+	Count int
+	// If set, fail a random percentage of flows instead of every flow.
+	Chaos *ChaosOptions
+}
+
+// ChaosOptions configures the chaos mode of the statuscode addon.
+type ChaosOptions struct {
+	// The percentage chance (1-100) of failing each matching flow.
+	Percent int
+	// The status codes to fail flows with, picked at random.
+	StatusCodes []int
+	// If true, 429 responses include an M_LIMIT_EXCEEDED body with RetryAfter as retry_after_ms.
+	LimitExceeded bool
+	RetryAfter    time.Duration
+	// The seed for the random choices.
+	Seed int64
+}
+
+func (o StatusCodeOptions) OptionName() string { return "statuscode" }
+func (o StatusCodeOptions) OptionValue() (map[string]interface{}, error) {
+	if o.Chaos == nil && (o.ReturnStatus < 100 || o.ReturnStatus > 599) {
+		return nil, fmt.Errorf("invalid return status %d", o.ReturnStatus)
+	}
+	if o.Count < 0 {
+		return nil, fmt.Errorf("negative count %d", o.Count)
+	}
+	val := map[string]interface{}{
+		"return_status": o.ReturnStatus,
+		"block_request": o.BlockRequest,
+		"count":         o.Count,
+	}
+	if o.Chaos != nil {
+		if o.Chaos.Percent <= 0 || o.Chaos.Percent > 100 {
+			return nil, fmt.Errorf("chaos percent must be between 1 and 100, got %d", o.Chaos.Percent)
+		}
+		if len(o.Chaos.StatusCodes) == 0 {
+			return nil, fmt.Errorf("chaos mode requires at least one status code")
+		}
+		for _, code := range o.Chaos.StatusCodes {
+			if code < 100 || code > 599 {
+				return nil, fmt.Errorf("invalid chaos status code %d", code)
+			}
+		}
+		val["chaos"] = map[string]interface{}{
+			"percent":        o.Chaos.Percent,
+			"status_codes":   o.Chaos.StatusCodes,
+			"limit_exceeded": o.Chaos.LimitExceeded,
+			"retry_after_ms": o.Chaos.RetryAfter.Milliseconds(),
+			"seed":           o.Chaos.Seed,
+		}
+	}
+	return withFilter(val, o.Filter)
+}
+
+// CallbackOptions configures the callback addon, which sends responses to the callback URL.
+type CallbackOptions struct {
+	Filter      Filter
+	CallbackURL string
+}
+
+func (o CallbackOptions) OptionName() string { return "callback" }
+func (o CallbackOptions) OptionValue() (map[string]interface{}, error) {
+	if !strings.HasPrefix(o.CallbackURL, "http") {
+		return nil, fmt.Errorf("invalid callback url '%s'", o.CallbackURL)
+	}
+	return withFilter(map[string]interface{}{
+		"callback_url": o.CallbackURL,
+	}, o.Filter)
+}
+
+// HoldOptions configures the hold addon, which holds responses until the callback URL returns.
+type HoldOptions struct {
+	Filter      Filter
+	CallbackURL string
+}
+
+func (o HoldOptions) OptionName() string { return "hold" }
+func (o HoldOptions) OptionValue() (map[string]interface{}, error) {
+	if !strings.HasPrefix(o.CallbackURL, "http") {
+		return nil, fmt.Errorf("invalid callback url '%s'", o.CallbackURL)
+	}
+	return withFilter(map[string]interface{}{
+		"callback_url": o.CallbackURL,
+	}, o.Filter)
+}
+
+// RewriteOptions configures the rewrite addon, which applies JSON patches to request or response bodies.
+type RewriteOptions struct {
+	Filter Filter
+	// Which body to rewrite. Defaults to the response body.
+	Target Target
+	// The patches to apply, in order.
+	Patches []JSONPatch
+	// How many flows to rewrite. If 0, all matching flows are rewritten.
+	Count int
+}
+
+func (o RewriteOptions) OptionName() string { return "rewrite" }
+func (o RewriteOptions) OptionValue() (map[string]interface{}, error) {
+	target, err := o.Target.orDefault()
+	if err != nil {
+		return nil, err
+	}
+	if len(o.Patches) == 0 {
+		return nil, fmt.Errorf("no patches provided")
+	}
+	for _, p := range o.Patches {
+		if err := p.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return withFilter(map[string]interface{}{
+		"target":  target,
+		"patches": o.Patches,
+		"count":   o.Count,
+	}, o.Filter)
+}
+
+// LatencyOptions configures the latency addon, which delays requests or responses.
+type LatencyOptions struct {
+	Filter Filter
+	// Whether to delay requests before they reach the server, or responses before they reach the client.
+	// Defaults to responses.
+	Target Target
+	// The fixed delay to apply to each matching flow.
+	Delay time.Duration
+	// A random extra delay between 0 and Jitter, uniformly distributed, applied to each matching flow.
+	Jitter time.Duration
+	// The seed for the random jitter. The same seed produces the same sequence of delays.
+	Seed int64
+}
+
+func (o LatencyOptions) OptionName() string { return "latency" }
+func (o LatencyOptions) OptionValue() (map[string]interface{}, error) {
+	target, err := o.Target.orDefault()
+	if err != nil {
+		return nil, err
+	}
+	if o.Delay < 0 || o.Jitter < 0 || (o.Delay.Milliseconds() == 0 && o.Jitter.Milliseconds() == 0) {
+		return nil, fmt.Errorf("delay and jitter must be non-negative with at least one at least 1ms")
+	}
+	return withFilter(map[string]interface{}{
+		"target":    target,
+		"delay_ms":  o.Delay.Milliseconds(),
+		"jitter_ms": o.Jitter.Milliseconds(),
+		"seed":      o.Seed,
+	}, o.Filter)
+}
+
+// RateLimit is a token bucket rate limit for a single user, like Synapse's per-user rate limits. The bucket holds
+// up to Burst requests and refills at PerSecond requests per second. When the bucket is empty, requests are
+// rejected with HTTP 429 M_LIMIT_EXCEEDED, with retry_after_ms and a Retry-After header set to when the next
+// request will be allowed. Users are resolved from access tokens by mitmproxy, so the limit still applies if
+// the user logs in again or refreshes their access token.
+type RateLimit struct {
+	// The user ID to limit. If empty, the limit applies to each user which has no limit of its own, with a
+	// separate bucket per user.
+	UserID    string
+	PerSecond float64
+	// Defaults to 1.
+	Burst int
+}
+
+// RateLimitOptions configures the rate limit addon. Rate limited requests do not reach the server.
+type RateLimitOptions struct {
+	Filter Filter
+	Limits []RateLimit
+}
+
+func (o RateLimitOptions) OptionName() string { return "ratelimit" }
+func (o RateLimitOptions) OptionValue() (map[string]interface{}, error) {
+	if len(o.Limits) == 0 {
+		return nil, fmt.Errorf("no limits provided")
+	}
+	seen := make(map[string]bool)
+	limits := make([]map[string]interface{}, 0, len(o.Limits))
+	for _, l := range o.Limits {
+		if seen[l.UserID] {
+			return nil, fmt.Errorf("user '%s' has more than one limit", l.UserID)
+		}
+		seen[l.UserID] = true
+		if l.PerSecond < 0 || l.Burst < 0 {
+			return nil, fmt.Errorf("negative rate limit for user '%s'", l.UserID)
+		}
+		burst := l.Burst
+		if burst == 0 {
+			burst = 1
+		}
+		limits = append(limits, map[string]interface{}{
+			"user_id":    l.UserID,
+			"per_second": l.PerSecond,
+			"burst":      burst,
+		})
+	}
+	return withFilter(map[string]interface{}{
+		"limits": limits,
+	}, o.Filter)
+}
+
+// FaultMode is a connection-level fault to inject into responses.
+type FaultMode string
+
+const (
+	// Close the connection after AfterBytes bytes of the response body have been sent to the client.
+	FaultReset FaultMode = "reset"
+	// Cut the response body to AfterBytes bytes. The response is otherwise well-formed.
+	FaultTruncate FaultMode = "truncate"
+	// Send the response body to the client DripBytes at a time, waiting DripInterval between each.
+	FaultDrip FaultMode = "drip"
+)
+
+// FaultOptions configures the fault addon, which injects connection-level faults into responses.
+type FaultOptions struct {
+	Filter Filter
+	Mode   FaultMode
+	// For FaultReset and FaultTruncate, how many bytes of the response body to send.
+	AfterBytes int
+	// For FaultDrip, how many bytes of the response body to send at a time. Defaults to 1.
+	DripBytes    int
+	DripInterval time.Duration
+	// How many flows to fault. If 0, all matching flows are faulted.
+	Count int
+}
+
+func (o FaultOptions) OptionName() string { return "fault" }
+func (o FaultOptions) OptionValue() (map[string]interface{}, error) {
+	switch o.Mode {
+	case FaultReset, FaultTruncate, FaultDrip:
+	default:
+		return nil, fmt.Errorf("invalid fault mode '%s'", o.Mode)
+	}
+	if o.AfterBytes < 0 || o.DripBytes < 0 || o.DripInterval < 0 || o.Count < 0 {
+		return nil, fmt.Errorf("fault options must be non-negative")
+	}
+	dripBytes := o.DripBytes
+	if dripBytes == 0 {
+		dripBytes = 1
+	}
+	return withFilter(map[string]interface{}{
+		"mode":             o.Mode,
+		"after_bytes":      o.AfterBytes,
+		"drip_bytes":       dripBytes,
+		"drip_interval_ms": o.DripInterval.Milliseconds(),
+		"count":            o.Count,
+	}, o.Filter)
+}
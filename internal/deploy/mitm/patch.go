@@ -0,0 +1,54 @@
+package mitm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// JSONPatch is a single JSON patch operation (RFC 6902). Path is a JSON pointer (RFC 6901), with the extension
+// that a path segment of "*" matches every key of an object or every element of an array.
+// Operations on paths which do not exist are skipped.
+type JSONPatch struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// PatchRemove removes the value at the path.
+func PatchRemove(path string) JSONPatch {
+	return JSONPatch{Op: "remove", Path: path}
+}
+
+// PatchReplace replaces the value at the path, if it exists.
+func PatchReplace(path string, value interface{}) JSONPatch {
+	return JSONPatch{Op: "replace", Path: path, Value: value}
+}
+
+// PatchAdd adds a value at the path. For arrays, the value is inserted at the index, or appended if the
+// last path segment is "-".
+func PatchAdd(path string, value interface{}) JSONPatch {
+	return JSONPatch{Op: "add", Path: path, Value: value}
+}
+
+// JSONPointer makes a JSON pointer from the given path segments, escaping them as required.
+// E.g JSONPointer("device_keys", "@alice:hs1", "*") => "/device_keys/@alice:hs1/*"
+func JSONPointer(segments ...string) string {
+	var sb strings.Builder
+	for _, seg := range segments {
+		sb.WriteString("/")
+		sb.WriteString(strings.ReplaceAll(strings.ReplaceAll(seg, "~", "~0"), "/", "~1"))
+	}
+	return sb.String()
+}
+
+func (p JSONPatch) validate() error {
+	switch p.Op {
+	case "add", "remove", "replace":
+	default:
+		return fmt.Errorf("invalid patch op '%s'", p.Op)
+	}
+	if p.Path != "" && !strings.HasPrefix(p.Path, "/") {
+		return fmt.Errorf("invalid patch path '%s': must be empty or start with '/'", p.Path)
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package mitm
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// mitmproxy filter operators which take no argument.
+var noArgOperators = map[string]bool{
+	"~a": true, "~all": true, "~dns": true, "~e": true, "~http": true, "~marked": true, "~q": true,
+	"~replay": true, "~replayq": true, "~replays": true, "~s": true, "~tcp": true, "~udp": true, "~websocket": true,
+}
+
+// mitmproxy filter operators which take a regular expression argument.
+var regexOperators = map[string]bool{
+	"~b": true, "~bq": true, "~bs": true, "~comment": true, "~d": true, "~dst": true, "~h": true, "~hq": true,
+	"~hs": true, "~m": true, "~marker": true, "~meta": true, "~src": true, "~t": true, "~tq": true, "~ts": true, "~u": true,
+}
+
+// ValidateFilter checks that the filter is valid mitmproxy filter syntax, and that all regular expressions in it
+// compile. Regular expressions are checked with Go's regexp package, which is stricter than python's re module, so
+// features such as lookaheads are rejected.
+func ValidateFilter(expr string) error {
+	tokens, err := tokenizeFilter(expr)
+	if err != nil {
+		return fmt.Errorf("invalid filter '%s': %s", expr, err)
+	}
+	p := &filterParser{tokens: tokens}
+	if err = p.parseOr(); err != nil {
+		return fmt.Errorf("invalid filter '%s': %s", expr, err)
+	}
+	if p.pos != len(p.tokens) {
+		return fmt.Errorf("invalid filter '%s': unexpected '%s'", expr, p.tokens[p.pos].val)
+	}
+	return nil
+}
+
+type filterTokenKind int
+
+const (
+	tokenOperator filterTokenKind = iota // ~u
+	tokenWord                            // an argument or bare regex
+	tokenSymbol                          // ( ) ! & |
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	val  string
+}
+
+func tokenizeFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+	i := 0
+	for i < len(expr) {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case strings.IndexByte("()!&|", c) >= 0:
+			tokens = append(tokens, filterToken{kind: tokenSymbol, val: string(c)})
+			i++
+		case c == '"' || c == '\'':
+			var sb strings.Builder
+			j := i + 1
+			closed := false
+			for j < len(expr) {
+				if expr[j] == '\\' && j+1 < len(expr) {
+					sb.WriteByte(expr[j+1])
+					j += 2
+					continue
+				}
+				if expr[j] == c {
+					closed = true
+					break
+				}
+				sb.WriteByte(expr[j])
+				j++
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated quoted string at position %d", i)
+			}
+			tokens = append(tokens, filterToken{kind: tokenWord, val: sb.String()})
+			i = j + 1
+		default:
+			j := i
+			for j < len(expr) && strings.IndexByte("()'\" \t\n\r", expr[j]) < 0 && (j == i || expr[j] != '~') {
+				j++
+			}
+			word := expr[i:j]
+			if c == '~' {
+				tokens = append(tokens, filterToken{kind: tokenOperator, val: word})
+			} else {
+				tokens = append(tokens, filterToken{kind: tokenWord, val: word})
+			}
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// filterParser checks the grammar of a tokenized filter. '!' binds tightest, then '&' (or juxtaposition), then '|'.
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) peek() *filterToken {
+	if p.pos >= len(p.tokens) {
+		return nil
+	}
+	return &p.tokens[p.pos]
+}
+
+func (p *filterParser) isSymbol(val string) bool {
+	tok := p.peek()
+	return tok != nil && tok.kind == tokenSymbol && tok.val == val
+}
+
+func (p *filterParser) parseOr() error {
+	if err := p.parseAnd(); err != nil {
+		return err
+	}
+	for p.isSymbol("|") {
+		p.pos++
+		if err := p.parseAnd(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *filterParser) parseAnd() error {
+	if err := p.parseUnary(); err != nil {
+		return err
+	}
+	for {
+		if p.isSymbol("&") {
+			p.pos++
+		} else if tok := p.peek(); tok == nil || (tok.kind == tokenSymbol && tok.val != "(" && tok.val != "!") {
+			return nil
+		}
+		if err := p.parseUnary(); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *filterParser) parseUnary() error {
+	tok := p.peek()
+	if tok == nil {
+		return fmt.Errorf("unexpected end of filter")
+	}
+	p.pos++
+	switch tok.kind {
+	case tokenSymbol:
+		switch tok.val {
+		case "!":
+			return p.parseUnary()
+		case "(":
+			if err := p.parseOr(); err != nil {
+				return err
+			}
+			if !p.isSymbol(")") {
+				return fmt.Errorf("missing ')'")
+			}
+			p.pos++
+			return nil
+		}
+		return fmt.Errorf("unexpected '%s'", tok.val)
+	case tokenWord:
+		// a bare regex
+		if _, err := regexp.Compile(tok.val); err != nil {
+			return err
+		}
+		return nil
+	}
+	// operators
+	if noArgOperators[tok.val] {
+		return nil
+	}
+	arg := p.peek()
+	if arg == nil || arg.kind != tokenWord {
+		if tok.val == "~c" || regexOperators[tok.val] {
+			return fmt.Errorf("%s requires an argument", tok.val)
+		}
+		return fmt.Errorf("unknown operator %s", tok.val)
+	}
+	p.pos++
+	if tok.val == "~c" {
+		if _, err := strconv.Atoi(arg.val); err != nil {
+			return fmt.Errorf("~c requires an integer status code, got '%s'", arg.val)
+		}
+		return nil
+	}
+	if !regexOperators[tok.val] {
+		return fmt.Errorf("unknown operator %s", tok.val)
+	}
+	if _, err := regexp.Compile(arg.val); err != nil {
+		return fmt.Errorf("%s: %s", tok.val, err)
+	}
+	return nil
+}
@@ -0,0 +1,580 @@
+package deploy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement-crypto/internal/config/timing"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/must"
+	testcontainers "github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// DeploymentState is written to the deployment state file when reusing deployments across `go test` invocations.
+// It contains everything needed to reattach to a running deployment, or to tear it down.
+type DeploymentState struct {
+	// The docker network all containers are connected to.
+	Network string `json:"network"`
+	// True if the deployment was made with DeploymentOpts.NativeSlidingSync
+	NativeSlidingSync bool `json:"native_sliding_sync"`
+	// True if the deployment was made with DeploymentOpts.NoFederationProxy
+	NoFederationProxy bool `json:"no_federation_proxy"`
+	// The homeservers in this deployment, keyed by HS name e.g "hs1".
+	Homeservers map[string]HomeserverState `json:"homeservers"`
+	// All non-homeserver containers in this deployment, keyed by name e.g "mitmproxy".
+	ContainerIDs map[string]string `json:"container_ids"`
+	// The mitmproxy reverse proxy URLs, keyed by the hostname being proxied e.g "hs1".
+	ReverseProxyURLs map[string]string `json:"reverse_proxy_urls"`
+	// The URL of the mitmproxy controller.
+	ControllerURL string `json:"controller_url"`
+	// The CA certificate and key in PEM format which the homeservers use for federation.
+	CACert string `json:"ca_cert"`
+	CAKey  string `json:"ca_key"`
+}
+
+// HomeserverState is the state of a single homeserver in a reusable deployment.
+type HomeserverState struct {
+	ContainerID  string `json:"container_id"`
+	BaseURL      string `json:"base_url"`
+	Image        string `json:"image"`
+	InternalPort string `json:"internal_port"`
+}
+
+// ReadDeploymentState reads a deployment state file written by a previous reusable deployment.
+func ReadDeploymentState(stateFile string) (*DeploymentState, error) {
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		return nil, err
+	}
+	var state DeploymentState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse deployment state file %s: %s", stateFile, err)
+	}
+	return &state, nil
+}
+
+func (s *DeploymentState) write(stateFile string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(stateFile, data, 0o644)
+}
+
+// lockDeploymentState takes an exclusive lock on the deployment state file, so `go test` processes which share it
+// (e.g `go test ./tests ./internal/tests`) do not race to create deployments. Blocks until the lock is taken.
+// The lock is released by calling unlock, or when this process exits.
+func lockDeploymentState(stateFile string) (unlock func(), err error) {
+	lockFile, err := os.OpenFile(stateFile+".lock", os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %s", err)
+	}
+	if err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		lockFile.Close()
+		return nil, fmt.Errorf("failed to lock %s: %s", lockFile.Name(), err)
+	}
+	return func() {
+		syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+		lockFile.Close()
+	}, nil
+}
+
+// TeardownReusableDeployment removes all containers and the network of a reusable deployment, then removes
+// the state file. Returns an error if the state file cannot be read. Failures to remove individual containers
+// are logged, as they may have already been removed.
+func TeardownReusableDeployment(stateFile string) error {
+	state, err := ReadDeploymentState(stateFile)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	dockerClient, err := testcontainers.NewDockerClientWithOpts(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to make docker client: %s", err)
+	}
+	defer dockerClient.Close()
+	containerIDs := make(map[string]string)
+	for name, id := range state.ContainerIDs {
+		containerIDs[name] = id
+	}
+	for hsName, hs := range state.Homeservers {
+		containerIDs[hsName] = hs.ContainerID
+	}
+	for name, id := range containerIDs {
+		log.Printf("removing %s (%s)", name, id)
+		err = dockerClient.ContainerRemove(ctx, id, types.ContainerRemoveOptions{
+			Force: true,
+		})
+		if err != nil {
+			log.Printf("failed to remove %s: %s", name, err)
+		}
+	}
+	if state.Network != "" {
+		log.Printf("removing network %s", state.Network)
+		if err = dockerClient.NetworkRemove(ctx, state.Network); err != nil {
+			log.Printf("failed to remove network %s: %s", state.Network, err)
+		}
+	}
+	return os.Remove(stateFile)
+}
+
+// reattachDeployment returns the deployment in the state file if it exists and is healthy, else returns nil.
+// Reattaching resets all mitmproxy options and abandons any callbacks to the previous test run, in case it
+// exited whilst options were locked or whilst mitmproxy was waiting for a callback.
+func reattachDeployment(t *testing.T, opts DeploymentOpts) *SlidingSyncDeployment {
+	state, err := ReadDeploymentState(opts.DeploymentStateFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Logf("not reusing deployment: %s", err)
+		}
+		return nil
+	}
+	if state.NativeSlidingSync != opts.NativeSlidingSync {
+		t.Logf("not reusing deployment: native sliding sync mode differs (was %v)", state.NativeSlidingSync)
+		return nil
+	}
+	if state.NoFederationProxy != opts.NoFederationProxy {
+		t.Logf("not reusing deployment: federation proxy mode differs (was disabled=%v)", state.NoFederationProxy)
+		return nil
+	}
+	for hsName, hs := range state.Homeservers {
+		if image := reusableHomeserverImage(opts.HomeserverImages, hsName); hs.Image != image {
+			t.Logf("not reusing deployment: %s image differs (was %s, now %s)", hsName, hs.Image, image)
+			return nil
+		}
+	}
+	if err = checkDeploymentHealth(state); err != nil {
+		t.Logf("not reusing deployment: %s", err)
+		return nil
+	}
+	deployment, err := newReusableDeployment(state.Network, state.Homeservers, []byte(state.CACert), []byte(state.CAKey))
+	if err != nil {
+		t.Logf("not reusing deployment: %s", err)
+		return nil
+	}
+	d := &SlidingSyncDeployment{
+		Deployment:           deployment,
+		containerIDs:         state.ContainerIDs,
+		ControllerURL:        state.ControllerURL,
+		mitmClient:           newMITMClient(t, state.ControllerURL),
+		dnsToReverseProxyURL: state.ReverseProxyURLs,
+		mitmDumpFile:         opts.MITMDumpFile,
+		nativeSlidingSync:    state.NativeSlidingSync,
+		stateFile:            opts.DeploymentStateFile,
+	}
+	if err = d.resetMITM(); err != nil {
+		t.Logf("not reusing deployment: failed to reset mitmproxy: %s", err)
+		return nil
+	}
+	t.Logf("SlidingSyncDeployment reused from %s (network=%s)", opts.DeploymentStateFile, state.Network)
+	return d
+}
+
+// checkDeploymentHealth returns an error if any container in the deployment is not running, or if the
+// homeservers cannot be reached via mitmproxy.
+func checkDeploymentHealth(state *DeploymentState) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timing.Get().Scale(10*time.Second))
+	defer cancel()
+	dockerClient, err := testcontainers.NewDockerClientWithOpts(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to make docker client: %s", err)
+	}
+	defer dockerClient.Close()
+	containerIDs := make(map[string]string)
+	for name, id := range state.ContainerIDs {
+		containerIDs[name] = id
+	}
+	for hsName, hs := range state.Homeservers {
+		containerIDs[hsName] = hs.ContainerID
+	}
+	for name, id := range containerIDs {
+		containerJSON, err := dockerClient.ContainerInspect(ctx, id)
+		if err != nil {
+			return fmt.Errorf("failed to inspect %s: %s", name, err)
+		}
+		if containerJSON.State == nil || !containerJSON.State.Running || containerJSON.State.Paused {
+			return fmt.Errorf("%s is not running", name)
+		}
+		// the image may have been rebuilt with the same name since the container was made
+		if hs, ok := state.Homeservers[name]; ok {
+			image, _, err := dockerClient.ImageInspectWithRaw(ctx, hs.Image)
+			if err != nil {
+				return fmt.Errorf("failed to inspect image %s of %s: %s", hs.Image, name, err)
+			}
+			if image.ID != containerJSON.Image {
+				return fmt.Errorf("%s is running an old build of %s", name, hs.Image)
+			}
+		}
+	}
+	httpClient := &http.Client{Timeout: timing.Get().Scale(5 * time.Second)}
+	for hsName := range state.Homeservers {
+		res, err := httpClient.Get(state.ReverseProxyURLs[hsName] + "/_matrix/client/versions")
+		if err != nil {
+			return fmt.Errorf("failed to reach %s: %s", hsName, err)
+		}
+		res.Body.Close()
+		if res.StatusCode != 200 {
+			return fmt.Errorf("%s returned HTTP %d for /versions", hsName, res.StatusCode)
+		}
+	}
+	return nil
+}
+
+// runReusableHomeservers starts hs1 and hs2 on a new docker network. Complement removes the containers it
+// deploys when the test package finishes, and on startup removes any containers left over from previous runs,
+// so reusable deployments have to run their own homeserver containers. Only the containers are made here: the
+// homeserver images must follow the same contract as Complement images, and the CA is made by Complement's config.
+func runReusableHomeservers(ctx context.Context, t *testing.T, opts DeploymentOpts) complement.Deployment {
+	t.Helper()
+	dockerClient, err := testcontainers.NewDockerClientWithOpts(ctx)
+	must.NotError(t, "failed to make docker client", err)
+	defer dockerClient.Close()
+	networkName := fmt.Sprintf("complement_crypto_reusable_%d", time.Now().UnixNano())
+	_, err = dockerClient.NetworkCreate(ctx, networkName, types.NetworkCreate{
+		CheckDuplicate: true,
+	})
+	must.NotError(t, "failed to create network", err)
+
+	cfg := newComplementConfig(complement.Deployment.GetConfig)
+	must.NotError(t, "failed to generate CA", cfg.GenerateCA())
+	caCert, err := cfg.CACertificateBytes()
+	must.NotError(t, "failed to encode CA certificate", err)
+	caKey, err := cfg.CAPrivateKeyBytes()
+	must.NotError(t, "failed to encode CA key", err)
+	caDir := writeTempFiles(t, "complement-crypto-ca", map[string][]byte{
+		"ca.crt": caCert,
+		"ca.key": caKey,
+	})
+	homeservers := make(map[string]HomeserverState)
+	for _, hsName := range []string{"hs1", "hs2"} {
+		image := reusableHomeserverImage(opts.HomeserverImages, hsName)
+		if image == "" {
+			ct.Fatalf(t, "no homeserver image for %s: set COMPLEMENT_BASE_IMAGE", hsName)
+		}
+		env := map[string]string{
+			"SERVER_NAME": hsName,
+		}
+		if !opts.NoFederationProxy {
+			// send federation traffic via mitmproxy
+			for k, v := range FederationProxyEnv() {
+				env[k] = v
+			}
+		}
+		hsContainer, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+			ContainerRequest: testcontainers.ContainerRequest{
+				Image:        image,
+				ExposedPorts: []string{"8008/tcp", "8448/tcp"},
+				Env:          env,
+				Files: []testcontainers.ContainerFile{
+					{
+						HostFilePath:      filepath.Join(caDir, "ca.crt"),
+						ContainerFilePath: "/complement/ca/ca.crt",
+						FileMode:          0o644,
+					},
+					{
+						HostFilePath:      filepath.Join(caDir, "ca.key"),
+						ContainerFilePath: "/complement/ca/ca.key",
+						FileMode:          0o644,
+					},
+				},
+				WaitingFor: wait.ForHTTP("/_matrix/client/versions").WithPort("8008/tcp"),
+				Networks:   []string{networkName},
+				NetworkAliases: map[string][]string{
+					networkName: {hsName},
+				},
+				HostConfigModifier: func(hc *container.HostConfig) {
+					hc.CapAdd = []string{"NET_ADMIN"}
+					if runtime.GOOS == "linux" {
+						hc.ExtraHosts = []string{"host.docker.internal:host-gateway"}
+					}
+				},
+			},
+			Started: true,
+		})
+		must.NotError(t, "failed to start homeserver container "+hsName, err)
+		homeservers[hsName] = HomeserverState{
+			ContainerID:  hsContainer.GetContainerID(),
+			BaseURL:      externalURL(t, hsContainer, "8008/tcp"),
+			Image:        image,
+			InternalPort: "8008",
+		}
+	}
+	deployment, err := newReusableDeployment(networkName, homeservers, caCert, caKey)
+	must.NotError(t, "failed to make deployment", err)
+	return deployment
+}
+
+// reusableHomeserverImage returns the image configured for the homeserver, which defaults to COMPLEMENT_BASE_IMAGE.
+func reusableHomeserverImage(homeserverImages map[string]string, hsName string) string {
+	if image := homeserverImages[hsName]; image != "" {
+		return image
+	}
+	return os.Getenv("COMPLEMENT_BASE_IMAGE")
+}
+
+// writeTempFiles writes the files to a new temporary directory which containers can write to, and returns the directory.
+func writeTempFiles(t *testing.T, pattern string, files map[string][]byte) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", pattern)
+	must.NotError(t, "failed to make temporary directory", err)
+	// containers may run as a different user
+	must.NotError(t, "failed to chmod temporary directory", os.Chmod(dir, 0o777))
+	for filename, contents := range files {
+		must.NotError(t, "failed to write "+filename, os.WriteFile(filepath.Join(dir, filename), contents, 0o644))
+	}
+	return dir
+}
+
+// reusableHomeservers implements complement.Deployment for homeservers which outlive a single `go test` invocation,
+// apart from GetConfig: see withConfig.
+type reusableHomeservers struct {
+	network string
+	// users are registered on long-lived homeservers, so prefix localparts with something unique
+	// to this run to avoid clashing with users from previous runs, or from other `go test` processes
+	// which are running at the same time.
+	localpartPrefix  string
+	localpartCounter atomic.Int64
+
+	mu          sync.RWMutex
+	homeservers map[string]HomeserverState
+}
+
+// newReusableDeployment returns a complement.Deployment for the homeservers, which use the CA given in PEM format.
+// GetConfig returns a config with the CA and the hostname of this process set, as these are what deployments and
+// callback servers need. Other fields are left at their zero values, as Complement did not make these homeservers.
+func newReusableDeployment(network string, homeservers map[string]HomeserverState, caCertPEM, caKeyPEM []byte) (complement.Deployment, error) {
+	cfg := newComplementConfig(complement.Deployment.GetConfig)
+	cfg.HostnameRunningComplement = os.Getenv("COMPLEMENT_HOSTNAME_RUNNING_COMPLEMENT")
+	if cfg.HostnameRunningComplement == "" {
+		cfg.HostnameRunningComplement = "host.docker.internal"
+	}
+	var err error
+	cfg.CACertificate, cfg.CAPrivateKey, err = parseCA(caCertPEM, caKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, 6)
+	if _, err = rand.Read(prefix); err != nil {
+		return nil, fmt.Errorf("failed to make localpart prefix: %s", err)
+	}
+	return withComplementConfig(&reusableHomeservers{
+		network:         network,
+		localpartPrefix: "user-" + hex.EncodeToString(prefix),
+		homeservers:     homeservers,
+	}, cfg), nil
+}
+
+// parseCA parses a CA certificate and key in the PEM format written by Complement's config.
+func parseCA(certPEM, keyPEM []byte) (*x509.Certificate, *rsa.PrivateKey, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, nil, fmt.Errorf("no CA certificate")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse CA certificate: %s", err)
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, nil, fmt.Errorf("no CA key")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse CA key: %s", err)
+	}
+	return cert, key, nil
+}
+
+// withConfig adds GetConfig to reusableHomeservers, making it a complement.Deployment. Complement's config type
+// is internal to Complement, so it cannot be named outside of it: C is always inferred from the signature of
+// complement.Deployment.GetConfig.
+type withConfig[C any] struct {
+	*reusableHomeservers
+	config C
+}
+
+func (d *withConfig[C]) GetConfig() C {
+	return d.config
+}
+
+// withComplementConfig returns the homeservers as a complement.Deployment whose GetConfig returns cfg. Panics if
+// cfg is not a Complement config.
+func withComplementConfig[C any](rh *reusableHomeservers, cfg C) complement.Deployment {
+	return any(&withConfig[C]{reusableHomeservers: rh, config: cfg}).(complement.Deployment)
+}
+
+// newComplementConfig returns an empty Complement config. Call with complement.Deployment.GetConfig, which
+// lets T be inferred.
+func newComplementConfig[T any](getConfig func(complement.Deployment) *T) *T {
+	return new(T)
+}
+
+func (d *reusableHomeservers) homeserver(t ct.TestLike, hsName string) HomeserverState {
+	t.Helper()
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	hs, ok := d.homeservers[hsName]
+	if !ok {
+		ct.Fatalf(t, "reusableHomeservers: HS name '%s' not found", hsName)
+	}
+	return hs
+}
+
+func (d *reusableHomeservers) UnauthenticatedClient(t ct.TestLike, hsName string) *client.CSAPI {
+	t.Helper()
+	return &client.CSAPI{
+		BaseURL:          d.homeserver(t, hsName).BaseURL,
+		Client:           client.NewLoggedClient(t, hsName, nil),
+		SyncUntilTimeout: timing.Get().Scale(5 * time.Second),
+	}
+}
+
+func (d *reusableHomeservers) Register(t ct.TestLike, hsName string, opts helpers.RegistrationOpts) *client.CSAPI {
+	t.Helper()
+	c := d.UnauthenticatedClient(t, hsName)
+	c.Password = opts.Password
+	if c.Password == "" {
+		c.Password = "complement_meets_min_password_req"
+	}
+	localpart := fmt.Sprintf("%s-%d", d.localpartPrefix, d.localpartCounter.Add(1))
+	if opts.LocalpartSuffix != "" {
+		localpart += "-" + opts.LocalpartSuffix
+	}
+	if opts.IsAdmin {
+		c.UserID, c.AccessToken, c.DeviceID = c.RegisterSharedSecret(t, localpart, c.Password, opts.IsAdmin)
+	} else {
+		c.UserID, c.AccessToken, c.DeviceID = c.RegisterUser(t, localpart, c.Password)
+	}
+	return c
+}
+
+func (d *reusableHomeservers) Login(t ct.TestLike, hsName string, existing *client.CSAPI, opts helpers.LoginOpts) *client.CSAPI {
+	t.Helper()
+	c := d.UnauthenticatedClient(t, hsName)
+	c.Password = existing.Password
+	if opts.Password != "" {
+		c.Password = opts.Password
+	}
+	localpart := strings.SplitN(strings.TrimPrefix(existing.UserID, "@"), ":", 2)[0]
+	if opts.DeviceID == "" {
+		c.UserID, c.AccessToken, c.DeviceID = c.LoginUser(t, localpart, c.Password)
+	} else {
+		c.UserID, c.AccessToken, c.DeviceID = c.LoginUser(t, localpart, c.Password, client.WithDeviceID(opts.DeviceID))
+	}
+	return c
+}
+
+func (d *reusableHomeservers) AppServiceUser(t ct.TestLike, hsName, appServiceUserID string) *client.CSAPI {
+	t.Helper()
+	ct.Fatalf(t, "AppServiceUser: application services are not supported on reusable deployments")
+	return nil
+}
+
+func (d *reusableHomeservers) Restart(t ct.TestLike) error {
+	t.Helper()
+	for _, hsName := range []string{"hs1", "hs2"} {
+		d.StopServer(t, hsName)
+		d.StartServer(t, hsName)
+	}
+	return nil
+}
+
+func (d *reusableHomeservers) StopServer(t ct.TestLike, hsName string) {
+	t.Helper()
+	t.Logf("StopServer %s", hsName)
+	withDockerClient(t, func(ctx context.Context, dockerClient *testcontainers.DockerClient) error {
+		return dockerClient.ContainerStop(ctx, d.homeserver(t, hsName).ContainerID, container.StopOptions{})
+	})
+}
+
+// StartServer starts a previously stopped homeserver. As with Complement, the port allocations may change.
+func (d *reusableHomeservers) StartServer(t ct.TestLike, hsName string) {
+	t.Helper()
+	t.Logf("StartServer %s", hsName)
+	hs := d.homeserver(t, hsName)
+	withDockerClient(t, func(ctx context.Context, dockerClient *testcontainers.DockerClient) error {
+		if err := dockerClient.ContainerStart(ctx, hs.ContainerID, types.ContainerStartOptions{}); err != nil {
+			return err
+		}
+		containerJSON, err := dockerClient.ContainerInspect(ctx, hs.ContainerID)
+		if err != nil {
+			return err
+		}
+		bindings := containerJSON.NetworkSettings.Ports[nat.Port(hs.InternalPort+"/tcp")]
+		if len(bindings) == 0 {
+			return fmt.Errorf("no port bindings for %s", hsName)
+		}
+		hs.BaseURL = "http://127.0.0.1:" + bindings[0].HostPort
+		d.mu.Lock()
+		d.homeservers[hsName] = hs
+		d.mu.Unlock()
+		return nil
+	})
+}
+
+func (d *reusableHomeservers) PauseServer(t ct.TestLike, hsName string) {
+	t.Helper()
+	t.Logf("PauseServer %s", hsName)
+	withDockerClient(t, func(ctx context.Context, dockerClient *testcontainers.DockerClient) error {
+		return dockerClient.ContainerPause(ctx, d.homeserver(t, hsName).ContainerID)
+	})
+}
+
+func (d *reusableHomeservers) UnpauseServer(t ct.TestLike, hsName string) {
+	t.Helper()
+	t.Logf("UnpauseServer %s", hsName)
+	withDockerClient(t, func(ctx context.Context, dockerClient *testcontainers.DockerClient) error {
+		return dockerClient.ContainerUnpause(ctx, d.homeserver(t, hsName).ContainerID)
+	})
+}
+
+func (d *reusableHomeservers) ContainerID(t ct.TestLike, hsName string) string {
+	t.Helper()
+	return d.homeserver(t, hsName).ContainerID
+}
+
+// Destroy is a no-op: reusable deployments are destroyed via TeardownReusableDeployment.
+func (d *reusableHomeservers) Destroy(t ct.TestLike) {}
+
+func (d *reusableHomeservers) RoundTripper() http.RoundTripper {
+	return http.DefaultTransport
+}
+
+func (d *reusableHomeservers) Network() string {
+	return d.network
+}
+
+func (d *reusableHomeservers) state() map[string]HomeserverState {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	homeservers := make(map[string]HomeserverState, len(d.homeservers))
+	for hsName, hs := range d.homeservers {
+		homeservers[hsName] = hs
+	}
+	return homeservers
+}
@@ -0,0 +1,131 @@
+package deploy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement-crypto/internal/config/timing"
+	"github.com/matrix-org/complement/must"
+)
+
+func TestReusableDeploymentConfig(t *testing.T) {
+	t.Setenv("COMPLEMENT_HOSTNAME_RUNNING_COMPLEMENT", "")
+	cfg := newComplementConfig(complement.Deployment.GetConfig)
+	must.NotError(t, "failed to generate CA", cfg.GenerateCA())
+	caCert, err := cfg.CACertificateBytes()
+	must.NotError(t, "failed to encode CA certificate", err)
+	caKey, err := cfg.CAPrivateKeyBytes()
+	must.NotError(t, "failed to encode CA key", err)
+
+	// the CA must survive being written to the state file, so reattaching gets the same config
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	state := DeploymentState{
+		Network: "complement_crypto_reusable_1",
+		Homeservers: map[string]HomeserverState{
+			"hs1": {ContainerID: "abc", BaseURL: "http://127.0.0.1:1234", InternalPort: "8008"},
+		},
+		CACert: string(caCert),
+		CAKey:  string(caKey),
+	}
+	must.NotError(t, "failed to write state", state.write(stateFile))
+	reread, err := ReadDeploymentState(stateFile)
+	must.NotError(t, "failed to read state", err)
+
+	deployment, err := newReusableDeployment(reread.Network, reread.Homeservers, []byte(reread.CACert), []byte(reread.CAKey))
+	must.NotError(t, "newReusableDeployment", err)
+	must.Equal(t, deployment.Network(), "complement_crypto_reusable_1", "Network")
+	must.Equal(t, deployment.ContainerID(t, "hs1"), "abc", "ContainerID")
+	must.Equal(t, deployment.GetConfig().HostnameRunningComplement, "host.docker.internal", "HostnameRunningComplement")
+	gotCert, err := deployment.GetConfig().CACertificateBytes()
+	must.NotError(t, "CACertificateBytes", err)
+	must.Equal(t, string(gotCert), string(caCert), "CA certificate")
+	gotKey, err := deployment.GetConfig().CAPrivateKeyBytes()
+	must.NotError(t, "CAPrivateKeyBytes", err)
+	must.Equal(t, string(gotKey), string(caKey), "CA key")
+
+	_, err = newReusableDeployment(reread.Network, reread.Homeservers, nil, nil)
+	if err == nil {
+		t.Fatalf("newReusableDeployment without a CA did not return an error")
+	}
+}
+
+func TestReattachResetsMITM(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	// acts as mitmproxy: requests to the controller are proxied, so have absolute URLs
+	controller := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.String())
+		mu.Unlock()
+		w.Write([]byte(`{}`))
+	}))
+	defer controller.Close()
+	d := &SlidingSyncDeployment{
+		mitmClient: newMITMClient(t, controller.URL),
+		optionLocks: map[string][]string{
+			"TestFromPreviousRun": {"lock_id"},
+		},
+	}
+	must.NotError(t, "resetMITM", d.resetMITM())
+	mu.Lock()
+	defer mu.Unlock()
+	must.Equal(t, len(paths), 3, "number of requests")
+	must.Equal(t, paths[0], magicMITMURL+"/options/reset", "options reset")
+	must.Equal(t, paths[1], magicMITMURL+"/tests/reset", "tests reset")
+	must.Equal(t, paths[2], magicMITMURL+"/callbacks/reset", "callbacks reset")
+	must.Equal(t, len(d.optionLocks), 0, "option locks")
+}
+
+func TestReattachRefusesChangedImage(t *testing.T) {
+	t.Setenv("COMPLEMENT_BASE_IMAGE", "homeserver:new")
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	state := DeploymentState{
+		Network: "complement_crypto_reusable_1",
+		Homeservers: map[string]HomeserverState{
+			"hs1": {ContainerID: "abc", BaseURL: "http://127.0.0.1:1234", Image: "homeserver:new", InternalPort: "8008"},
+			"hs2": {ContainerID: "def", BaseURL: "http://127.0.0.1:5678", Image: "homeserver:old", InternalPort: "8008"},
+		},
+	}
+	must.NotError(t, "failed to write state", state.write(stateFile))
+	// this fails before the deployment is checked, so no containers are needed
+	d := reattachDeployment(t, DeploymentOpts{DeploymentStateFile: stateFile})
+	if d != nil {
+		t.Fatalf("reattached to a deployment with a different hs2 image")
+	}
+	must.Equal(t, reusableHomeserverImage(map[string]string{"hs2": "homeserver:hs2"}, "hs2"), "homeserver:hs2", "configured image")
+	must.Equal(t, reusableHomeserverImage(map[string]string{"hs2": "homeserver:hs2"}, "hs1"), "homeserver:new", "default image")
+}
+
+func TestLockDeploymentState(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	unlock, err := lockDeploymentState(stateFile)
+	must.NotError(t, "failed to lock", err)
+	locked := make(chan func())
+	go func() {
+		// another test package waiting for the deployment
+		unlockOther, err := lockDeploymentState(stateFile)
+		if err != nil {
+			t.Errorf("failed to lock: %s", err)
+		}
+		locked <- unlockOther
+	}()
+	select {
+	case <-locked:
+		t.Fatalf("took the lock whilst it was held")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case unlockOther := <-locked:
+		if unlockOther != nil {
+			unlockOther()
+		}
+	case <-time.After(timing.Get().Scale(5 * time.Second)):
+		t.Fatalf("did not take the lock once it was released")
+	}
+}
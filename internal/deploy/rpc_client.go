@@ -1,17 +1,14 @@
 package deploy
 
 import (
-	"bufio"
+	"encoding/json"
 	"fmt"
-	"log"
-	"net/rpc"
 	"os"
-	"os/exec"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/config/timing"
 	"github.com/matrix-org/complement/ct"
 )
 
@@ -48,160 +45,172 @@ func (r *RPCLanguageBindings) PostTestRun(contextID string) {
 //   - IPC via stdout fails (used to extract the random high numbered port)
 //   - the client cannot talk to the rpc server
 func (r *RPCLanguageBindings) MustCreateClient(t ct.TestLike, cfg api.ClientCreationOpts) api.Client {
-	contextID := fmt.Sprintf("%s%s_%s", r.contextPrefix, strings.Replace(cfg.UserID[1:], ":", "_", -1), cfg.DeviceID)
+	contextID := rpcContextID(r.contextPrefix, cfg)
 	// security: check it is a file not a random bash script...
 	if _, err := os.Stat(r.binaryPath); err != nil {
 		ct.Fatalf(t, "%s: RPC binary at %s does not exist or cannot be executed/read: %s", contextID, r.binaryPath, err)
 	}
-	rpcCmd := exec.Command(r.binaryPath)
-	stdout, err := rpcCmd.StdoutPipe()
+	proc := startRPCProcess(t, r.binaryPath, contextID)
+	return mustCreateRPCClient(t, proc, r.clientType, r.contextPrefix, cfg)
+}
+
+// mustCreateRPCClient creates a client in this RPC server.
+func mustCreateRPCClient(t ct.TestLike, proc *rpcProcess, lang api.ClientTypeLang, contextPrefix string, cfg api.ClientCreationOpts) *RPCClient {
+	contextID := rpcContextID(contextPrefix, cfg)
+	var output RPCHandle
+	err := proc.client.Call("MustCreateClient", RPCClientCreationOpts{
+		ClientCreationOpts: cfg,
+		ContextID:          contextID,
+		Lang:               lang,
+	}, &output)
 	if err != nil {
-		ct.Fatalf(t, "%s: cannot pipe stdout of rpc binary: %s", contextID, err)
+		ct.Fatalf(t, "%s: failed to create RPC client: %s", contextID, proc.wrapErr(err, cfg.UserID))
 	}
-	rpcCmd.Stderr = rpcCmd.Stdout
-	if err := rpcCmd.Start(); err != nil { // this calls NewRPCServer() effectively
-		ct.Fatalf(t, "%s: cannot start RPC binary %s: %s", contextID, r.binaryPath, err)
+	return &RPCClient{
+		process:       proc,
+		handle:        output.Handle,
+		userID:        cfg.UserID,
+		lang:          lang,
+		contextPrefix: contextPrefix,
 	}
-	// wait until we get a high-numbered port
-	portCh := make(chan struct {
-		port int
-		err  error
-	})
-	go func() {
-		rd := bufio.NewReader(stdout)
-		defer close(portCh)
-		defer func() {
-			// log stdout from the RPC server
-			go func() {
-				for {
-					str, err := rd.ReadString('\n')
-					if err != nil {
-						log.Print("RPC ERROR: " + err.Error())
-						break
-					}
-					log.Printf("  RPC (%s): %s", contextID, str)
-				}
-			}()
-			// we need to .Wait to ensure we clean up resources when the RPC server dies.
-			rpcCmd.Wait()
-		}()
-
-		var port int
-		for {
-			str, err := rd.ReadString('\n')
-			if port == 0 { // we need a port
-				if err != nil {
-					portCh <- struct {
-						port int
-						err  error
-					}{port: 0, err: fmt.Errorf("failed to read stdout line: %s", err)}
-					return
-				}
-				port, err = strconv.Atoi(strings.TrimSpace(str))
-				if err != nil {
-					log.Printf("  RPC (%s): %s", contextID, str)
-					continue
-				}
-				portCh <- struct {
-					port int
-					err  error
-				}{
-					port: port,
-					err:  nil,
-				}
-				break
-			}
-		}
-	}()
-	select {
-	case p := <-portCh:
-		rpcAddr := fmt.Sprintf("127.0.0.1:%d", p.port)
-		var void int
-		client, err := rpc.DialHTTP("tcp", rpcAddr)
-		if err != nil {
-			t.Fatalf("DialHTTP: %s", err)
-		}
+}
 
-		err = client.Call("RPCServer.MustCreateClient", RPCClientCreationOpts{
-			ClientCreationOpts: cfg,
-			ContextID:          contextID,
-			Lang:               r.clientType,
-		}, &void)
-		if err != nil {
-			ct.Fatalf(t, "%s: failed to create RPC client: %s", contextID, err)
-		}
-		return &RPCClient{
-			client: client,
-			lang:   r.clientType,
-			rpcCmd: rpcCmd,
-		}
-	case <-time.After(time.Second):
-		ct.Fatalf(t, "%s: timed out waiting for port number to be echoed to stdout. Did the RPC binary run, and is it actually the RPC binary? Path: %s", contextID, r.binaryPath)
-	}
-	panic("unreachable")
+func rpcContextID(contextPrefix string, cfg api.ClientCreationOpts) string {
+	return fmt.Sprintf("%s%s_%s", contextPrefix, strings.Replace(cfg.UserID[1:], ":", "_", -1), cfg.DeviceID)
 }
 
-// RPCClient implements api.Client by making RPC calls to an RPC server, which actually has a concrete api.Client
+// RPCClient implements api.Client by making RPC calls to an RPC server, which actually has a concrete api.Client.
+// An RPC server can host many clients, which are identified by their handle.
 type RPCClient struct {
-	client *rpc.Client
-	lang   api.ClientTypeLang
-	rpcCmd *exec.Cmd
+	process       *rpcProcess
+	handle        string
+	userID        string
+	lang          api.ClientTypeLang
+	contextPrefix string
 }
 
+// MustCreateClientInSameProcess creates another client of the same language in the RPC server which
+// hosts this client, so both clients share the same process e.g the same tokio runtime.
+func (c *RPCClient) MustCreateClientInSameProcess(t ct.TestLike, cfg api.ClientCreationOpts) *RPCClient {
+	t.Helper()
+	return mustCreateRPCClient(t, c.process, c.lang, c.contextPrefix, cfg)
+}
+
+// ForceClose kills the RPC server, and hence every client in the same process.
 func (c *RPCClient) ForceClose(t ct.TestLike) {
 	t.Helper()
-	err := c.rpcCmd.Process.Kill()
+	err := c.process.kill()
 	if err != nil {
 		t.Fatalf("failed to kill process: %s", err)
 	}
 }
 
+// Suspend freezes the RPC server with SIGSTOP, and hence every client in the same process. If the test does not
+// call Resume e.g because it failed, the RPC server is resumed when the test finishes, or before it is closed.
+func (c *RPCClient) Suspend(t ct.TestLike) {
+	t.Helper()
+	if err := c.process.suspend(); err != nil {
+		t.Fatalf("failed to send SIGSTOP to process: %s", err)
+	}
+	if tc, ok := t.(interface{ Cleanup(func()) }); ok {
+		tc.Cleanup(func() {
+			if err := c.process.resume(); err != nil {
+				t.Logf("failed to resume process: %s", err)
+			}
+		})
+	}
+}
+
+// Resume unfreezes a suspended RPC server with SIGCONT.
+func (c *RPCClient) Resume(t ct.TestLike) {
+	t.Helper()
+	if err := c.process.resume(); err != nil {
+		t.Fatalf("failed to send SIGCONT to process: %s", err)
+	}
+}
+
+// Terminate the RPC server, and hence every client in the same process. If graceful, sends SIGTERM, which
+// closes every client before exiting, and waits for the process to exit. If the process does not exit
+// within the timing profile's RPCTerminateTimeout, it is killed. If not graceful, this is the same as ForceClose.
+func (c *RPCClient) Terminate(t ct.TestLike, graceful bool) {
+	t.Helper()
+	if !graceful {
+		c.ForceClose(t)
+		return
+	}
+	if err := c.process.terminate(); err != nil {
+		t.Fatalf("failed to send SIGTERM to process: %s", err)
+	}
+	timeout := timing.Get().RPCTerminateTimeout
+	select {
+	case <-c.process.exited:
+	case <-time.After(timeout):
+		t.Logf("RPC server did not exit within %v of SIGTERM, killing it", timeout)
+		c.ForceClose(t)
+	}
+}
+
 // Close is called to clean up resources.
 // Specifically, we need to shut off existing browsers and any FFI bindings.
 // If we get callbacks/events after this point, tests may panic if the callbacks
 // log messages.
 func (c *RPCClient) Close(t ct.TestLike) {
 	t.Helper()
-	var void int
 	fmt.Println("RPCClient.Close")
-	err := c.client.Call("RPCServer.Close", t.Name(), &void)
+	// a suspended process would never respond
+	if err := c.process.resume(); err != nil {
+		t.Fatalf("RPCClient.Close: failed to resume process: %s", err)
+	}
+	err := c.call("Close", RPCTestName{Handle: c.handle, TestName: t.Name()}, nil)
 	if err != nil {
 		t.Fatalf("RPCClient.Close: %s", err)
 	}
-	c.client.Close()
+	c.process.client.Close()
+}
+
+// call the method on the RPC server. If the RPC server has died, returns an error saying why.
+func (c *RPCClient) call(method string, params interface{}, result interface{}) error {
+	if c.process.hasExited() {
+		return c.process.deathError(c.userID)
+	}
+	err := c.process.client.Call(method, params, result)
+	if err != nil {
+		return c.process.wrapErr(err, c.userID)
+	}
+	return nil
 }
 
 func (c *RPCClient) GetNotification(t ct.TestLike, roomID, eventID string) (*api.Notification, error) {
 	var notification api.Notification
 	input := RPCGetNotification{
-		RoomID:  roomID,
-		EventID: eventID,
+		Handle:   c.handle,
+		TestName: t.Name(),
+		RoomID:   roomID,
+		EventID:  eventID,
 	}
-	err := c.client.Call("RPCServer.GetNotification", input, &notification)
+	err := c.call("GetNotification", input, &notification)
 	return &notification, err
 }
 
 func (c *RPCClient) CurrentAccessToken(t ct.TestLike) string {
-	var token string
-	err := c.client.Call("RPCServer.CurrentAccessToken", t.Name(), &token)
+	var output RPCAccessToken
+	err := c.call("CurrentAccessToken", RPCTestName{Handle: c.handle, TestName: t.Name()}, &output)
 	if err != nil {
 		ct.Fatalf(t, "RPCServer.CurrentAccessToken: %s", err)
 	}
-	return token
+	return output.AccessToken
 }
 
 // Remove any persistent storage, if it was enabled.
 func (c *RPCClient) DeletePersistentStorage(t ct.TestLike) {
-	var void int
-	err := c.client.Call("RPCServer.DeletePersistentStorage", t.Name(), &void)
+	err := c.call("DeletePersistentStorage", RPCTestName{Handle: c.handle, TestName: t.Name()}, nil)
 	if err != nil {
 		t.Fatalf("RPCClient.DeletePersistentStorage: %s", err)
 	}
 }
 func (c *RPCClient) Login(t ct.TestLike, opts api.ClientCreationOpts) error {
-	var void int
 	fmt.Printf("RPCClient Calling login with %+v\n", opts)
-	err := c.client.Call("RPCServer.Login", opts, &void)
+	err := c.call("Login", RPCLogin{Handle: c.handle, ClientCreationOpts: opts}, nil)
 	fmt.Println("RPCClient login returned => ", err)
 	return err
 }
@@ -211,13 +220,12 @@ func (c *RPCClient) Login(t ct.TestLike, opts api.ClientCreationOpts) error {
 // MUST BLOCK until the initial sync is complete.
 // Fails the test if there was a problem syncing.
 func (c *RPCClient) MustStartSyncing(t ct.TestLike) (stopSyncing func()) {
-	var void int
-	err := c.client.Call("RPCServer.MustStartSyncing", t.Name(), &void)
+	err := c.call("MustStartSyncing", RPCTestName{Handle: c.handle, TestName: t.Name()}, nil)
 	if err != nil {
 		t.Fatalf("RPCClient.MustStartSyncing: %s", err)
 	}
 	return func() {
-		err := c.client.Call("RPCServer.StopSyncing", t.Name(), &void)
+		err := c.call("StopSyncing", RPCTestName{Handle: c.handle, TestName: t.Name()}, nil)
 		if err != nil {
 			t.Fatalf("RPCClient.StopSyncing: %s", err)
 		}
@@ -229,13 +237,12 @@ func (c *RPCClient) MustStartSyncing(t ct.TestLike) (stopSyncing func()) {
 // MUST BLOCK until the initial sync is complete.
 // Returns an error if there was a problem syncing.
 func (c *RPCClient) StartSyncing(t ct.TestLike) (stopSyncing func(), err error) {
-	var void int
-	err = c.client.Call("RPCServer.StartSyncing", t.Name(), &void)
+	err = c.call("StartSyncing", RPCTestName{Handle: c.handle, TestName: t.Name()}, nil)
 	if err != nil {
 		return
 	}
 	return func() {
-		err := c.client.Call("RPCServer.StopSyncing", t.Name(), &void)
+		err := c.call("StopSyncing", RPCTestName{Handle: c.handle, TestName: t.Name()}, nil)
 		if err != nil {
 			t.Logf("RPCClient.StopSyncing: %s", err)
 		}
@@ -245,61 +252,74 @@ func (c *RPCClient) StartSyncing(t ct.TestLike) (stopSyncing func(), err error)
 // IsRoomEncrypted returns true if the room is encrypted. May return an error e.g if you
 // provide a bogus room ID.
 func (c *RPCClient) IsRoomEncrypted(t ct.TestLike, roomID string) (bool, error) {
-	var isEncrypted bool
-	err := c.client.Call("RPCServer.IsRoomEncrypted", roomID, &isEncrypted)
-	return isEncrypted, err
+	var output RPCIsRoomEncrypted
+	err := c.call("IsRoomEncrypted", RPCRoomID{
+		Handle:   c.handle,
+		TestName: t.Name(),
+		RoomID:   roomID,
+	}, &output)
+	return output.IsEncrypted, err
 }
 
 // SendMessage sends the given text as an m.room.message with msgtype:m.text into the given
 // room. Returns the event ID of the sent event, so MUST BLOCK until the event has been sent.
 func (c *RPCClient) SendMessage(t ct.TestLike, roomID, text string) (eventID string) {
-	err := c.client.Call("RPCServer.SendMessage", RPCSendMessage{
+	var output RPCEventID
+	err := c.call("SendMessage", RPCSendMessage{
+		Handle:   c.handle,
 		TestName: t.Name(),
 		RoomID:   roomID,
 		Text:     text,
-	}, &eventID)
+	}, &output)
 	if err != nil {
 		t.Fatalf("RPCClient.SendMessage: %s", err)
 	}
-	return
+	return output.EventID
 }
 
 // TrySendMessage tries to send the message, but can fail.
 func (c *RPCClient) TrySendMessage(t ct.TestLike, roomID, text string) (eventID string, err error) {
-	err = c.client.Call("RPCServer.TrySendMessage", RPCSendMessage{
+	var output RPCEventID
+	err = c.call("TrySendMessage", RPCSendMessage{
+		Handle:   c.handle,
 		TestName: t.Name(),
 		RoomID:   roomID,
 		Text:     text,
-	}, &eventID)
-	return
+	}, &output)
+	return output.EventID, err
 }
 
-// Wait until an event is seen in the given room. The checker functions can be custom or you can use
-// a pre-defined one like api.CheckEventHasMembership, api.CheckEventHasBody, or api.CheckEventHasEventID.
-func (c *RPCClient) WaitUntilEventInRoom(t ct.TestLike, roomID string, checker func(e api.Event) bool) api.Waiter {
-	var waiterID int
-	err := c.client.Call("RPCServer.WaitUntilEventInRoom", RPCWaitUntilEvent{
+// Wait until an event is seen in the given room. If the checker is an api.EventMatcher, it is evaluated by the
+// RPC server so only matching events are sent back. Otherwise, every event is sent back to be checked here.
+func (c *RPCClient) WaitUntilEventInRoom(t ct.TestLike, roomID string, checker api.EventChecker) api.Waiter {
+	var output RPCWaiterID
+	input := RPCWaitUntilEvent{
+		Handle:   c.handle,
 		TestName: t.Name(),
 		RoomID:   roomID,
-	}, &waiterID)
+	}
+	if matcher, ok := checker.(api.EventMatcher); ok {
+		input.Matcher = &matcher
+	}
+	err := c.call("WaitUntilEventInRoom", input, &output)
 	if err != nil {
 		t.Fatalf("RPCClient.WaitUntilEventInRoom: %s", err)
 	}
 	return &RPCWaiter{
-		client:   c.client,
-		waiterID: waiterID,
+		client:   c,
+		waiterID: output.WaiterID,
 		checker:  checker,
 	}
 }
 
 // Backpaginate in this room by `count` events.
 func (c *RPCClient) MustBackpaginate(t ct.TestLike, roomID string, count int) {
-	var void int
-	err := c.client.Call("RPCServer.MustBackpaginate", RPCBackpaginate{
+	err := c.call("MustBackpaginate", RPCBackpaginate{
+		Handle:   c.handle,
 		TestName: t.Name(),
 		RoomID:   roomID,
 		Count:    count,
-	}, &void)
+	}, nil)
 	if err != nil {
 		t.Fatalf("RPCClient.MustBackpaginate: %s", err)
 	}
@@ -308,7 +328,8 @@ func (c *RPCClient) MustBackpaginate(t ct.TestLike, roomID string, count int) {
 // MustGetEvent will return the client's view of this event, or fail the test if the event cannot be found.
 func (c *RPCClient) MustGetEvent(t ct.TestLike, roomID, eventID string) api.Event {
 	var ev api.Event
-	err := c.client.Call("RPCServer.MustGetEvent", RPCGetEvent{
+	err := c.call("MustGetEvent", RPCGetEvent{
+		Handle:   c.handle,
 		TestName: t.Name(),
 		RoomID:   roomID,
 		EventID:  eventID,
@@ -321,17 +342,21 @@ func (c *RPCClient) MustGetEvent(t ct.TestLike, roomID, eventID string) api.Even
 
 // MustBackupKeys will backup E2EE keys, else fail the test.
 func (c *RPCClient) MustBackupKeys(t ct.TestLike) (recoveryKey string) {
-	err := c.client.Call("RPCServer.MustBackupKeys", 0, &recoveryKey)
+	var output RPCRecoveryKey
+	err := c.call("MustBackupKeys", RPCTestName{Handle: c.handle, TestName: t.Name()}, &output)
 	if err != nil {
 		t.Fatalf("RPCClient.MustBackupKeys: %v", err)
 	}
-	return
+	return output.RecoveryKey
 }
 
 // MustLoadBackup will recover E2EE keys from the latest backup, else fail the test.
 func (c *RPCClient) MustLoadBackup(t ct.TestLike, recoveryKey string) {
-	var void int
-	err := c.client.Call("RPCServer.MustLoadBackup", recoveryKey, &void)
+	err := c.call("MustLoadBackup", RPCLoadBackup{
+		Handle:      c.handle,
+		TestName:    t.Name(),
+		RecoveryKey: recoveryKey,
+	}, nil)
 	if err != nil {
 		t.Fatalf("RPCClient.MustLoadBackup: %v", err)
 	}
@@ -339,41 +364,43 @@ func (c *RPCClient) MustLoadBackup(t ct.TestLike, recoveryKey string) {
 
 // LoadBackup will recover E2EE keys from the latest backup, else return an error.
 func (c *RPCClient) LoadBackup(t ct.TestLike, recoveryKey string) error {
-	var void int
-	return c.client.Call("RPCServer.LoadBackup", recoveryKey, &void)
+	return c.call("LoadBackup", RPCLoadBackup{
+		Handle:      c.handle,
+		TestName:    t.Name(),
+		RecoveryKey: recoveryKey,
+	}, nil)
 }
 
 // Log something to stdout and the underlying client log file
 func (c *RPCClient) Logf(t ct.TestLike, format string, args ...interface{}) {
 	str := fmt.Sprintf(format, args...)
 	str = t.Name() + ": " + str
-	var void int
-	err := c.client.Call("RPCServer.Logf", str, &void)
+	err := c.call("Logf", RPCLog{Handle: c.handle, Message: str}, nil)
 	if err != nil {
 		t.Fatalf("RPCClient.Logf: %s", err)
 	}
 }
 
 func (c *RPCClient) UserID() string {
-	var userID string
-	c.client.Call("RPCServer.UserID", 0, &userID)
-	return userID
+	var output RPCUserID
+	c.call("UserID", RPCHandle{Handle: c.handle}, &output)
+	return output.UserID
 }
 func (c *RPCClient) Type() api.ClientTypeLang {
-	var lang api.ClientTypeLang
-	c.client.Call("RPCServer.Type", 0, &lang)
-	return lang
+	var output RPCType
+	c.call("Type", RPCHandle{Handle: c.handle}, &output)
+	return output.Type
 }
 func (c *RPCClient) Opts() api.ClientCreationOpts {
 	var opts api.ClientCreationOpts
-	c.client.Call("RPCServer.Opts", 0, &opts)
+	c.call("Opts", RPCHandle{Handle: c.handle}, &opts)
 	return opts
 }
 
 type RPCWaiter struct {
 	waiterID int
-	client   *rpc.Client
-	checker  func(e api.Event) bool
+	client   *RPCClient
+	checker  api.EventChecker
 }
 
 func (w *RPCWaiter) Waitf(t ct.TestLike, s time.Duration, format string, args ...any) {
@@ -386,37 +413,75 @@ func (w *RPCWaiter) Waitf(t ct.TestLike, s time.Duration, format string, args ..
 
 func (w *RPCWaiter) TryWaitf(t ct.TestLike, s time.Duration, format string, args ...any) error {
 	t.Helper()
-	var void int
 	msg := fmt.Sprintf(format, args...)
-	t.Logf("RPCWaiter.TryWaitf: calling RPCServer.WaiterStart")
-	err := w.client.Call("RPCServer.WaiterStart", RPCWait{
-		TestName: t.Name(),
-		WaiterID: w.waiterID,
-		Msg:      msg,
-		Timeout:  s,
-	}, &void)
+	handle := w.client.handle
+	notifications := w.client.process.notifications
+	// subscribe before starting the waiter so we see all of its events
+	sub := notifications.Subscribe(func(n jsonRPCNotification) bool {
+		var params struct {
+			Handle   string `json:"handle"`
+			WaiterID int    `json:"waiter_id"`
+		}
+		if err := json.Unmarshal(n.Params, &params); err != nil || params.Handle != handle {
+			return false
+		}
+		return n.Method == "ClientState" || params.WaiterID == w.waiterID
+	})
+	err := w.client.call("WaiterStart", RPCWait{
+		Handle:    handle,
+		TestName:  t.Name(),
+		WaiterID:  w.waiterID,
+		Msg:       msg,
+		TimeoutMS: s.Milliseconds(),
+	}, nil)
 	if err != nil {
+		sub.Unsubscribe()
 		return fmt.Errorf("WaiterStart: %s", err)
 	}
-	t.Logf("RPCWaiter.TryWaitf: calling RPCServer.WaiterStart OK")
-	// now we need to poll for events from the remote waiter
+	defer func() {
+		// Unsubscribe first, as nothing reads the subscription once this function returns. Then stop the waiter,
+		// which may have already stopped, so ignore errors.
+		sub.Unsubscribe()
+		w.client.call("WaiterStop", RPCStopWaiter{Handle: handle, WaiterID: w.waiterID}, nil)
+	}()
+	timer := time.NewTimer(s)
+	defer timer.Stop()
 	for {
-		var eventsToCheck []api.Event
-		t.Logf("RPCWaiter.TryWaitf: calling RPCServer.WaiterPoll")
-		err := w.client.Call("RPCServer.WaiterPoll", w.waiterID, &eventsToCheck)
-		if err != nil {
-			return fmt.Errorf("%s: %s", err, msg)
-		}
-		t.Logf("RPCWaiter.TryWaitf: calling RPCServer.WaiterPoll OK with %d events", len(eventsToCheck))
-		// for each event, check with the checker function if it passes
-		for _, ev := range eventsToCheck {
-			if w.checker(ev) {
-				// if it passes, we waited successfully!
-				t.Logf("RPC: checker function passes for event %+v", ev)
-				return nil
+		select {
+		case n, ok := <-sub.C:
+			if !ok {
+				err := w.client.process.wrapErr(fmt.Errorf("RPC notification stream ended: %v", notifications.Err()), w.client.userID)
+				return fmt.Errorf("%s: %s", err, msg)
+			}
+			switch n.Method {
+			case "WaiterEvent":
+				var params RPCWaiterEvent
+				if err := json.Unmarshal(n.Params, &params); err != nil {
+					return fmt.Errorf("invalid WaiterEvent notification: %s: %s", err, msg)
+				}
+				// check with the checker function if it passes
+				if w.checker.Check(params.Event) {
+					// if it passes, we waited successfully!
+					t.Logf("RPC: checker function passes for event %+v", params.Event)
+					return nil
+				}
+			case "WaiterDone":
+				var params RPCWaiterDone
+				if err := json.Unmarshal(n.Params, &params); err != nil {
+					return fmt.Errorf("invalid WaiterDone notification: %s: %s", err, msg)
+				}
+				return fmt.Errorf("%s: %s", params.Error, msg)
+			case "ClientState":
+				var params RPCClientState
+				if err := json.Unmarshal(n.Params, &params); err != nil {
+					return fmt.Errorf("invalid ClientState notification: %s: %s", err, msg)
+				}
+				if params.State == RPCClientStateClosed {
+					return fmt.Errorf("client was closed: %s", msg)
+				}
 			}
+		case <-timer.C:
+			return fmt.Errorf("timed out after %v: %s", s, msg)
 		}
-		// otherwise, keep trying. The RPC server is tracking timeouts for us.
-		time.Sleep(100 * time.Millisecond)
 	}
 }
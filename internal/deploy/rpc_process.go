@@ -0,0 +1,266 @@
+package deploy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/config/timing"
+	"github.com/matrix-org/complement/ct"
+)
+
+// How many lines of output from the RPC server are kept, to be shown if it dies.
+const rpcOutputLines = 200
+
+// rpcProcess is a running RPC server, which can host many clients.
+type rpcProcess struct {
+	client        *jsonRPCClient
+	notifications *jsonRPCNotifications
+	cmd           *exec.Cmd
+	contextID     string
+	exited        chan struct{} // closed when the process exits
+
+	mu         sync.Mutex
+	output     []string // the last rpcOutputLines lines of output
+	exitReason string   // set before exited is closed
+	killed     bool     // true if the test killed the process, so it dying is expected
+	suspended  bool     // true if the process was sent SIGSTOP and has not been sent SIGCONT since
+	reported   bool     // true if the output has been attached to an error
+}
+
+// startRPCProcess runs the RPC binary and connects to it once it has echoed its port number.
+// Fails the test if the process cannot be started, or dies before echoing its port.
+func startRPCProcess(t ct.TestLike, binaryPath, contextID string) *rpcProcess {
+	rpcCmd := exec.Command(binaryPath)
+	// show backtraces if rust code panics, unless the test process has configured this already
+	if os.Getenv("RUST_BACKTRACE") == "" {
+		rpcCmd.Env = append(os.Environ(), "RUST_BACKTRACE=1")
+	}
+	stdout, err := rpcCmd.StdoutPipe()
+	if err != nil {
+		ct.Fatalf(t, "%s: cannot pipe stdout of rpc binary: %s", contextID, err)
+	}
+	rpcCmd.Stderr = rpcCmd.Stdout
+	if err := rpcCmd.Start(); err != nil { // this calls NewRPCServer() effectively
+		ct.Fatalf(t, "%s: cannot start RPC binary %s: %s", contextID, binaryPath, err)
+	}
+	proc := &rpcProcess{
+		cmd:       rpcCmd,
+		contextID: contextID,
+		exited:    make(chan struct{}),
+	}
+	// wait until we get a high-numbered port
+	portCh := make(chan int, 1)
+	go proc.readOutput(stdout, portCh)
+	select {
+	case port, ok := <-portCh:
+		if !ok {
+			<-proc.exited
+			ct.Fatalf(t, "%s: RPC binary exited before echoing its port number: %s", contextID, proc.deathError(contextID))
+		}
+		baseURL := fmt.Sprintf("http://127.0.0.1:%d/", port)
+		// connect to notifications before creating clients, so we see all of their notifications
+		notifications, err := newJSONRPCNotifications(baseURL + "notifications")
+		if err != nil {
+			ct.Fatalf(t, "%s: %s", contextID, err)
+		}
+		proc.client = newJSONRPCClient(baseURL)
+		proc.notifications = notifications
+		return proc
+	case <-time.After(timing.Get().RPCStartupTimeout):
+		ct.Fatalf(t, "%s: timed out waiting for port number to be echoed to stdout. Did the RPC binary run, and is it actually the RPC binary? Path: %s", contextID, binaryPath)
+	}
+	panic("unreachable")
+}
+
+// readOutput logs the output of the RPC server and keeps the last rpcOutputLines lines. The first line which
+// is a number is sent to portCh. portCh is closed when the output ends. Once the output has ended, waits for
+// the process to exit.
+func (p *rpcProcess) readOutput(stdout io.Reader, portCh chan<- int) {
+	rd := bufio.NewReader(stdout)
+	port := 0
+	for {
+		str, err := rd.ReadString('\n')
+		if str != "" {
+			if port == 0 {
+				port, _ = strconv.Atoi(strings.TrimSpace(str))
+				if port != 0 {
+					portCh <- port
+					continue
+				}
+			}
+			log.Printf("  RPC (%s): %s", p.contextID, str)
+			p.mu.Lock()
+			p.output = append(p.output, strings.TrimRight(str, "\n"))
+			if len(p.output) > rpcOutputLines {
+				p.output = p.output[len(p.output)-rpcOutputLines:]
+			}
+			p.mu.Unlock()
+		}
+		if err != nil {
+			break
+		}
+	}
+	close(portCh)
+	// we need to .Wait to ensure we clean up resources when the RPC server dies. This must be done
+	// after reading all the output, as Wait closes stdout.
+	p.cmd.Wait()
+	p.mu.Lock()
+	p.exitReason = exitReason(p.cmd.ProcessState)
+	log.Printf("  RPC (%s): exited: %s", p.contextID, p.exitReason)
+	p.mu.Unlock()
+	close(p.exited)
+}
+
+func (p *rpcProcess) hasExited() bool {
+	select {
+	case <-p.exited:
+		return true
+	default:
+		return false
+	}
+}
+
+// kill the process. It dying is then expected, so errors do not include its output.
+func (p *rpcProcess) kill() error {
+	if err := p.resume(); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.killed = true
+	p.mu.Unlock()
+	return p.cmd.Process.Kill()
+}
+
+// terminate the process gracefully. It dying is then expected, so errors do not include its output.
+// A suspended process is resumed first, else it would not handle SIGTERM.
+func (p *rpcProcess) terminate() error {
+	if err := p.resume(); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.killed = true
+	p.mu.Unlock()
+	return p.cmd.Process.Signal(syscall.SIGTERM)
+}
+
+// suspend the process with SIGSTOP.
+func (p *rpcProcess) suspend() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.cmd.Process.Signal(syscall.SIGSTOP); err != nil {
+		return err
+	}
+	p.suspended = true
+	return nil
+}
+
+// resume the process with SIGCONT if it is suspended, else does nothing.
+func (p *rpcProcess) resume() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.suspended || p.hasExited() {
+		p.suspended = false
+		return nil
+	}
+	if err := p.cmd.Process.Signal(syscall.SIGCONT); err != nil {
+		return err
+	}
+	p.suspended = false
+	return nil
+}
+
+// wrapErr returns why the process died if err was caused by the process dying, else returns err.
+func (p *rpcProcess) wrapErr(err error, userID string) error {
+	if _, ok := err.(*RPCError); ok {
+		return err // the method failed, so the process is alive
+	}
+	// the connection can fail before the process has been reaped, so wait for it
+	select {
+	case <-p.exited:
+		return p.deathError(userID)
+	case <-time.After(timing.Get().Scale(time.Second)):
+		return err
+	}
+}
+
+// deathError returns an error saying why the process died. The first error for an unexpected death includes
+// the last lines of output and any core dump, so they are attached to the test logs.
+func (p *rpcProcess) deathError(userID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.killed {
+		return fmt.Errorf("RPC client for %s was stopped by the test: %s", userID, p.exitReason)
+	}
+	msg := fmt.Sprintf("RPC client for %s died: %s", userID, p.exitReason)
+	if p.reported {
+		return errors.New(msg)
+	}
+	p.reported = true
+	var sb strings.Builder
+	sb.WriteString(msg)
+	fmt.Fprintf(&sb, "\nlast %d lines of output from %s:\n", len(p.output), p.contextID)
+	for _, line := range p.output {
+		sb.WriteString("  " + line + "\n")
+	}
+	if core := p.coreDump(); core != "" {
+		fmt.Fprintf(&sb, "core dump: %s\n", core)
+	}
+	return errors.New(sb.String())
+}
+
+// coreDump returns the path to the core dump of the process, if one was written to the working directory.
+func (p *rpcProcess) coreDump() string {
+	for _, name := range []string{fmt.Sprintf("core.%d", p.cmd.Process.Pid), "core"} {
+		path := filepath.Join(p.cmd.Dir, name)
+		if _, err := os.Stat(path); err == nil {
+			abs, _ := filepath.Abs(path)
+			return abs
+		}
+	}
+	return ""
+}
+
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGBUS:  "SIGBUS",
+	syscall.SIGFPE:  "SIGFPE",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGPIPE: "SIGPIPE",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGTERM: "SIGTERM",
+	syscall.SIGTRAP: "SIGTRAP",
+}
+
+// exitReason describes how a process exited e.g "signal SIGABRT (core dumped)" or "exit status 101".
+func exitReason(state *os.ProcessState) string {
+	if state == nil {
+		return "unknown exit status"
+	}
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return fmt.Sprintf("exit status %d", state.ExitCode())
+	}
+	name := signalNames[status.Signal()]
+	if name == "" {
+		name = fmt.Sprintf("%d (%s)", int(status.Signal()), status.Signal())
+	}
+	reason := "signal " + name
+	if status.CoreDump() {
+		reason += " (core dumped)"
+	}
+	return reason
+}
@@ -0,0 +1,93 @@
+package deploy
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/config/timing"
+	"github.com/matrix-org/complement/must"
+)
+
+// startTestProcess runs the shell script in place of the RPC binary, and returns once it has exited.
+func startTestProcess(t *testing.T, script string, beforeExit func(p *rpcProcess)) *rpcProcess {
+	t.Helper()
+	cmd := exec.Command("sh", "-c", "ulimit -c 0; echo 1234; "+script)
+	p := &rpcProcess{
+		cmd:       cmd,
+		contextID: "1alice",
+		exited:    make(chan struct{}),
+	}
+	stdout, err := cmd.StdoutPipe()
+	must.NotError(t, "failed to pipe stdout", err)
+	cmd.Stderr = cmd.Stdout
+	must.NotError(t, "failed to start", cmd.Start())
+	portCh := make(chan int, 1)
+	go p.readOutput(stdout, portCh)
+	must.Equal(t, <-portCh, 1234, "port")
+	if beforeExit != nil {
+		beforeExit(p)
+	}
+	select {
+	case <-p.exited:
+	case <-time.After(timing.Get().Scale(5 * time.Second)):
+		t.Fatalf("process did not exit")
+	}
+	return p
+}
+
+func TestRPCProcessDeathError(t *testing.T) {
+	p := startTestProcess(t, `for i in $(seq 1 250); do echo "line $i"; done; echo panicked >&2; kill -ABRT $$`, nil)
+	must.Equal(t, p.hasExited(), true, "hasExited")
+	err := p.wrapErr(fmt.Errorf("connection refused"), "@alice:hs1")
+	lines := strings.Split(err.Error(), "\n")
+	must.Equal(t, lines[0], "RPC client for @alice:hs1 died: signal SIGABRT", "first line")
+	must.Equal(t, lines[1], fmt.Sprintf("last %d lines of output from 1alice:", rpcOutputLines), "second line")
+	// only the last lines of output are kept, including stderr
+	must.Equal(t, lines[2], "  line 52", "first line of output")
+	must.Equal(t, lines[2+rpcOutputLines-1], "  panicked", "last line of output")
+	// the output is only included once
+	must.Equal(t, p.deathError("@alice:hs1").Error(), "RPC client for @alice:hs1 died: signal SIGABRT", "second error")
+	// errors from methods are not caused by the process dying
+	rpcErr := &RPCError{Code: RPCErrCodeServerError, Message: "something went wrong"}
+	must.Equal(t, p.wrapErr(rpcErr, "@alice:hs1"), error(rpcErr), "method error")
+}
+
+func TestRPCProcessExitStatus(t *testing.T) {
+	p := startTestProcess(t, `exit 101`, nil)
+	must.Equal(t, strings.Split(p.deathError("@alice:hs1").Error(), "\n")[0], "RPC client for @alice:hs1 died: exit status 101", "error")
+}
+
+func TestRPCProcessKilledByTest(t *testing.T) {
+	p := startTestProcess(t, `exec sleep 10`, func(p *rpcProcess) {
+		must.NotError(t, "failed to kill", p.kill())
+	})
+	must.Equal(t, p.deathError("@alice:hs1").Error(), "RPC client for @alice:hs1 was stopped by the test: signal SIGKILL", "error")
+}
+
+// Test that a suspended process is resumed before being terminated, so it can handle SIGTERM.
+func TestRPCProcessTerminateWhilstSuspended(t *testing.T) {
+	p := startTestProcess(t, `trap 'exit 3' TERM; echo ready; while true; do sleep 0.1; done`, func(p *rpcProcess) {
+		// wait for the trap to be set
+		deadline := time.Now().Add(timing.Get().Scale(5 * time.Second))
+		for {
+			p.mu.Lock()
+			ready := len(p.output) > 0
+			p.mu.Unlock()
+			if ready {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("process did not echo ready")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		must.NotError(t, "failed to suspend", p.suspend())
+		must.NotError(t, "failed to terminate", p.terminate())
+	})
+	must.Equal(t, p.deathError("@alice:hs1").Error(), "RPC client for @alice:hs1 was stopped by the test: exit status 3", "error")
+	// resuming a process which has exited does nothing
+	must.NotError(t, "failed to resume", p.resume())
+}
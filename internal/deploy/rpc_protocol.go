@@ -0,0 +1,554 @@
+package deploy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/config/timing"
+)
+
+// The RPC protocol is JSON-RPC 2.0 (https://www.jsonrpc.org/specification) over HTTP, so RPC servers can be
+// written in any language. Each call is a POST request with a single JSON-RPC request object as the body, and
+// the response body is a single JSON-RPC response object. Params and results are always JSON objects. Batches
+// and notifications are not used. See RPC.md for the methods and their params.
+//
+// The RPC server pushes JSON-RPC notifications to the test process over a long-lived HTTP response from
+// GET /notifications, as newline-delimited JSON.
+const jsonRPCVersion = "2.0"
+
+// Error codes defined by JSON-RPC 2.0. Errors returned by methods use RPCErrCodeServerError.
+const (
+	RPCErrCodeParseError     = -32700
+	RPCErrCodeInvalidRequest = -32600
+	RPCErrCodeMethodNotFound = -32601
+	RPCErrCodeInvalidParams  = -32602
+	RPCErrCodeServerError    = -32000
+)
+
+type jsonRPCRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+type jsonRPCNotification struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+type jsonRPCResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+}
+
+// RPCError is a JSON-RPC error object. It is returned by RPC calls which fail.
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
+// RPCVoid is the params or result of RPC methods which have none. It is encoded as {}.
+type RPCVoid struct{}
+
+type jsonRPCMethod struct {
+	fn        reflect.Value
+	argType   reflect.Type
+	replyType reflect.Type
+}
+
+// jsonRPCHandler serves JSON-RPC 2.0 requests by calling methods on a receiver, in the style of net/rpc.
+type jsonRPCHandler struct {
+	methods map[string]jsonRPCMethod
+}
+
+// NewJSONRPCHandler returns an HTTP handler which serves the exported methods of rcvr over JSON-RPC 2.0.
+// The JSON-RPC method name is the Go method name. Methods which do not meet the form:
+//
+//	func (t *T) MethodName(args T1, reply *T2) error
+//
+// are not served.
+func NewJSONRPCHandler(rcvr interface{}) http.Handler {
+	errorType := reflect.TypeOf((*error)(nil)).Elem()
+	v := reflect.ValueOf(rcvr)
+	typ := v.Type()
+	h := &jsonRPCHandler{
+		methods: make(map[string]jsonRPCMethod),
+	}
+	for i := 0; i < typ.NumMethod(); i++ {
+		m := typ.Method(i)
+		mt := m.Type
+		if !m.IsExported() || mt.NumIn() != 3 || mt.NumOut() != 1 || mt.In(2).Kind() != reflect.Pointer || mt.Out(0) != errorType {
+			continue
+		}
+		h.methods[m.Name] = jsonRPCMethod{
+			fn:        v.Method(i),
+			argType:   mt.In(1),
+			replyType: mt.In(2).Elem(),
+		}
+	}
+	return h
+}
+
+func (h *jsonRPCHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req jsonRPCRequest
+	var res jsonRPCResponse
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		res.Error = &RPCError{Code: RPCErrCodeParseError, Message: err.Error()}
+	} else {
+		res.ID = req.ID
+		res.Result, res.Error = h.call(req)
+	}
+	res.JSONRPC = jsonRPCVersion
+	if res.ID == nil {
+		res.ID = json.RawMessage("null")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *jsonRPCHandler) call(req jsonRPCRequest) (json.RawMessage, *RPCError) {
+	if req.JSONRPC != jsonRPCVersion || req.Method == "" {
+		return nil, &RPCError{Code: RPCErrCodeInvalidRequest, Message: "not a JSON-RPC 2.0 request"}
+	}
+	method, ok := h.methods[req.Method]
+	if !ok {
+		return nil, &RPCError{Code: RPCErrCodeMethodNotFound, Message: "unknown method " + req.Method}
+	}
+	arg := reflect.New(method.argType)
+	if len(req.Params) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(req.Params))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(arg.Interface()); err != nil {
+			return nil, &RPCError{Code: RPCErrCodeInvalidParams, Message: fmt.Sprintf("%s: %s", req.Method, err)}
+		}
+	}
+	reply := reflect.New(method.replyType)
+	out := method.fn.Call([]reflect.Value{arg.Elem(), reply})
+	if err, _ := out[0].Interface().(error); err != nil {
+		return nil, &RPCError{Code: RPCErrCodeServerError, Message: err.Error()}
+	}
+	result, err := json.Marshal(reply.Interface())
+	if err != nil {
+		return nil, &RPCError{Code: RPCErrCodeServerError, Message: fmt.Sprintf("%s: failed to marshal result: %s", req.Method, err)}
+	}
+	return result, nil
+}
+
+// jsonRPCClient makes JSON-RPC 2.0 calls to an RPC server.
+type jsonRPCClient struct {
+	url    string
+	client *http.Client
+	nextID atomic.Int64
+}
+
+func newJSONRPCClient(url string) *jsonRPCClient {
+	return &jsonRPCClient{
+		url: url,
+		client: &http.Client{
+			Transport: &http.Transport{},
+			// so a call to a server which never responds e.g because it is suspended fails rather than hanging
+			Timeout: timing.Get().RPCCallTimeout,
+		},
+	}
+}
+
+// Call the method with the params, and decode the result into result. Returns an *RPCError if the method failed.
+func (c *jsonRPCClient) Call(method string, params interface{}, result interface{}) error {
+	jsonParams, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("%s: failed to marshal params: %s", method, err)
+	}
+	id, _ := json.Marshal(c.nextID.Add(1))
+	body, err := json.Marshal(jsonRPCRequest{
+		JSONRPC: jsonRPCVersion,
+		ID:      id,
+		Method:  method,
+		Params:  jsonParams,
+	})
+	if err != nil {
+		return fmt.Errorf("%s: failed to marshal request: %s", method, err)
+	}
+	httpRes, err := c.client.Post(c.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%s: %s", method, err)
+	}
+	defer httpRes.Body.Close()
+	resBody, err := io.ReadAll(httpRes.Body)
+	if err != nil {
+		return fmt.Errorf("%s: failed to read response: %s", method, err)
+	}
+	var res jsonRPCResponse
+	if err := json.Unmarshal(resBody, &res); err != nil {
+		return fmt.Errorf("%s: HTTP %d: invalid JSON-RPC response: %s", method, httpRes.StatusCode, string(resBody))
+	}
+	if res.Error != nil {
+		return res.Error
+	}
+	if result == nil || len(res.Result) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(res.Result, result); err != nil {
+		return fmt.Errorf("%s: failed to decode result: %s", method, err)
+	}
+	return nil
+}
+
+// Close idle connections to the server.
+func (c *jsonRPCClient) Close() {
+	c.client.CloseIdleConnections()
+}
+
+// JSONRPCNotifier streams JSON-RPC 2.0 notifications to every connected client. It is served by the RPC server
+// on GET /notifications.
+type JSONRPCNotifier struct {
+	mu      sync.Mutex
+	streams map[*jsonRPCStream]struct{}
+	// closed when Close is called, which ends every stream once it has sent its notifications
+	closed    chan struct{}
+	closeOnce sync.Once
+	// tracks running streams, so Close can wait for them to end
+	serving sync.WaitGroup
+}
+
+// How many notifications a stream can buffer before it is disconnected for being too slow.
+const jsonRPCStreamBufferSize = 1000
+
+type jsonRPCStream struct {
+	lines chan []byte
+	// closed when the stream is disconnected for being too slow
+	kicked chan struct{}
+}
+
+func NewJSONRPCNotifier() *JSONRPCNotifier {
+	return &JSONRPCNotifier{
+		streams: make(map[*jsonRPCStream]struct{}),
+		closed:  make(chan struct{}),
+	}
+}
+
+// Notify sends a notification to every connected client, in the order Notify is called. Never blocks: a client
+// which has not read the last jsonRPCStreamBufferSize notifications is disconnected rather than missing some,
+// so it sees the stream end instead of waiting forever.
+func (n *JSONRPCNotifier) Notify(method string, params interface{}) error {
+	jsonParams, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("%s: failed to marshal params: %s", method, err)
+	}
+	line, err := json.Marshal(jsonRPCNotification{
+		JSONRPC: jsonRPCVersion,
+		Method:  method,
+		Params:  jsonParams,
+	})
+	if err != nil {
+		return fmt.Errorf("%s: failed to marshal notification: %s", method, err)
+	}
+	line = append(line, '\n')
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for stream := range n.streams {
+		select {
+		case stream.lines <- line:
+		default:
+			log.Printf("JSONRPCNotifier: disconnecting a stream which has %d unread notifications", len(stream.lines))
+			delete(n.streams, stream)
+			close(stream.kicked)
+		}
+	}
+	return nil
+}
+
+func (n *JSONRPCNotifier) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	stream := &jsonRPCStream{
+		lines:  make(chan []byte, jsonRPCStreamBufferSize),
+		kicked: make(chan struct{}),
+	}
+	n.mu.Lock()
+	select {
+	case <-n.closed:
+		n.mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	default:
+	}
+	n.streams[stream] = struct{}{}
+	n.serving.Add(1)
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		delete(n.streams, stream)
+		n.mu.Unlock()
+		n.serving.Done()
+	}()
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(200)
+	// tell the client the stream is connected, so it does not miss any notifications
+	if flusher != nil {
+		flusher.Flush()
+	}
+	write := func(line []byte) bool {
+		if _, err := w.Write(line); err != nil {
+			return false
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return true
+	}
+	for {
+		select {
+		case line := <-stream.lines:
+			if !write(line) {
+				return
+			}
+		case <-stream.kicked:
+			return
+		case <-r.Context().Done():
+			return
+		case <-n.closed:
+			// send what has already been notified, then end the stream
+			for {
+				select {
+				case line := <-stream.lines:
+					if !write(line) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// connected returns true if any stream is connected.
+func (n *JSONRPCNotifier) connected() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.streams) > 0
+}
+
+// Close ends every stream once it has sent the notifications which have already been sent with Notify, so they
+// are not lost when the process exits. Waits up to timeout for the streams to end. New streams are refused.
+func (n *JSONRPCNotifier) Close(timeout time.Duration) {
+	n.mu.Lock()
+	n.closeOnce.Do(func() {
+		close(n.closed)
+	})
+	n.mu.Unlock()
+	ended := make(chan struct{})
+	go func() {
+		n.serving.Wait()
+		close(ended)
+	}()
+	select {
+	case <-ended:
+	case <-time.After(timeout):
+		log.Printf("JSONRPCNotifier: streams did not end within %v of Close", timeout)
+	}
+}
+
+// jsonRPCNotifications reads JSON-RPC 2.0 notifications streamed from an RPC server, and dispatches
+// them to subscribers.
+type jsonRPCNotifications struct {
+	body   io.ReadCloser
+	mu     sync.Mutex
+	subs   map[*jsonRPCSubscription]struct{}
+	err    error
+	closed bool
+}
+
+// jsonRPCSubscription receives notifications which match its filter on C. C is closed when the stream ends, or
+// when the subscription is unsubscribed. Notifications are queued until they are read from C, so a subscriber which
+// is not reading does not stop notifications being delivered to other subscribers.
+type jsonRPCSubscription struct {
+	C      chan jsonRPCNotification
+	filter func(n jsonRPCNotification) bool
+	done   chan struct{}
+	parent *jsonRPCNotifications
+
+	mu    sync.Mutex
+	queue []jsonRPCNotification
+	ended bool
+	wake  chan struct{}
+}
+
+// newJSONRPCNotifications connects to the notification stream at this URL. Returns once connected, so
+// notifications sent after this function returns will be received.
+func newJSONRPCNotifications(url string) (*jsonRPCNotifications, error) {
+	res, err := http.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to notification stream: %s", err)
+	}
+	if res.StatusCode != 200 {
+		res.Body.Close()
+		return nil, fmt.Errorf("failed to connect to notification stream: HTTP %d", res.StatusCode)
+	}
+	n := &jsonRPCNotifications{
+		body: res.Body,
+		subs: make(map[*jsonRPCSubscription]struct{}),
+	}
+	go n.read()
+	return n, nil
+}
+
+func (n *jsonRPCNotifications) read() {
+	rd := bufio.NewReader(n.body)
+	var err error
+	for {
+		var line []byte
+		line, err = rd.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		var notification jsonRPCNotification
+		if err = json.Unmarshal(line, &notification); err != nil {
+			err = fmt.Errorf("invalid notification: %s", string(line))
+			break
+		}
+		n.mu.Lock()
+		var subs []*jsonRPCSubscription
+		for sub := range n.subs {
+			if sub.filter(notification) {
+				subs = append(subs, sub)
+			}
+		}
+		n.mu.Unlock()
+		for _, sub := range subs {
+			sub.push(notification)
+		}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		err = fmt.Errorf("notification stream closed")
+	}
+	n.err = err
+	for sub := range n.subs {
+		sub.end()
+	}
+	n.subs = nil
+}
+
+// Subscribe to notifications which match the filter. The subscription must be unsubscribed when it is no longer needed.
+func (n *jsonRPCNotifications) Subscribe(filter func(n jsonRPCNotification) bool) *jsonRPCSubscription {
+	sub := &jsonRPCSubscription{
+		C:      make(chan jsonRPCNotification),
+		filter: filter,
+		done:   make(chan struct{}),
+		parent: n,
+		wake:   make(chan struct{}, 1),
+	}
+	go sub.deliver()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.subs == nil {
+		// the stream has already ended
+		sub.end()
+		return sub
+	}
+	n.subs[sub] = struct{}{}
+	return sub
+}
+
+// Err returns why the stream ended, or nil if it has not ended.
+func (n *jsonRPCNotifications) Err() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.err
+}
+
+// Close the stream. All subscriptions are closed.
+func (n *jsonRPCNotifications) Close() {
+	n.mu.Lock()
+	n.closed = true
+	n.mu.Unlock()
+	n.body.Close()
+}
+
+func (s *jsonRPCSubscription) Unsubscribe() {
+	s.parent.mu.Lock()
+	defer s.parent.mu.Unlock()
+	if _, ok := s.parent.subs[s]; ok {
+		delete(s.parent.subs, s)
+		close(s.done)
+	}
+}
+
+// push queues the notification for delivery on C. Never blocks.
+func (s *jsonRPCSubscription) push(n jsonRPCNotification) {
+	s.mu.Lock()
+	s.queue = append(s.queue, n)
+	s.mu.Unlock()
+	s.signal()
+}
+
+// end closes C once the queued notifications have been delivered.
+func (s *jsonRPCSubscription) end() {
+	s.mu.Lock()
+	s.ended = true
+	s.mu.Unlock()
+	s.signal()
+}
+
+func (s *jsonRPCSubscription) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default: // already woken
+	}
+}
+
+// deliver sends queued notifications on C in order, until the stream ends or the subscription is unsubscribed.
+func (s *jsonRPCSubscription) deliver() {
+	defer close(s.C)
+	for {
+		s.mu.Lock()
+		queue := s.queue
+		s.queue = nil
+		ended := s.ended
+		s.mu.Unlock()
+		if len(queue) == 0 {
+			if ended {
+				return
+			}
+			select {
+			case <-s.wake:
+			case <-s.done:
+				return
+			}
+			continue
+		}
+		for _, n := range queue {
+			select {
+			case s.C <- n:
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
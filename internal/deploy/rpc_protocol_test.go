@@ -0,0 +1,779 @@
+package deploy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/api/langs"
+	"github.com/matrix-org/complement-crypto/internal/config/timing"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/must"
+)
+
+type testRPCReceiver struct{}
+
+type testRPCEcho struct {
+	Text string `json:"text"`
+}
+
+func (r *testRPCReceiver) Echo(input testRPCEcho, output *testRPCEcho) error {
+	output.Text = input.Text
+	return nil
+}
+
+func (r *testRPCReceiver) Fail(input RPCVoid, output *RPCVoid) error {
+	return fmt.Errorf("something went wrong")
+}
+
+// not served, as it does not meet the form
+func (r *testRPCReceiver) NotAMethod(input string) string {
+	return input
+}
+
+// canonicalJSON returns the JSON with sorted keys and no whitespace, so JSON can be compared as strings.
+func canonicalJSON(t *testing.T, in []byte) string {
+	t.Helper()
+	var v interface{}
+	must.NotError(t, "invalid JSON: "+string(in), json.Unmarshal(in, &v))
+	out, err := json.Marshal(v)
+	must.NotError(t, "failed to marshal JSON", err)
+	return string(out)
+}
+
+// Test the wire format of the JSON-RPC 2.0 transport, so servers in other languages can be
+// written against it.
+func TestJSONRPCWireFormat(t *testing.T) {
+	srv := httptest.NewServer(NewJSONRPCHandler(&testRPCReceiver{}))
+	defer srv.Close()
+	testCases := []struct {
+		name string
+		req  string
+		res  string
+		// error messages for invalid requests are not part of the protocol
+		ignoreMessage bool
+	}{
+		{
+			name: "success",
+			req:  `{"jsonrpc":"2.0","id":1,"method":"Echo","params":{"text":"hello"}}`,
+			res:  `{"jsonrpc":"2.0","id":1,"result":{"text":"hello"}}`,
+		},
+		{
+			name: "string ID",
+			req:  `{"jsonrpc":"2.0","id":"abc","method":"Echo","params":{"text":"hello"}}`,
+			res:  `{"jsonrpc":"2.0","id":"abc","result":{"text":"hello"}}`,
+		},
+		{
+			name: "method error",
+			req:  `{"jsonrpc":"2.0","id":2,"method":"Fail","params":{}}`,
+			res:  `{"jsonrpc":"2.0","id":2,"error":{"code":-32000,"message":"something went wrong"}}`,
+		},
+		{
+			name: "unknown method",
+			req:  `{"jsonrpc":"2.0","id":3,"method":"NotAMethod","params":{}}`,
+			res:  `{"jsonrpc":"2.0","id":3,"error":{"code":-32601,"message":"unknown method NotAMethod"}}`,
+		},
+		{
+			name: "unknown params",
+			req:  `{"jsonrpc":"2.0","id":4,"method":"Echo","params":{"txt":"hello"}}`,
+			res:  `{"jsonrpc":"2.0","id":4,"error":{"code":-32602}}`,
+
+			ignoreMessage: true,
+		},
+		{
+			name: "params not an object",
+			req:  `{"jsonrpc":"2.0","id":5,"method":"Echo","params":"hello"}`,
+			res:  `{"jsonrpc":"2.0","id":5,"error":{"code":-32602}}`,
+
+			ignoreMessage: true,
+		},
+		{
+			name: "wrong version",
+			req:  `{"jsonrpc":"1.0","id":6,"method":"Echo","params":{}}`,
+			res:  `{"jsonrpc":"2.0","id":6,"error":{"code":-32600}}`,
+
+			ignoreMessage: true,
+		},
+		{
+			name: "parse error",
+			req:  `{not json`,
+			res:  `{"jsonrpc":"2.0","id":null,"error":{"code":-32700}}`,
+
+			ignoreMessage: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := http.Post(srv.URL, "application/json", bytes.NewBufferString(tc.req))
+			must.NotError(t, "failed to POST", err)
+			defer res.Body.Close()
+			must.Equal(t, res.StatusCode, 200, "HTTP status")
+			must.Equal(t, res.Header.Get("Content-Type"), "application/json", "Content-Type")
+			body, err := io.ReadAll(res.Body)
+			must.NotError(t, "failed to read body", err)
+			if tc.ignoreMessage {
+				var v map[string]interface{}
+				must.NotError(t, "invalid JSON: "+string(body), json.Unmarshal(body, &v))
+				if e, ok := v["error"].(map[string]interface{}); ok {
+					delete(e, "message")
+				}
+				body, _ = json.Marshal(v)
+			}
+			must.Equal(t, canonicalJSON(t, body), canonicalJSON(t, []byte(tc.res)), "response")
+		})
+	}
+}
+
+// Test that the client sends JSON-RPC 2.0 requests and decodes results and errors.
+func TestJSONRPCClient(t *testing.T) {
+	var gotReq []byte
+	h := NewJSONRPCHandler(&testRPCReceiver{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotReq, _ = io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(gotReq))
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	client := newJSONRPCClient(srv.URL)
+	defer client.Close()
+
+	var output testRPCEcho
+	must.NotError(t, "Echo failed", client.Call("Echo", testRPCEcho{Text: "hello"}, &output))
+	must.Equal(t, canonicalJSON(t, gotReq), canonicalJSON(t, []byte(`{"jsonrpc":"2.0","id":1,"method":"Echo","params":{"text":"hello"}}`)), "request")
+	must.Equal(t, output.Text, "hello", "result")
+
+	err := client.Call("Fail", RPCVoid{}, nil)
+	must.Equal(t, canonicalJSON(t, gotReq), canonicalJSON(t, []byte(`{"jsonrpc":"2.0","id":2,"method":"Fail","params":{}}`)), "request")
+	rpcErr, ok := err.(*RPCError)
+	if !ok {
+		t.Fatalf("Fail returned %T, want *RPCError", err)
+	}
+	must.Equal(t, rpcErr.Code, RPCErrCodeServerError, "error code")
+	must.Equal(t, rpcErr.Message, "something went wrong", "error message")
+}
+
+// The path to RPC.md, relative to this package.
+const rpcDocPath = "../../RPC.md"
+
+var (
+	rpcDocTypeHeading = regexp.MustCompile("^`(\\w+)`:$")
+	rpcDocTypeField   = regexp.MustCompile(`^\s*"(\w+)":\s*([^,(]*[^,(\s])`)
+	rpcDocTypeExtends = regexp.MustCompile("^`(\\w+)` is an `(\\w+)` with an extra `(\\w+)` field")
+	rpcDocParens      = regexp.MustCompile(`\([^)]*\)`)
+	rpcDocCode        = regexp.MustCompile("`([^`]+)`")
+)
+
+// rpcDoc is the methods and notifications documented in RPC.md, along with the fields of their params and results.
+type rpcDoc struct {
+	types         map[string][]string // type name => fields
+	fieldTypes    map[string]string   // field => JSON type of its example value
+	methods       map[string][2][]string
+	notifications map[string][]string
+}
+
+// parseRPCDoc parses the types and the method and notification tables in RPC.md, so the tests can check the
+// implementation against the documentation rather than a copy of it.
+func parseRPCDoc(t *testing.T) rpcDoc {
+	t.Helper()
+	f, err := os.Open(rpcDocPath)
+	must.NotError(t, "failed to open RPC.md", err)
+	defer f.Close()
+	doc := rpcDoc{
+		types:         make(map[string][]string),
+		fieldTypes:    make(map[string]string),
+		methods:       make(map[string][2][]string),
+		notifications: make(map[string][]string),
+	}
+	var section, typeName string
+	inCodeBlock := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "### "):
+			section = strings.TrimPrefix(line, "### ")
+		case strings.HasPrefix(line, "```"):
+			inCodeBlock = !inCodeBlock
+			if !inCodeBlock {
+				typeName = ""
+			}
+		case inCodeBlock:
+			m := rpcDocTypeField.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			if typeName != "" {
+				doc.types[typeName] = append(doc.types[typeName], m[1])
+			}
+			fieldType := rpcDocValueType(m[2])
+			if existing, ok := doc.fieldTypes[m[1]]; ok && existing != fieldType {
+				t.Fatalf("RPC.md: field %s has examples of type %s and %s", m[1], existing, fieldType)
+			}
+			doc.fieldTypes[m[1]] = fieldType
+		case rpcDocTypeHeading.MatchString(line):
+			typeName = rpcDocTypeHeading.FindStringSubmatch(line)[1]
+		case rpcDocTypeExtends.MatchString(line):
+			m := rpcDocTypeExtends.FindStringSubmatch(line)
+			doc.types[m[1]] = append(append([]string{}, doc.types[m[2]]...), m[3])
+		case strings.HasPrefix(line, "| `"):
+			cells := strings.Split(strings.Trim(line, "| "), " | ")
+			name := strings.Trim(cells[0], "`")
+			switch section {
+			case "Methods":
+				must.Equal(t, len(cells), 3, "cells in method row "+name)
+				doc.methods[name] = [2][]string{doc.fields(t, cells[1]), doc.fields(t, cells[2])}
+			case "Notifications":
+				must.Equal(t, len(cells), 3, "cells in notification row "+name)
+				doc.notifications[name] = doc.fields(t, cells[1])
+			}
+		}
+	}
+	must.NotError(t, "failed to read RPC.md", scanner.Err())
+	return doc
+}
+
+// fields returns the field names described by a table cell e.g "`handle`, plus `ClientCreationOpts` fields" or
+// "`Event`". Values of fields are ignored: they are either in brackets, or after a colon at the end of the cell.
+func (doc rpcDoc) fields(t *testing.T, cell string) []string {
+	t.Helper()
+	if cell == "`{}`" {
+		return nil
+	}
+	cell, _, _ = strings.Cut(rpcDocParens.ReplaceAllString(cell, ""), ":")
+	var fields []string
+	for _, part := range strings.Split(cell, ",") {
+		for _, m := range rpcDocCode.FindAllStringSubmatch(part, -1) {
+			if typeFields, ok := doc.types[m[1]]; ok {
+				fields = append(fields, typeFields...)
+			} else {
+				fields = append(fields, m[1])
+			}
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// rpcDocValueType returns the JSON type of an example value in RPC.md. Values which are the name of a type
+// e.g `Event` are objects.
+func rpcDocValueType(val string) string {
+	if strings.HasPrefix(val, "[") {
+		return "array"
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(val), &v); err != nil {
+		return "object"
+	}
+	switch v.(type) {
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// jsonType returns the JSON type of values of this type. Pointers have the type of what they point to, as null
+// is documented alongside the example value.
+func jsonType(typ reflect.Type) string {
+	switch typ.Kind() {
+	case reflect.Pointer:
+		return jsonType(typ.Elem())
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// jsonFields returns the fields which a value of this type has when marshalled to JSON, and their JSON types.
+func jsonFields(t *testing.T, typ reflect.Type) map[string]string {
+	t.Helper()
+	fields := make(map[string]string)
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for embeddedName, embeddedType := range jsonFields(t, f.Type) {
+				fields[embeddedName] = embeddedType
+			}
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = jsonType(f.Type)
+	}
+	return fields
+}
+
+// checkFields checks that a value of this type has exactly the documented fields, and that each field has the
+// JSON type of its example value in RPC.md.
+func (doc rpcDoc) checkFields(t *testing.T, typ reflect.Type, documented []string, msg string) {
+	t.Helper()
+	fieldTypes := jsonFields(t, typ)
+	var fields []string
+	for field := range fieldTypes {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	must.Equal(t, fmt.Sprint(fields), fmt.Sprint(documented), msg)
+	for _, field := range fields {
+		docType, ok := doc.fieldTypes[field]
+		if !ok {
+			t.Fatalf("%s: field %s has no example value in RPC.md", msg, field)
+		}
+		must.Equal(t, fieldTypes[field], docType, msg+": JSON type of "+field)
+	}
+}
+
+// Test that RPCServer serves exactly the methods in RPC.md, and that their params and results have
+// exactly the documented fields, of the same JSON types as their example values.
+func TestRPCServerConformsToSchema(t *testing.T) {
+	doc := parseRPCDoc(t)
+	h := NewJSONRPCHandler(&RPCServer{}).(*jsonRPCHandler)
+	var served []string
+	for name := range h.methods {
+		served = append(served, name)
+	}
+	var documented []string
+	for name := range doc.methods {
+		documented = append(documented, name)
+	}
+	sort.Strings(served)
+	sort.Strings(documented)
+	must.Equal(t, fmt.Sprint(served), fmt.Sprint(documented), "served methods")
+
+	for name, fields := range doc.methods {
+		method := h.methods[name]
+		doc.checkFields(t, method.argType, fields[0], name+": params")
+		doc.checkFields(t, method.replyType, fields[1], name+": result")
+	}
+	for name, schema := range rpcServerNotificationSchema {
+		fields, ok := doc.notifications[name]
+		if !ok {
+			t.Fatalf("notification %s is not documented", name)
+		}
+		doc.checkFields(t, reflect.TypeOf(schema.val).Elem(), fields, name+": params")
+	}
+	must.Equal(t, len(doc.notifications), len(rpcServerNotificationSchema), "number of notifications")
+}
+
+// An example of the params of each notification sent by RPCServer. TestRPCServerConformsToSchema checks these
+// against RPC.md.
+var rpcServerNotificationSchema = map[string]struct {
+	params string
+	val    interface{}
+}{
+	"ClientState": {`{"handle":"1","state":"syncing"}`, &RPCClientState{}},
+	"WaiterEvent": {`{"handle":"1","waiter_id":1,"event":{"event_id":"$a","text":"hello","sender":"@alice:hs1","target":"","membership":"","failed_to_decrypt":false}}`, &RPCWaiterEvent{}},
+	"WaiterDone":  {`{"handle":"1","waiter_id":1,"error":"timed out after 5s"}`, &RPCWaiterDone{}},
+}
+
+// Test that notifications are streamed as newline-delimited JSON-RPC 2.0 notifications, and are dispatched
+// to matching subscribers in order.
+func TestJSONRPCNotifications(t *testing.T) {
+	notifier := NewJSONRPCNotifier()
+	srv := httptest.NewServer(notifier)
+	defer srv.Close()
+
+	// check the wire format
+	res, err := http.Get(srv.URL)
+	must.NotError(t, "failed to GET", err)
+	must.Equal(t, res.StatusCode, 200, "HTTP status")
+	must.Equal(t, res.Header.Get("Content-Type"), "application/x-ndjson", "Content-Type")
+	var names []string
+	for name := range rpcServerNotificationSchema {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// the test can't fail from another goroutine, so errors are sent back
+	notifyErrs := make(chan error, 1)
+	go func() {
+		defer close(notifyErrs)
+		for _, name := range names {
+			schema := rpcServerNotificationSchema[name]
+			if err := json.Unmarshal([]byte(schema.params), schema.val); err != nil {
+				notifyErrs <- fmt.Errorf("failed to unmarshal %s: %w", name, err)
+				return
+			}
+			if err := notifier.Notify(name, schema.val); err != nil {
+				notifyErrs <- fmt.Errorf("failed to notify %s: %w", name, err)
+				return
+			}
+		}
+	}()
+	rd := bufio.NewReader(res.Body)
+	for _, name := range names {
+		line, err := rd.ReadBytes('\n')
+		if err != nil {
+			must.NotError(t, "notifier", <-notifyErrs)
+		}
+		must.NotError(t, "failed to read notification", err)
+		want := fmt.Sprintf(`{"jsonrpc":"2.0","method":"%s","params":%s}`, name, rpcServerNotificationSchema[name].params)
+		must.Equal(t, canonicalJSON(t, line), canonicalJSON(t, []byte(want)), name)
+	}
+	must.NotError(t, "notifier", <-notifyErrs)
+	res.Body.Close()
+
+	// check subscriptions
+	notifications, err := newJSONRPCNotifications(srv.URL)
+	must.NotError(t, "failed to connect", err)
+	sub := notifications.Subscribe(func(n jsonRPCNotification) bool {
+		return n.Method == "Echo"
+	})
+	defer sub.Unsubscribe()
+	unread := notifications.Subscribe(func(n jsonRPCNotification) bool {
+		return true
+	})
+	unread.Unsubscribe()
+	for _, text := range []string{"a", "b"} {
+		must.NotError(t, "failed to notify", notifier.Notify("Other", RPCVoid{}))
+		must.NotError(t, "failed to notify", notifier.Notify("Echo", testRPCEcho{Text: text}))
+	}
+	for _, text := range []string{"a", "b"} {
+		n := <-sub.C
+		must.Equal(t, n.Method, "Echo", "method")
+		must.Equal(t, canonicalJSON(t, n.Params), canonicalJSON(t, []byte(fmt.Sprintf(`{"text":"%s"}`, text))), "params")
+	}
+	notifications.Close()
+	if _, ok := <-sub.C; ok {
+		t.Fatalf("subscription was not closed when the stream was closed")
+	}
+	must.NotEqual(t, notifications.Err(), nil, "stream error")
+}
+
+// Test that Notify never blocks on a client which is not reading notifications, and disconnects it instead.
+func TestJSONRPCNotifierDisconnectsSlowStreams(t *testing.T) {
+	notifier := NewJSONRPCNotifier()
+	// a stream which is never read from, as if the HTTP connection had stalled
+	stream := &jsonRPCStream{
+		lines:  make(chan []byte, jsonRPCStreamBufferSize),
+		kicked: make(chan struct{}),
+	}
+	notifier.streams[stream] = struct{}{}
+	notified := make(chan struct{})
+	go func() {
+		defer close(notified)
+		for i := 0; i <= jsonRPCStreamBufferSize; i++ {
+			notifier.Notify("Echo", testRPCEcho{Text: fmt.Sprint(i)})
+		}
+	}()
+	select {
+	case <-notified:
+	case <-time.After(timing.Get().Scale(5 * time.Second)):
+		t.Fatalf("Notify blocked on a stream which is not reading")
+	}
+	select {
+	case <-stream.kicked:
+	default:
+		t.Fatalf("slow stream was not disconnected")
+	}
+	must.Equal(t, len(notifier.streams), 0, "number of streams")
+}
+
+// Test that a subscriber which is not reading does not stop other subscribers receiving notifications.
+func TestJSONRPCNotificationsSlowSubscriber(t *testing.T) {
+	notifier := NewJSONRPCNotifier()
+	srv := httptest.NewServer(notifier)
+	defer srv.Close()
+	notifications, err := newJSONRPCNotifications(srv.URL)
+	must.NotError(t, "failed to connect", err)
+	defer notifications.Close()
+	all := func(n jsonRPCNotification) bool { return true }
+	slow := notifications.Subscribe(all)
+	defer slow.Unsubscribe()
+	fast := notifications.Subscribe(all)
+	defer fast.Unsubscribe()
+
+	const count = 500
+	for i := 0; i < count; i++ {
+		must.NotError(t, "failed to notify", notifier.Notify("Echo", testRPCEcho{Text: fmt.Sprint(i)}))
+	}
+	timeout := time.After(timing.Get().Scale(5 * time.Second))
+	for i := 0; i < count; i++ {
+		select {
+		case n := <-fast.C:
+			must.Equal(t, canonicalJSON(t, n.Params), canonicalJSON(t, []byte(fmt.Sprintf(`{"text":"%d"}`, i))), "params")
+		case <-timeout:
+			t.Fatalf("received %d of %d notifications whilst another subscriber was not reading", i, count)
+		}
+	}
+	// the slow subscriber still gets everything, in order
+	for i := 0; i < count; i++ {
+		n := <-slow.C
+		must.Equal(t, canonicalJSON(t, n.Params), canonicalJSON(t, []byte(fmt.Sprintf(`{"text":"%d"}`, i))), "slow params")
+	}
+}
+
+// Test that Close ends every stream after sending the notifications which were sent before it, and refuses new
+// streams, so a server which is exiting does not lose notifications.
+func TestJSONRPCNotifierClose(t *testing.T) {
+	notifier := NewJSONRPCNotifier()
+	srv := httptest.NewServer(notifier)
+	defer srv.Close()
+	res, err := http.Get(srv.URL)
+	must.NotError(t, "failed to GET", err)
+	defer res.Body.Close()
+	const count = 100
+	for i := 0; i < count; i++ {
+		must.NotError(t, "failed to notify", notifier.Notify("Echo", testRPCEcho{Text: fmt.Sprint(i)}))
+	}
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		notifier.Close(timing.Get().Scale(5 * time.Second))
+	}()
+	rd := bufio.NewReader(res.Body)
+	for i := 0; i < count; i++ {
+		line, err := rd.ReadBytes('\n')
+		must.NotError(t, fmt.Sprintf("failed to read notification %d", i), err)
+		want := fmt.Sprintf(`{"jsonrpc":"2.0","method":"Echo","params":{"text":"%d"}}`, i)
+		must.Equal(t, canonicalJSON(t, line), canonicalJSON(t, []byte(want)), "notification")
+	}
+	if _, err := rd.ReadBytes('\n'); err != io.EOF {
+		t.Fatalf("stream did not end after Close: %v", err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(timing.Get().Scale(5 * time.Second)):
+		t.Fatalf("Close did not return after the stream ended")
+	}
+	res, err = http.Get(srv.URL)
+	must.NotError(t, "failed to GET", err)
+	res.Body.Close()
+	must.Equal(t, res.StatusCode, http.StatusServiceUnavailable, "HTTP status after Close")
+}
+
+// Test that RPCServer methods fail for clients which do not exist, rather than using another client.
+func TestRPCServerUnknownHandle(t *testing.T) {
+	srv := httptest.NewServer(NewJSONRPCHandler(&RPCServer{
+		clients:        make(map[string]*rpcServerClient),
+		langContextIDs: make(map[api.ClientTypeLang]string),
+		clientsMu:      &sync.Mutex{},
+		lastCmdRecvMu:  &sync.Mutex{},
+	}))
+	defer srv.Close()
+	client := newJSONRPCClient(srv.URL)
+	defer client.Close()
+	var output RPCUserID
+	err := client.Call("UserID", RPCHandle{Handle: "1"}, &output)
+	rpcErr, ok := err.(*RPCError)
+	if !ok {
+		t.Fatalf("UserID returned %T, want *RPCError", err)
+	}
+	must.Equal(t, rpcErr.Code, RPCErrCodeServerError, "error code")
+	must.Equal(t, rpcErr.Message, "RPC: no client with handle '1'", "error message")
+}
+
+// Test that the inactivity watchdog does not kill processes which were suspended, as the test process could not
+// send commands whilst they were suspended.
+func TestRPCServerInactivityIgnoresSuspension(t *testing.T) {
+	start := time.Now()
+	srv := &RPCServer{
+		inactivityThreshold: 30 * time.Second,
+		notifier:            NewJSONRPCNotifier(),
+		lastCmdRecv:         start,
+		lastCmdRecvMu:       &sync.Mutex{},
+	}
+	must.Equal(t, srv.isInactive(start.Add(10*time.Second), keepAliveInterval), false, "active")
+	must.Equal(t, srv.isInactive(start.Add(31*time.Second), keepAliveInterval), true, "inactive")
+	// resumed after being suspended for a minute
+	resumedAt := start.Add(90 * time.Second)
+	must.Equal(t, srv.isInactive(resumedAt, time.Minute), false, "resumed")
+	must.Equal(t, srv.isInactive(resumedAt.Add(time.Second), keepAliveInterval), false, "after resumed")
+	must.Equal(t, srv.isInactive(resumedAt.Add(31*time.Second), keepAliveInterval), true, "inactive after resumed")
+}
+
+// Test that the inactivity watchdog does not kill processes whilst the test process is connected to the
+// notification stream, as a test which is only waiting for events sends no commands.
+func TestRPCServerInactivityIgnoresConnectedStreams(t *testing.T) {
+	start := time.Now()
+	srv := &RPCServer{
+		inactivityThreshold: 30 * time.Second,
+		notifier:            NewJSONRPCNotifier(),
+		lastCmdRecv:         start,
+		lastCmdRecvMu:       &sync.Mutex{},
+	}
+	stream := &jsonRPCStream{
+		lines:  make(chan []byte, jsonRPCStreamBufferSize),
+		kicked: make(chan struct{}),
+	}
+	srv.notifier.streams[stream] = struct{}{}
+	must.Equal(t, srv.isInactive(start.Add(time.Minute), keepAliveInterval), false, "connected")
+	// the test process exits
+	delete(srv.notifier.streams, stream)
+	disconnectedAt := start.Add(time.Minute + keepAliveInterval)
+	must.Equal(t, srv.isInactive(disconnectedAt, keepAliveInterval), false, "just disconnected")
+	must.Equal(t, srv.isInactive(disconnectedAt.Add(31*time.Second), keepAliveInterval), true, "inactive after disconnecting")
+}
+
+const testRPCLang api.ClientTypeLang = "test"
+
+// testRPCBindings records which logs were written.
+type testRPCBindings struct {
+	mu          sync.Mutex
+	postTestRun []string
+}
+
+func (b *testRPCBindings) PreTestRun(contextID string) {}
+func (b *testRPCBindings) PostTestRun(contextID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.postTestRun = append(b.postTestRun, contextID)
+}
+func (b *testRPCBindings) MustCreateClient(t ct.TestLike, cfg api.ClientCreationOpts) api.Client {
+	ct.Fatalf(t, "testRPCBindings: MustCreateClient is not supported")
+	return nil
+}
+
+// testRPCClient records whether it was closed and whether it is syncing. Calling any other method panics.
+type testRPCClient struct {
+	api.Client
+	closed  bool
+	syncing atomic.Int32
+}
+
+func (c *testRPCClient) Close(t ct.TestLike) {
+	c.closed = true
+}
+
+func (c *testRPCClient) MustStartSyncing(t ct.TestLike) (stopSyncing func()) {
+	stopSyncing, _ = c.StartSyncing(t)
+	return stopSyncing
+}
+
+func (c *testRPCClient) StartSyncing(t ct.TestLike) (stopSyncing func(), err error) {
+	c.syncing.Add(1)
+	return func() { c.syncing.Add(-1) }, nil
+}
+
+// Test that Shutdown, which the RPC server calls on SIGTERM, closes every client, tells the test process that
+// they are closed, and writes the logs.
+func TestRPCServerShutdown(t *testing.T) {
+	bindings := &testRPCBindings{}
+	langs.SetLanguageBinding(testRPCLang, bindings)
+	srv := &RPCServer{
+		clients:        make(map[string]*rpcServerClient),
+		langContextIDs: map[api.ClientTypeLang]string{testRPCLang: "1alice"},
+		clientsMu:      &sync.Mutex{},
+		notifier:       NewJSONRPCNotifier(),
+		lastCmdRecvMu:  &sync.Mutex{},
+	}
+	stream := &jsonRPCStream{
+		lines:  make(chan []byte, jsonRPCStreamBufferSize),
+		kicked: make(chan struct{}),
+	}
+	srv.notifier.streams[stream] = struct{}{}
+	clients := []*testRPCClient{{}, {}}
+	for i, c := range clients {
+		srv.clients[fmt.Sprint(i+1)] = &rpcServerClient{
+			client:    c,
+			lang:      testRPCLang,
+			waiters:   make(map[int]*RPCServerWaiter),
+			waitersMu: &sync.Mutex{},
+		}
+	}
+
+	srv.Shutdown()
+
+	for i, c := range clients {
+		must.Equal(t, c.closed, true, fmt.Sprintf("client %d closed", i+1))
+	}
+	must.Equal(t, len(srv.clients), 0, "number of clients")
+	must.Equal(t, len(srv.langContextIDs), 0, "number of languages")
+	var closed []string
+	for len(stream.lines) > 0 {
+		var n struct {
+			Method string         `json:"method"`
+			Params RPCClientState `json:"params"`
+		}
+		must.NotError(t, "failed to unmarshal notification", json.Unmarshal(<-stream.lines, &n))
+		must.Equal(t, n.Method, "ClientState", "method")
+		must.Equal(t, n.Params.State, RPCClientStateClosed, "state")
+		closed = append(closed, n.Params.Handle)
+	}
+	must.Equal(t, len(closed), 2, "number of closed notifications")
+	must.Equal(t, closed[0], "1", "first closed handle")
+	must.Equal(t, closed[1], "2", "second closed handle")
+	bindings.mu.Lock()
+	defer bindings.mu.Unlock()
+	must.Equal(t, len(bindings.postTestRun), 1, "number of times logs were written")
+	must.Equal(t, bindings.postTestRun[0], "1alice", "context ID of the logs")
+}
+
+// Test that Close stops the client syncing and stops its waiters, and that syncing can be started and stopped
+// concurrently for the same client.
+func TestRPCServerCloseStopsSyncingAndWaiters(t *testing.T) {
+	bindings := &testRPCBindings{}
+	langs.SetLanguageBinding(testRPCLang, bindings)
+	srv := &RPCServer{
+		clients:        make(map[string]*rpcServerClient),
+		langContextIDs: map[api.ClientTypeLang]string{testRPCLang: "1alice"},
+		clientsMu:      &sync.Mutex{},
+		notifier:       NewJSONRPCNotifier(),
+		lastCmdRecvMu:  &sync.Mutex{},
+	}
+	client := &testRPCClient{}
+	waiter := &RPCServerWaiter{started: true}
+	srv.clients["1"] = &rpcServerClient{
+		client:    client,
+		lang:      testRPCLang,
+		waiters:   map[int]*RPCServerWaiter{1: waiter},
+		waitersMu: &sync.Mutex{},
+	}
+	input := RPCTestName{Handle: "1", TestName: t.Name()}
+	must.NotError(t, "StartSyncing", srv.StartSyncing(input, &RPCVoid{}))
+	var wg sync.WaitGroup
+	var stopped atomic.Int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.StopSyncing(input, &RPCVoid{}); err == nil {
+				stopped.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	must.Equal(t, stopped.Load(), int32(1), "number of successful StopSyncing calls")
+	must.Equal(t, client.syncing.Load(), int32(0), "number of sync loops after StopSyncing")
+	must.NotError(t, "MustStartSyncing", srv.MustStartSyncing(input, &RPCVoid{}))
+
+	must.NotError(t, "Close", srv.Close(input, &RPCVoid{}))
+	must.Equal(t, client.closed, true, "closed")
+	must.Equal(t, client.syncing.Load(), int32(0), "number of sync loops after Close")
+	must.Equal(t, waiter.stopped, true, "waiter stopped")
+}
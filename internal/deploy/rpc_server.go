@@ -3,39 +3,54 @@ package deploy
 import (
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/matrix-org/complement-crypto/internal/api"
 	"github.com/matrix-org/complement-crypto/internal/api/langs"
+	"github.com/matrix-org/complement-crypto/internal/config/timing"
 )
 
-const InactivityThreshold = 30 * time.Second
-
-// RPCServer exposes the api.Client interface over the wire, consumed via net/rpc.
-// Args and return params must be encodable with encoding/gob.
-// All functions on this struct must meet the form:
+// RPCServer exposes the api.Client interface over the wire via JSON-RPC 2.0, see NewJSONRPCHandler.
+// It is the Go implementation of the RPC protocol described in RPC.md. Args and replies must be JSON
+// objects. All functions on this struct must meet the form:
 //
 //	func (t *T) MethodName(argType T1, replyType *T2) error
 type RPCServer struct {
-	contextID     string // test|user|device
-	bindings      api.LanguageBindings
-	activeClient  api.Client
-	stopSyncing   func()
-	waiters       map[int]*RPCServerWaiter
-	nextWaiterID  int
-	waitersMu     *sync.Mutex
-	lastCmdRecv   time.Time
-	lastCmdRecvMu *sync.Mutex
+	inactivityThreshold time.Duration
+	clients             map[string]*rpcServerClient // handle => client
+	nextHandle          int
+	langContextIDs      map[api.ClientTypeLang]string // lang => context ID used for the logs of this language
+	clientsMu           *sync.Mutex
+	notifier            *JSONRPCNotifier
+	lastCmdRecv         time.Time
+	lastCmdRecvMu       *sync.Mutex
+}
+
+// rpcServerClient is a single client hosted by the RPC server.
+type rpcServerClient struct {
+	client api.Client
+	lang   api.ClientTypeLang
+	// guards stopSyncing, as calls for the same client can be served concurrently
+	syncMu       sync.Mutex
+	stopSyncing  func()
+	waiters      map[int]*RPCServerWaiter
+	nextWaiterID int
+	waitersMu    *sync.Mutex
 }
 
 func NewRPCServer() *RPCServer {
 	srv := &RPCServer{
-		waiters:       make(map[int]*RPCServerWaiter),
-		waitersMu:     &sync.Mutex{},
-		lastCmdRecv:   time.Now(),
-		lastCmdRecvMu: &sync.Mutex{},
+		inactivityThreshold: timing.Get().RPCInactivityThreshold,
+		clients:             make(map[string]*rpcServerClient),
+		langContextIDs:      make(map[api.ClientTypeLang]string),
+		clientsMu:           &sync.Mutex{},
+		notifier:            NewJSONRPCNotifier(),
+		lastCmdRecv:         time.Now(),
+		lastCmdRecvMu:       &sync.Mutex{},
 	}
 	go srv.checkKeepAlive()
 	return srv
@@ -43,23 +58,60 @@ func NewRPCServer() *RPCServer {
 
 type RPCClientCreationOpts struct {
 	api.ClientCreationOpts
-	Lang      api.ClientTypeLang // need to know the type for pulling out the corret bindings
-	ContextID string
+	Lang      api.ClientTypeLang `json:"lang"` // need to know the type for pulling out the corret bindings
+	ContextID string             `json:"context_id"`
+}
+
+// RPCHandle identifies a client created by MustCreateClient. An RPC server can host many clients.
+type RPCHandle struct {
+	Handle string `json:"handle"`
+}
+
+// RPCTestName is the params for methods which only need the client and the name of the running test.
+type RPCTestName struct {
+	Handle   string `json:"handle"`
+	TestName string `json:"test_name"`
 }
 
 // When the RPC server is run locally, we want to make sure we don't persist as an orphan process
 // if the test suite crashes. We do this by checking that we have seen an RPC command within
-// InactivityThreshold duration.
+// the RPCInactivityThreshold duration of the timing profile, or that the test process is connected to the
+// notification stream. Waiters push events rather than being polled, so a test process which is only waiting
+// on this server sends no commands, but it stays connected until it exits.
 func (s *RPCServer) checkKeepAlive() {
-	ticker := time.NewTicker(time.Second)
+	ticker := time.NewTicker(keepAliveInterval)
+	lastCheck := time.Now()
 	for range ticker.C {
-		s.lastCmdRecvMu.Lock()
-		if time.Since(s.lastCmdRecv) > InactivityThreshold {
-			fmt.Printf("terminating RPC server due to inactivity (%v)\n", InactivityThreshold)
+		now := time.Now()
+		if s.isInactive(now, now.Sub(lastCheck)) {
+			fmt.Printf("terminating RPC server due to inactivity (%v)\n", s.inactivityThreshold)
 			os.Exit(0)
 		}
-		s.lastCmdRecvMu.Unlock()
+		lastCheck = now
+	}
+}
+
+// How often the inactivity watchdog runs.
+const keepAliveInterval = time.Second
+
+// isInactive returns true if no RPC command has been seen within the inactivity threshold, and no notification
+// stream is connected. sinceLastCheck is how long it has been since the watchdog last ran. If this is much longer
+// than keepAliveInterval, the process was suspended e.g by SIGSTOP, so the test process could not send commands.
+// In this case, we treat the process as having just seen a command, so it is not killed as soon as it is resumed.
+func (s *RPCServer) isInactive(now time.Time, sinceLastCheck time.Duration) bool {
+	s.lastCmdRecvMu.Lock()
+	defer s.lastCmdRecvMu.Unlock()
+	if sinceLastCheck > 5*keepAliveInterval {
+		fmt.Printf("RPC server was suspended for %v, resetting inactivity timer\n", sinceLastCheck)
+		s.lastCmdRecv = now
+		return false
 	}
+	if s.notifier.connected() {
+		// the test process is still running, so count this as activity
+		s.lastCmdRecv = now
+		return false
+	}
+	return now.Sub(s.lastCmdRecv) > s.inactivityThreshold
 }
 
 func (s *RPCServer) keepAlive() {
@@ -68,98 +120,283 @@ func (s *RPCServer) keepAlive() {
 	s.lastCmdRecv = time.Now()
 }
 
-// MustCreateClient creates a given client and returns it to the caller, else returns an error.
-func (s *RPCServer) MustCreateClient(opts RPCClientCreationOpts, void *int) error {
+// client returns the client with this handle, or an error if there is no such client.
+func (s *RPCServer) client(handle string) (*rpcServerClient, error) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	c := s.clients[handle]
+	if c == nil {
+		return nil, fmt.Errorf("RPC: no client with handle '%s'", handle)
+	}
+	return c, nil
+}
+
+// Notifications returns the handler for the stream of notifications to the test process, which is served
+// on GET /notifications.
+func (s *RPCServer) Notifications() http.Handler {
+	return s.notifier
+}
+
+// Client states sent in ClientState notifications.
+const (
+	RPCClientStateSyncing        = "syncing"
+	RPCClientStateStoppedSyncing = "stopped_syncing"
+	RPCClientStateClosed         = "closed"
+)
+
+// RPCClientState is the params of the ClientState notification, which is sent when a client changes state.
+type RPCClientState struct {
+	Handle string `json:"handle"`
+	State  string `json:"state"`
+}
+
+// RPCWaiterEvent is the params of the WaiterEvent notification, which is sent for each event seen by a started waiter.
+type RPCWaiterEvent struct {
+	Handle   string    `json:"handle"`
+	WaiterID int       `json:"waiter_id"`
+	Event    api.Event `json:"event"`
+}
+
+// RPCWaiterDone is the params of the WaiterDone notification, which is sent when a waiter stops seeing events.
+// Error is set if the waiter timed out.
+type RPCWaiterDone struct {
+	Handle   string `json:"handle"`
+	WaiterID int    `json:"waiter_id"`
+	Error    string `json:"error"`
+}
+
+func (s *RPCServer) notifyState(handle, state string) {
+	if err := s.notifier.Notify("ClientState", RPCClientState{Handle: handle, State: state}); err != nil {
+		log.Printf("RPCServer: failed to send ClientState notification: %s", err)
+	}
+}
+
+// Shutdown closes every client, as if the test process had called Close for each of them, then ends the
+// notification streams once the test process has been sent every notification. It is called when the RPC server
+// is asked to terminate gracefully e.g by SIGTERM.
+func (s *RPCServer) Shutdown() {
+	s.clientsMu.Lock()
+	handles := make([]string, 0, len(s.clients))
+	for handle := range s.clients {
+		handles = append(handles, handle)
+	}
+	s.clientsMu.Unlock()
+	sort.Strings(handles)
+	for _, handle := range handles {
+		if err := s.Close(RPCTestName{Handle: handle}, &RPCVoid{}); err != nil {
+			log.Printf("RPCServer: Shutdown: failed to close client %s: %s", handle, err)
+		}
+	}
+	// else the process can exit before the ClientState notifications are sent
+	s.notifier.Close(timing.Get().Scale(5 * time.Second))
+}
+
+// MustCreateClient creates a given client and returns its handle to the caller, else returns an error.
+// Many clients can be created, and they all run in this process.
+func (s *RPCServer) MustCreateClient(opts RPCClientCreationOpts, output *RPCHandle) error {
 	defer s.keepAlive()
 	fmt.Printf("RPCServer: Received MustCreateClient: %+v\n", opts)
-	if s.activeClient != nil {
-		return fmt.Errorf("RPC: MustCreateClient: already have an activeClient")
-	}
 	bindings := langs.GetLanguageBindings(opts.Lang)
 	if bindings == nil {
 		return fmt.Errorf("RPC: MustCreateClient: unknown language bindings %s : did you build the rpc server with the correct -tags?", opts.Lang)
 	}
-	bindings.PreTestRun(opts.ContextID) // prepare logs
-	s.contextID = opts.ContextID
-	s.activeClient = bindings.MustCreateClient(&api.MockT{}, opts.ClientCreationOpts)
-	s.bindings = bindings
+	s.clientsMu.Lock()
+	_, prepared := s.langContextIDs[opts.Lang]
+	if !prepared {
+		// logs are per-process, so only prepare them for the first client in each language
+		s.langContextIDs[opts.Lang] = opts.ContextID
+	}
+	s.clientsMu.Unlock()
+	if !prepared {
+		bindings.PreTestRun(opts.ContextID) // prepare logs
+	}
+	client := bindings.MustCreateClient(&api.MockT{}, opts.ClientCreationOpts)
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	s.nextHandle++
+	output.Handle = fmt.Sprintf("%d", s.nextHandle)
+	s.clients[output.Handle] = &rpcServerClient{
+		client:    client,
+		lang:      opts.Lang,
+		waiters:   make(map[int]*RPCServerWaiter),
+		waitersMu: &sync.Mutex{},
+	}
 	return nil
 }
 
-func (s *RPCServer) Close(testName string, void *int) error {
+func (s *RPCServer) Close(input RPCTestName, void *RPCVoid) error {
 	defer s.keepAlive()
-	s.activeClient.Close(&api.MockT{TestName: testName})
+	c, err := s.client(input.Handle)
+	if err != nil {
+		return err
+	}
+	// the client is going away, so stop its waiters sending events, and stop syncing
+	c.waitersMu.Lock()
+	for _, w := range c.waiters {
+		w.stopped = true
+	}
+	c.waitersMu.Unlock()
+	c.syncMu.Lock()
+	if c.stopSyncing != nil {
+		c.stopSyncing()
+		c.stopSyncing = nil
+	}
+	c.syncMu.Unlock()
+	c.client.Close(&api.MockT{TestName: input.TestName})
+	s.notifyState(input.Handle, RPCClientStateClosed)
+	s.clientsMu.Lock()
+	delete(s.clients, input.Handle)
+	lastInLang := true
+	for _, other := range s.clients {
+		if other.lang == c.lang {
+			lastInLang = false
+		}
+	}
+	contextID := s.langContextIDs[c.lang]
+	if lastInLang {
+		delete(s.langContextIDs, c.lang)
+	}
+	s.clientsMu.Unlock()
 	// write logs
-	s.bindings.PostTestRun(s.contextID)
+	if lastInLang {
+		langs.GetLanguageBindings(c.lang).PostTestRun(contextID)
+	}
 	return nil
 }
 
-func (s *RPCServer) DeletePersistentStorage(testName string, void *int) error {
+func (s *RPCServer) DeletePersistentStorage(input RPCTestName, void *RPCVoid) error {
 	defer s.keepAlive()
-	s.activeClient.DeletePersistentStorage(&api.MockT{TestName: testName})
+	c, err := s.client(input.Handle)
+	if err != nil {
+		return err
+	}
+	c.client.DeletePersistentStorage(&api.MockT{TestName: input.TestName})
 	return nil
 }
 
-func (s *RPCServer) CurrentAccessToken(testName string, token *string) error {
+type RPCAccessToken struct {
+	AccessToken string `json:"access_token"`
+}
+
+func (s *RPCServer) CurrentAccessToken(input RPCTestName, output *RPCAccessToken) error {
 	defer s.keepAlive()
-	*token = s.activeClient.CurrentAccessToken(&api.MockT{TestName: testName})
+	c, err := s.client(input.Handle)
+	if err != nil {
+		return err
+	}
+	output.AccessToken = c.client.CurrentAccessToken(&api.MockT{TestName: input.TestName})
 	return nil
 }
 
-func (s *RPCServer) Login(opts api.ClientCreationOpts, void *int) error {
+type RPCLogin struct {
+	Handle string `json:"handle"`
+	api.ClientCreationOpts
+}
+
+func (s *RPCServer) Login(input RPCLogin, void *RPCVoid) error {
 	defer s.keepAlive()
-	return s.activeClient.Login(&api.MockT{}, opts)
+	c, err := s.client(input.Handle)
+	if err != nil {
+		return err
+	}
+	return c.client.Login(&api.MockT{}, input.ClientCreationOpts)
 }
 
-func (s *RPCServer) MustStartSyncing(testName string, void *int) error {
+func (s *RPCServer) MustStartSyncing(input RPCTestName, void *RPCVoid) error {
 	defer s.keepAlive()
-	s.stopSyncing = s.activeClient.MustStartSyncing(&api.MockT{TestName: testName})
+	c, err := s.client(input.Handle)
+	if err != nil {
+		return err
+	}
+	c.syncMu.Lock()
+	defer c.syncMu.Unlock()
+	c.stopSyncing = c.client.MustStartSyncing(&api.MockT{TestName: input.TestName})
+	s.notifyState(input.Handle, RPCClientStateSyncing)
 	return nil
 }
 
-func (s *RPCServer) StartSyncing(testName string, void *int) error {
+func (s *RPCServer) StartSyncing(input RPCTestName, void *RPCVoid) error {
 	defer s.keepAlive()
-	stopSyncing, err := s.activeClient.StartSyncing(&api.MockT{TestName: testName})
+	c, err := s.client(input.Handle)
+	if err != nil {
+		return err
+	}
+	c.syncMu.Lock()
+	defer c.syncMu.Unlock()
+	stopSyncing, err := c.client.StartSyncing(&api.MockT{TestName: input.TestName})
 	if err != nil {
-		return fmt.Errorf("%s RPCServer.StartSyncing: %v", testName, err)
+		return fmt.Errorf("%s RPCServer.StartSyncing: %v", input.TestName, err)
 	}
-	s.stopSyncing = stopSyncing
+	c.stopSyncing = stopSyncing
+	s.notifyState(input.Handle, RPCClientStateSyncing)
 	return nil
 }
 
-func (s *RPCServer) StopSyncing(testName string, void *int) error {
+func (s *RPCServer) StopSyncing(input RPCTestName, void *RPCVoid) error {
 	defer s.keepAlive()
-	if s.stopSyncing == nil {
-		return fmt.Errorf("%s RPCServer.StopSyncing: cannot stop syncing as StartSyncing wasn't called", testName)
+	c, err := s.client(input.Handle)
+	if err != nil {
+		return err
+	}
+	c.syncMu.Lock()
+	defer c.syncMu.Unlock()
+	if c.stopSyncing == nil {
+		return fmt.Errorf("%s RPCServer.StopSyncing: cannot stop syncing as StartSyncing wasn't called", input.TestName)
 	}
-	s.stopSyncing()
-	s.stopSyncing = nil
+	c.stopSyncing()
+	c.stopSyncing = nil
+	s.notifyState(input.Handle, RPCClientStateStoppedSyncing)
 	return nil
 }
 
-func (s *RPCServer) IsRoomEncrypted(roomID string, isEncrypted *bool) error {
+type RPCRoomID struct {
+	Handle   string `json:"handle"`
+	TestName string `json:"test_name"`
+	RoomID   string `json:"room_id"`
+}
+
+type RPCIsRoomEncrypted struct {
+	IsEncrypted bool `json:"is_encrypted"`
+}
+
+func (s *RPCServer) IsRoomEncrypted(input RPCRoomID, output *RPCIsRoomEncrypted) error {
 	defer s.keepAlive()
-	var err error
-	*isEncrypted, err = s.activeClient.IsRoomEncrypted(&api.MockT{}, roomID)
+	c, err := s.client(input.Handle)
+	if err != nil {
+		return err
+	}
+	output.IsEncrypted, err = c.client.IsRoomEncrypted(&api.MockT{TestName: input.TestName}, input.RoomID)
 	return err
 }
 
 type RPCSendMessage struct {
-	TestName string
-	RoomID   string
-	Text     string
+	Handle   string `json:"handle"`
+	TestName string `json:"test_name"`
+	RoomID   string `json:"room_id"`
+	Text     string `json:"text"`
+}
+
+type RPCEventID struct {
+	EventID string `json:"event_id"`
 }
 
-func (s *RPCServer) SendMessage(msg RPCSendMessage, eventID *string) error {
+func (s *RPCServer) SendMessage(input RPCSendMessage, output *RPCEventID) error {
 	defer s.keepAlive()
-	*eventID = s.activeClient.SendMessage(&api.MockT{TestName: msg.TestName}, msg.RoomID, msg.Text)
+	c, err := s.client(input.Handle)
+	if err != nil {
+		return err
+	}
+	output.EventID = c.client.SendMessage(&api.MockT{TestName: input.TestName}, input.RoomID, input.Text)
 	return nil
 }
 
-func (s *RPCServer) TrySendMessage(msg RPCSendMessage, eventID *string) error {
+func (s *RPCServer) TrySendMessage(input RPCSendMessage, output *RPCEventID) error {
 	defer s.keepAlive()
-	var err error
-	*eventID, err = s.activeClient.TrySendMessage(&api.MockT{TestName: msg.TestName}, msg.RoomID, msg.Text)
+	c, err := s.client(input.Handle)
+	if err != nil {
+		return err
+	}
+	output.EventID, err = c.client.TrySendMessage(&api.MockT{TestName: input.TestName}, input.RoomID, input.Text)
 	if err != nil {
 		return err
 	}
@@ -167,135 +404,225 @@ func (s *RPCServer) TrySendMessage(msg RPCSendMessage, eventID *string) error {
 }
 
 type RPCWaitUntilEvent struct {
-	TestName string
-	RoomID   string
+	Handle   string `json:"handle"`
+	TestName string `json:"test_name"`
+	RoomID   string `json:"room_id"`
+	// If set, only events which match are sent to the test process, and the waiter stops at the first match.
+	// If null, every event is sent, as the test process is using a checker which cannot be serialised.
+	Matcher *api.EventMatcher `json:"matcher"`
+}
+
+type RPCWaiterID struct {
+	WaiterID int `json:"waiter_id"`
 }
 
-func (s *RPCServer) WaitUntilEventInRoom(input RPCWaitUntilEvent, waiterID *int) error {
+func (s *RPCServer) WaitUntilEventInRoom(input RPCWaitUntilEvent, output *RPCWaiterID) error {
 	defer s.keepAlive()
-	waiter := s.activeClient.WaitUntilEventInRoom(&api.MockT{TestName: input.TestName}, input.RoomID, func(e api.Event) bool {
-		s.waitersMu.Lock()
-		defer s.waitersMu.Unlock()
-		rpcWaiter := s.waiters[*waiterID]
+	c, err := s.client(input.Handle)
+	if err != nil {
+		return err
+	}
+	waiterID := &output.WaiterID
+	waiter := c.client.WaitUntilEventInRoom(&api.MockT{TestName: input.TestName}, input.RoomID, api.CheckerFunc(func(e api.Event) bool {
+		if input.Matcher != nil && !input.Matcher.Check(e) {
+			return false
+		}
+		c.waitersMu.Lock()
+		rpcWaiter := c.waiters[*waiterID]
 		if rpcWaiter == nil {
+			c.waitersMu.Unlock()
 			panic("waiter did not exist when it should have")
 		}
-		// remember this event so when the rpc client calls PollWait we can deliver them.
-		rpcWaiter.eventsToCheck = append(rpcWaiter.eventsToCheck, e)
-		s.waiters[*waiterID] = rpcWaiter
-		return false
-	})
-	s.waitersMu.Lock()
-	defer s.waitersMu.Unlock()
-	nextID := s.nextWaiterID + 1
-	s.nextWaiterID = nextID
-	s.waiters[s.nextWaiterID] = &RPCServerWaiter{
+		if rpcWaiter.stopped {
+			c.waitersMu.Unlock()
+			return true // stop the waiter, as the test process no longer wants events
+		}
+		if !rpcWaiter.started {
+			// remember this event so when the test process calls WaiterStart we can deliver it.
+			rpcWaiter.pendingEvents = append(rpcWaiter.pendingEvents, e)
+			c.waitersMu.Unlock()
+			return false
+		}
+		// notify without holding waitersMu, so WaiterStop is never blocked behind a notification
+		rpcWaiter.sendMu.Lock()
+		c.waitersMu.Unlock()
+		s.notifyEvent(input.Handle, *waiterID, e)
+		rpcWaiter.sendMu.Unlock()
+		// if the event matched, there is no need to send more events
+		return input.Matcher != nil
+	}))
+	c.waitersMu.Lock()
+	defer c.waitersMu.Unlock()
+	nextID := c.nextWaiterID + 1
+	c.nextWaiterID = nextID
+	c.waiters[c.nextWaiterID] = &RPCServerWaiter{
 		Waiter: waiter,
 	}
 	*waiterID = nextID
 	return nil
 }
 
-type RPCCheck struct {
+func (s *RPCServer) notifyEvent(handle string, waiterID int, e api.Event) {
+	err := s.notifier.Notify("WaiterEvent", RPCWaiterEvent{
+		Handle:   handle,
+		WaiterID: waiterID,
+		Event:    e,
+	})
+	if err != nil {
+		log.Printf("RPCServer: failed to send WaiterEvent notification: %s", err)
+	}
 }
 
 type RPCWait struct {
-	TestName string
-	WaiterID int
-	Msg      string
-	Timeout  time.Duration
+	Handle    string `json:"handle"`
+	TestName  string `json:"test_name"`
+	WaiterID  int    `json:"waiter_id"`
+	Msg       string `json:"msg"`
+	TimeoutMS int64  `json:"timeout_ms"`
 }
 
-// WaiterStart is the RPC equivalent to Waiter.Waitf. It begins accumulating events for the RPC client to check.
-// Clients need to call WaiterPoll to get these new events.
-func (s *RPCServer) WaiterStart(input RPCWait, void *int) error {
+// WaiterStart is the RPC equivalent to Waiter.Waitf. It begins sending WaiterEvent notifications for each event
+// the waiter sees, for the test process to check. A WaiterDone notification is sent when the waiter stops.
+func (s *RPCServer) WaiterStart(input RPCWait, void *RPCVoid) error {
 	defer s.keepAlive()
-	s.waitersMu.Lock()
-	w := s.waiters[input.WaiterID]
+	c, err := s.client(input.Handle)
+	if err != nil {
+		return err
+	}
+	c.waitersMu.Lock()
+	w := c.waiters[input.WaiterID]
 	if w == nil {
-		s.waitersMu.Unlock()
+		c.waitersMu.Unlock()
 		return fmt.Errorf("RPC: Wait: no waiter found with id %d", input.WaiterID)
 	}
-	if !w.startedAt.IsZero() {
-		s.waitersMu.Unlock()
-		return nil // already polling
+	if w.started {
+		c.waitersMu.Unlock()
+		return nil // already started
 	}
-	w.startedAt = time.Now()
-	w.timeout = input.Timeout
-	s.waitersMu.Unlock()
+	w.started = true
+	pendingEvents := w.pendingEvents
+	w.pendingEvents = nil
+	// send events seen before the waiter was started. sendMu is taken before waitersMu is released, so they are
+	// sent before newer events.
+	w.sendMu.Lock()
+	c.waitersMu.Unlock()
+	for _, e := range pendingEvents {
+		s.notifyEvent(input.Handle, input.WaiterID, e)
+	}
+	w.sendMu.Unlock()
 	// We do NOT call .Waitf here as timing out will be fatal. Instead, we TryWaitf, and only fail the test
-	// _once the client has fetched the events_ because checker functions are arbitrary. Effectively, calling
-	// this function just starts populating w.eventsToCheck. An error will ALWAYS be returned here because
-	// we ALWAYS return false in the checker function to keep fetching more events, hence consciously drop it.
-	// We need to do this in a goroutine so the client can start calling WaiterPoll.
-	go w.TryWaitf(&api.MockT{TestName: input.TestName}, input.Timeout, input.Msg)
+	// in the test process, because checker functions are arbitrary. Effectively, calling this function just
+	// starts sending events. An error is returned here unless WaiterStop is called, because we return false in
+	// the checker function to keep fetching more events.
+	// We need to do this in a goroutine so the test process can start checking events.
+	go func() {
+		err := w.TryWaitf(&api.MockT{TestName: input.TestName}, time.Duration(input.TimeoutMS)*time.Millisecond, input.Msg)
+		c.waitersMu.Lock()
+		stopped := w.stopped
+		delete(c.waiters, input.WaiterID)
+		c.waitersMu.Unlock()
+		done := RPCWaiterDone{
+			Handle:   input.Handle,
+			WaiterID: input.WaiterID,
+		}
+		if err != nil && !stopped {
+			done.Error = err.Error()
+		}
+		if err := s.notifier.Notify("WaiterDone", done); err != nil {
+			log.Printf("RPCServer: failed to send WaiterDone notification: %s", err)
+		}
+	}()
 	return nil
 }
 
-func (s *RPCServer) WaiterPoll(waiterID int, eventsToCheck *[]api.Event) error {
+type RPCStopWaiter struct {
+	Handle   string `json:"handle"`
+	WaiterID int    `json:"waiter_id"`
+}
+
+// WaiterStop stops sending events for this waiter, as the test process has finished waiting.
+func (s *RPCServer) WaiterStop(input RPCStopWaiter, void *RPCVoid) error {
 	defer s.keepAlive()
-	fmt.Println("Acquiring lock")
-	s.waitersMu.Lock()
-	defer s.waitersMu.Unlock()
-	fmt.Println("Acquired!")
-	w := s.waiters[waiterID]
-	if w == nil {
-		return fmt.Errorf("unknown waiter id %d", waiterID)
-	}
-	if time.Since(w.startedAt) > w.timeout {
-		return fmt.Errorf("timed out after %v", w.timeout)
+	c, err := s.client(input.Handle)
+	if err != nil {
+		return err
 	}
-	eventsToCheckCopy := make([]api.Event, len(w.eventsToCheck))
-	for i := range w.eventsToCheck {
-		eventsToCheckCopy[i] = w.eventsToCheck[i]
+	c.waitersMu.Lock()
+	defer c.waitersMu.Unlock()
+	w := c.waiters[input.WaiterID]
+	if w == nil {
+		return nil // already stopped
 	}
-	*eventsToCheck = eventsToCheckCopy
-	w.eventsToCheck = nil // reset the events to check
+	w.stopped = true
 	return nil
 }
 
 // Backpaginate in this room by `count` events.
 type RPCBackpaginate struct {
-	TestName string
-	RoomID   string
-	Count    int
+	Handle   string `json:"handle"`
+	TestName string `json:"test_name"`
+	RoomID   string `json:"room_id"`
+	Count    int    `json:"count"`
 }
 
-func (s *RPCServer) MustBackpaginate(input RPCBackpaginate, void *int) error {
+func (s *RPCServer) MustBackpaginate(input RPCBackpaginate, void *RPCVoid) error {
 	defer s.keepAlive()
-	s.activeClient.MustBackpaginate(&api.MockT{TestName: input.TestName}, input.RoomID, input.Count)
+	c, err := s.client(input.Handle)
+	if err != nil {
+		return err
+	}
+	c.client.MustBackpaginate(&api.MockT{TestName: input.TestName}, input.RoomID, input.Count)
 	return nil
 }
 
 type RPCGetEvent struct {
-	TestName string
-	RoomID   string
-	EventID  string
+	Handle   string `json:"handle"`
+	TestName string `json:"test_name"`
+	RoomID   string `json:"room_id"`
+	EventID  string `json:"event_id"`
 }
 
 // MustGetEvent will return the client's view of this event, or fail the test if the event cannot be found.
 func (s *RPCServer) MustGetEvent(input RPCGetEvent, output *api.Event) error {
 	defer s.keepAlive()
-	*output = s.activeClient.MustGetEvent(&api.MockT{TestName: input.TestName}, input.RoomID, input.EventID)
+	c, err := s.client(input.Handle)
+	if err != nil {
+		return err
+	}
+	*output = c.client.MustGetEvent(&api.MockT{TestName: input.TestName}, input.RoomID, input.EventID)
 	return nil
 }
 
 // MustBackupKeys will backup E2EE keys, else fail the test.
-func (s *RPCServer) MustBackupKeys(testName string, recoveryKey *string) error {
+type RPCRecoveryKey struct {
+	RecoveryKey string `json:"recovery_key"`
+}
+
+func (s *RPCServer) MustBackupKeys(input RPCTestName, output *RPCRecoveryKey) error {
 	defer s.keepAlive()
-	*recoveryKey = s.activeClient.MustBackupKeys(&api.MockT{TestName: testName})
+	c, err := s.client(input.Handle)
+	if err != nil {
+		return err
+	}
+	output.RecoveryKey = c.client.MustBackupKeys(&api.MockT{TestName: input.TestName})
 	return nil
 }
 
 type RPCGetNotification struct {
-	RoomID  string
-	EventID string
+	Handle   string `json:"handle"`
+	TestName string `json:"test_name"`
+	RoomID   string `json:"room_id"`
+	EventID  string `json:"event_id"`
 }
 
 func (s *RPCServer) GetNotification(input RPCGetNotification, output *api.Notification) (err error) {
 	defer s.keepAlive()
+	c, err := s.client(input.Handle)
+	if err != nil {
+		return err
+	}
 	var n *api.Notification
-	n, err = s.activeClient.GetNotification(&api.MockT{}, input.RoomID, input.EventID)
+	n, err = c.client.GetNotification(&api.MockT{TestName: input.TestName}, input.RoomID, input.EventID)
 	if err == nil {
 		*output = *n
 	}
@@ -303,43 +630,90 @@ func (s *RPCServer) GetNotification(input RPCGetNotification, output *api.Notifi
 }
 
 // MustLoadBackup will recover E2EE keys from the latest backup, else fail the test.
-func (s *RPCServer) MustLoadBackup(recoveryKey string, void *int) error {
+type RPCLoadBackup struct {
+	Handle      string `json:"handle"`
+	TestName    string `json:"test_name"`
+	RecoveryKey string `json:"recovery_key"`
+}
+
+func (s *RPCServer) MustLoadBackup(input RPCLoadBackup, void *RPCVoid) error {
 	defer s.keepAlive()
-	s.activeClient.MustLoadBackup(&api.MockT{}, recoveryKey)
+	c, err := s.client(input.Handle)
+	if err != nil {
+		return err
+	}
+	c.client.MustLoadBackup(&api.MockT{TestName: input.TestName}, input.RecoveryKey)
 	return nil
 }
 
-func (s *RPCServer) LoadBackup(recoveryKey string, void *int) error {
+func (s *RPCServer) LoadBackup(input RPCLoadBackup, void *RPCVoid) error {
 	defer s.keepAlive()
-	return s.activeClient.LoadBackup(&api.MockT{}, recoveryKey)
+	c, err := s.client(input.Handle)
+	if err != nil {
+		return err
+	}
+	return c.client.LoadBackup(&api.MockT{TestName: input.TestName}, input.RecoveryKey)
 }
 
-func (s *RPCServer) Logf(input string, void *int) error {
+type RPCLog struct {
+	Handle  string `json:"handle"`
+	Message string `json:"message"`
+}
+
+func (s *RPCServer) Logf(input RPCLog, void *RPCVoid) error {
 	defer s.keepAlive()
-	log.Println(input)
-	s.activeClient.Logf(&api.MockT{}, input)
+	c, err := s.client(input.Handle)
+	if err != nil {
+		return err
+	}
+	log.Println(input.Message)
+	c.client.Logf(&api.MockT{}, "%s", input.Message)
 	return nil
 }
 
-func (s *RPCServer) UserID(void int, userID *string) error {
+type RPCUserID struct {
+	UserID string `json:"user_id"`
+}
+
+func (s *RPCServer) UserID(input RPCHandle, output *RPCUserID) error {
 	defer s.keepAlive()
-	*userID = s.activeClient.UserID()
+	c, err := s.client(input.Handle)
+	if err != nil {
+		return err
+	}
+	output.UserID = c.client.UserID()
 	return nil
 }
-func (s *RPCServer) Type(void int, clientType *api.ClientTypeLang) error {
+
+type RPCType struct {
+	Type api.ClientTypeLang `json:"type"`
+}
+
+func (s *RPCServer) Type(input RPCHandle, output *RPCType) error {
 	defer s.keepAlive()
-	*clientType = s.activeClient.Type()
+	c, err := s.client(input.Handle)
+	if err != nil {
+		return err
+	}
+	output.Type = c.client.Type()
 	return nil
 }
-func (s *RPCServer) Opts(void int, opts *api.ClientCreationOpts) error {
+func (s *RPCServer) Opts(input RPCHandle, opts *api.ClientCreationOpts) error {
 	defer s.keepAlive()
-	*opts = s.activeClient.Opts()
+	c, err := s.client(input.Handle)
+	if err != nil {
+		return err
+	}
+	*opts = c.client.Opts()
 	return nil
 }
 
 type RPCServerWaiter struct {
 	api.Waiter
-	eventsToCheck []api.Event
-	startedAt     time.Time
-	timeout       time.Duration
+	pendingEvents []api.Event // events seen before WaiterStart
+	started       bool
+	stopped       bool
+	// held whilst sending WaiterEvent notifications, so they are sent in order. Taken whilst holding waitersMu,
+	// but waitersMu must not be taken whilst holding it.
+	sendMu sync.Mutex
 }
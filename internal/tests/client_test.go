@@ -15,6 +15,8 @@ import (
 	"github.com/matrix-org/complement-crypto/internal/api"
 	"github.com/matrix-org/complement-crypto/internal/api/js"
 	"github.com/matrix-org/complement-crypto/internal/api/rust"
+	"github.com/matrix-org/complement-crypto/internal/config"
+	"github.com/matrix-org/complement-crypto/internal/config/timing"
 	"github.com/matrix-org/complement-crypto/internal/deploy"
 	"github.com/matrix-org/complement/b"
 	"github.com/matrix-org/complement/client"
@@ -36,11 +38,14 @@ func Deploy(t *testing.T) *deploy.SlidingSyncDeployment {
 	if ssDeployment != nil {
 		return ssDeployment
 	}
-	ssDeployment = deploy.RunNewDeployment(t, "", "")
+	ssDeployment = deploy.RunNewDeployment(t, deploy.DeploymentOpts{})
 	return ssDeployment
 }
 
 func TestMain(m *testing.M) {
+	tp := config.NewTimingProfileFromEnvVars()
+	timing.Set(tp)
+	fmt.Printf("Using %s\n", tp)
 	rustClientCreator := func(t *testing.T, cfg api.ClientCreationOpts) api.Client {
 		client, err := rust.NewRustClient(t, cfg)
 		if err != nil {
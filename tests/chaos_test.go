@@ -0,0 +1,76 @@
+package tests
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/config/timing"
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+)
+
+// ExpectedMessage is a message which the receiver must eventually decrypt.
+type ExpectedMessage struct {
+	Receiver api.Client
+	RoomID   string
+	EventID  string
+	Body     string
+}
+
+// WithChaos runs the scenario whilst mitmproxy randomly fails client-server requests, then asserts that every
+// message returned by the scenario is eventually decrypted by its receiver once connectivity is restored.
+// Messages which failed to send should not be returned.
+func (c *TestContext) WithChaos(t *testing.T, opts mitm.StatusCodeOptions, scenario func() []ExpectedMessage) {
+	t.Helper()
+	if opts.Filter.IsZero() {
+		opts.Filter = mitm.Client()
+	}
+	var msgs []ExpectedMessage
+	c.Deployment.WithChaos(t, opts, func() {
+		msgs = scenario()
+	})
+	for _, msg := range msgs {
+		msg.Receiver.WaitUntilEventInRoom(t, msg.RoomID, api.MatchAll(
+			api.MatchEventID(msg.EventID), api.MatchFailedToDecrypt(false), api.MatchBody(msg.Body),
+		)).Waitf(t, timing.Get().Scale(10*time.Second), "%s did not decrypt event %s after chaos ended", msg.Receiver.UserID(), msg.EventID)
+	}
+}
+
+// Test that when requests fail at random, clients retry such that all messages which were sent are eventually
+// decrypted by the receiver.
+func TestMessagesDecryptUnderChaos(t *testing.T) {
+	ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, EncRoomOptions.PresetPublicChat())
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.Client) {
+			tc.WithChaos(t, mitm.StatusCodeOptions{
+				Chaos: &mitm.ChaosOptions{
+					Percent:       20,
+					StatusCodes:   []int{http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway},
+					LimitExceeded: true,
+					RetryAfter:    100 * time.Millisecond,
+				},
+			}, func() []ExpectedMessage {
+				var msgs []ExpectedMessage
+				for i := 0; i < 10; i++ {
+					body := fmt.Sprintf("Chaos message %d", i)
+					evID, err := alice.TrySendMessage(t, roomID, body)
+					if err != nil {
+						t.Logf("TrySendMessage: %s", err)
+						continue
+					}
+					msgs = append(msgs, ExpectedMessage{
+						Receiver: bob,
+						RoomID:   roomID,
+						EventID:  evID,
+						Body:     body,
+					})
+				}
+				return msgs
+			})
+		})
+	})
+}
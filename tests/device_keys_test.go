@@ -6,7 +6,9 @@ import (
 	"time"
 
 	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/config/timing"
 	"github.com/matrix-org/complement-crypto/internal/deploy"
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
 	"github.com/matrix-org/complement/must"
 )
 
@@ -63,3 +65,37 @@ func TestFailedDeviceKeyDownloadRetries(t *testing.T) {
 		must.Equal(t, queryReceived, true, "No request to /keys/query was received!")
 	})
 }
+
+// If a client's /keys/query response does not include a user's devices, the client does not encrypt for them.
+//
+// Remove Bob's device keys from Alice's /keys/query responses, then have Alice send a message.
+// Bob should be unable to decrypt it, proving the client acted on the rewritten response.
+func TestRewrittenKeysQueryHidesDevices(t *testing.T) {
+	ForEachClientType(t, func(t *testing.T, clientType api.ClientType) {
+		tc := CreateTestContext(t, clientType, clientType)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, EncRoomOptions.Invite([]string{tc.Bob.UserID}))
+		tc.Bob.MustJoinRoom(t, roomID, []string{"hs1"})
+
+		alice := tc.MustLoginClient(t, tc.Alice, tc.AliceClientType)
+		defer alice.Close(t)
+		bob := tc.MustLoginClient(t, tc.Bob, tc.BobClientType)
+		defer bob.Close(t)
+		bobStopSyncing := bob.MustStartSyncing(t)
+		defer bobStopSyncing()
+
+		tc.Deployment.WithRewrittenBodies(t, mitm.RewriteOptions{
+			Filter:  mitm.All(mitm.PathContains("/keys/query"), mitm.DeviceID(tc.Alice.DeviceID)),
+			Patches: []mitm.JSONPatch{mitm.PatchRemove("/device_keys/" + tc.Bob.UserID)},
+		}, func() {
+			// alice first downloads bob's keys when she starts syncing
+			aliceStopSyncing := alice.MustStartSyncing(t)
+			defer aliceStopSyncing()
+
+			evID := alice.SendMessage(t, roomID, "bob cannot decrypt this")
+			// bob sees the event, but not its body
+			bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasEventID(evID)).Waitf(t, timing.Get().Scale(5*time.Second), "bob did not see alice's message")
+			ev := bob.MustGetEvent(t, roomID, evID)
+			must.Equal(t, ev.FailedToDecrypt, true, "bob decrypted a message alice should not have encrypted for him")
+		})
+	})
+}
@@ -0,0 +1,115 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/config/timing"
+	"github.com/matrix-org/complement-crypto/internal/deploy"
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that if a /sync response is truncated, the client does not advance its sync token and instead
+// retries from the same position, such that it still sees messages sent whilst the response was broken.
+func TestTruncatedSyncDoesNotAdvanceSinceToken(t *testing.T) {
+	ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, EncRoomOptions.PresetPublicChat())
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.Client) {
+			aliceSyncs := mitm.All(mitm.URLRegex("/sync"), mitm.DeviceID(tc.Alice.DeviceID))
+			mark := tc.Deployment.MarkFlows(t)
+			tc.Deployment.WithFaults(t, mitm.FaultOptions{
+				Filter:     aliceSyncs,
+				Mode:       mitm.FaultTruncate,
+				AfterBytes: 10,
+				Count:      1,
+			}, func() {
+				// wake up alice's sync loop so the response is truncated
+				bob.SendMessage(t, roomID, "wake up")
+				time.Sleep(time.Second)
+			})
+			// alice should still see messages
+			bob.SendMessage(t, roomID, "after truncation")
+			alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody("after truncation")).Waitf(t, timing.Get().Scale(10*time.Second), "alice did not see message after truncated /sync")
+
+			flows := tc.Deployment.FlowsSince(t, mark, aliceSyncs)
+			truncated := -1
+			for i, flow := range flows {
+				if flow.Fault == mitm.FaultTruncate {
+					truncated = i
+					break
+				}
+			}
+			if truncated == -1 {
+				t.Fatalf("did not see a truncated /sync response in %d flows", len(flows))
+			}
+			token := syncToken(t, flows[truncated])
+			t.Logf("truncated /sync: %s (token=%s)", flows[truncated], token)
+			for _, flow := range flows[truncated+1:] {
+				if syncToken(t, flow) == token {
+					return
+				}
+			}
+			t.Errorf("alice did not retry /sync with token '%s' after a truncated response", token)
+		})
+	})
+}
+
+// syncToken returns the position the client is syncing from: `since` for /sync or `pos` for sliding sync.
+func syncToken(t *testing.T, flow deploy.CallbackData) string {
+	t.Helper()
+	u, err := url.Parse(flow.URL)
+	if err != nil {
+		t.Fatalf("failed to parse URL %s: %s", flow.URL, err)
+	}
+	if since := u.Query().Get("since"); since != "" {
+		return since
+	}
+	return u.Query().Get("pos")
+}
+
+// Test that if the response to sending an event is lost after the server has processed the request, the client
+// retries with the same transaction ID, such that the event is still delivered exactly once.
+func TestSendRetriedAfterFailedResponse(t *testing.T) {
+	ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, EncRoomOptions.PresetPublicChat())
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.Client) {
+			aliceSends := mitm.All(mitm.Method("PUT"), mitm.PathContains("/send/m.room.encrypted/"), mitm.DeviceID(tc.Alice.DeviceID))
+			mark := tc.Deployment.MarkFlows(t)
+			var intercepted atomic.Int32
+			var eventID string
+			tc.Deployment.WithInterceptedEndpoint(t, aliceSends, func(cd deploy.CallbackData) *deploy.Verdict {
+				if intercepted.Add(1) > 1 {
+					return nil
+				}
+				// the server has stored the event, but alice doesn't know that
+				t.Logf("failing %s", cd)
+				return &deploy.Verdict{
+					StatusCode: 502,
+					Body:       json.RawMessage(`{"errcode":"M_UNKNOWN","error":"intercepted by test"}`),
+				}
+			}, func() {
+				eventID = alice.SendMessage(t, roomID, "retried")
+			})
+			bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasEventID(eventID)).Waitf(t, timing.Get().Scale(10*time.Second), "bob did not see the retried message")
+			ev := bob.MustGetEvent(t, roomID, eventID)
+			must.Equal(t, ev.Text, "retried", "bob could not decrypt the retried message")
+
+			flows := tc.Deployment.FlowsSince(t, mark, aliceSends)
+			if len(flows) < 2 {
+				t.Fatalf("alice did not retry /send after a 502: saw %d requests", len(flows))
+			}
+			must.Equal(t, flows[0].ResponseCode, 502, "first /send response code")
+			must.Equal(t, flows[1].URL, flows[0].URL, "retried /send used a different transaction ID")
+			must.Equal(t, flows[1].ResponseCode, 200, "retried /send response code")
+		})
+	})
+}
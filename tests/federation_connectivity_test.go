@@ -1,10 +1,15 @@
 package tests
 
 import (
+	"encoding/json"
+	"net/http"
 	"testing"
 	"time"
 
 	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/config/timing"
+	"github.com/matrix-org/complement-crypto/internal/deploy"
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
 	"github.com/matrix-org/complement/must"
 )
 
@@ -18,14 +23,17 @@ import (
 func TestNewUserCannotGetKeysForOfflineServer(t *testing.T) {
 	ForEachClientType(t, func(t *testing.T, clientType api.ClientType) {
 		tc := CreateTestContext(t, api.ClientType{
-			Lang: clientType.Lang,
-			HS:   "hs1",
+			Lang:         clientType.Lang,
+			HS:           "hs1",
+			Multiprocess: clientType.Multiprocess,
 		}, api.ClientType{
-			Lang: clientType.Lang,
-			HS:   "hs2",
+			Lang:         clientType.Lang,
+			HS:           "hs2",
+			Multiprocess: clientType.Multiprocess,
 		}, api.ClientType{
-			Lang: clientType.Lang,
-			HS:   "hs1",
+			Lang:         clientType.Lang,
+			HS:           "hs1",
+			Multiprocess: clientType.Multiprocess,
 		})
 		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, EncRoomOptions.Invite([]string{tc.Bob.UserID}))
 		t.Logf("%s joining room %s", tc.Bob.UserID, roomID)
@@ -98,14 +106,17 @@ func TestNewUserCannotGetKeysForOfflineServer(t *testing.T) {
 func TestExistingSessionCannotGetKeysForOfflineServer(t *testing.T) {
 	ForEachClientType(t, func(t *testing.T, clientType api.ClientType) {
 		tc := CreateTestContext(t, api.ClientType{
-			Lang: clientType.Lang,
-			HS:   "hs1",
+			Lang:         clientType.Lang,
+			HS:           "hs1",
+			Multiprocess: clientType.Multiprocess,
 		}, api.ClientType{
-			Lang: clientType.Lang,
-			HS:   "hs2",
+			Lang:         clientType.Lang,
+			HS:           "hs2",
+			Multiprocess: clientType.Multiprocess,
 		}, api.ClientType{
-			Lang: clientType.Lang,
-			HS:   "hs1",
+			Lang:         clientType.Lang,
+			HS:           "hs1",
+			Multiprocess: clientType.Multiprocess,
 		})
 		roomIDbc := tc.CreateNewEncryptedRoom(t, tc.Charlie, EncRoomOptions.Invite([]string{tc.Bob.UserID}))
 		roomIDab := tc.CreateNewEncryptedRoom(t, tc.Alice, EncRoomOptions.Invite([]string{tc.Bob.UserID}))
@@ -154,3 +165,160 @@ func TestExistingSessionCannotGetKeysForOfflineServer(t *testing.T) {
 		})
 	})
 }
+
+// A and B are in a room, on different servers.
+// A sends a message, but A's server cannot send the room key to B's server over federation.
+// A's server is killed whilst it is trying to send the room key.
+// A's server restarts. It should retry sending the room key, so B can decrypt the message.
+func TestServerRetriesToDeviceOverFederationAfterKill(t *testing.T) {
+	skipIfFederationNotProxied(t)
+	ForEachClientType(t, func(t *testing.T, clientType api.ClientType) {
+		tc := CreateTestContext(t, clientType, api.ClientType{
+			Lang:         clientType.Lang,
+			HS:           "hs2",
+			Multiprocess: clientType.Multiprocess,
+		})
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, EncRoomOptions.Invite([]string{tc.Bob.UserID}))
+		joinMark := tc.Deployment.MarkFlows(t)
+		tc.Bob.MustJoinRoom(t, roomID, []string{"hs1"})
+		mustSeeFederationFlows(t, tc.Deployment, joinMark)
+
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.Client) {
+			// let clients sync device keys
+			time.Sleep(time.Second)
+
+			wantMsgBody := "Bob can see this once Alice's server retries sending the room key"
+			waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+			transactionsToHS2 := mitm.All(mitm.Federation(), mitm.Host("hs2"), mitm.PathContains("/_matrix/federation/v1/send/"))
+			mark := tc.Deployment.MarkFlows(t)
+			tc.Deployment.WithMITMAddons(t, []mitm.Addon{
+				mitm.StatusCodeOptions{
+					Filter:       transactionsToHS2,
+					ReturnStatus: http.StatusBadGateway,
+					BlockRequest: true,
+				},
+			}, func() {
+				evID := alice.SendMessage(t, roomID, wantMsgBody)
+				t.Logf("alice sent %s, waiting for hs1 to try to send the room key to hs2", evID)
+				waitForToDeviceTransaction(t, tc.Deployment, mark, transactionsToHS2)
+				tc.Deployment.KillServer(t, "hs1")
+			})
+			tc.Deployment.StartServer(t, "hs1")
+
+			// the room key only reaches bob if hs1 retries the transaction after restarting
+			waiter.Waitf(t, timing.Get().Scale(30*time.Second), "bob did not see alice's message '%s' after hs1 restarted", wantMsgBody)
+		})
+	})
+}
+
+// waitForToDeviceTransaction waits until a federation transaction containing to-device messages matches the filter.
+func waitForToDeviceTransaction(t *testing.T, deployment *deploy.SlidingSyncDeployment, mark deploy.FlowMark, filter mitm.Filter) {
+	t.Helper()
+	deployment.WaitForFlows(t, mark, filter, func(flows []deploy.CallbackData) bool {
+		for _, flow := range flows {
+			var txn struct {
+				EDUs []struct {
+					Type string `json:"edu_type"`
+				} `json:"edus"`
+			}
+			if err := json.Unmarshal(flow.RequestBody, &txn); err != nil {
+				continue
+			}
+			for _, edu := range txn.EDUs {
+				if edu.Type == "m.direct_to_device" {
+					t.Logf("saw to-device transaction: %s", flow)
+					return true
+				}
+			}
+		}
+		return false
+	})
+}
+
+// A and B are in a room, on different servers. B joins whilst A's server cannot reach B's server to get B's
+// device list, which also checks that federation traffic goes via mitmproxy.
+// A's client queries B's keys, and A's server reports that B's server failed.
+// B's server becomes reachable. A's server should retry getting B's keys, so A can encrypt for B.
+func TestServerRetriesFederatedKeysQuery(t *testing.T) {
+	skipIfFederationNotProxied(t)
+	ForEachClientType(t, func(t *testing.T, clientType api.ClientType) {
+		tc := CreateTestContext(t, clientType, api.ClientType{
+			Lang:         clientType.Lang,
+			HS:           "hs2",
+			Multiprocess: clientType.Multiprocess,
+		})
+		alice := tc.MustLoginClient(t, tc.Alice, tc.AliceClientType)
+		defer alice.Close(t)
+		bob := tc.MustLoginClient(t, tc.Bob, tc.BobClientType)
+		defer bob.Close(t)
+		bobStopSyncing := bob.MustStartSyncing(t)
+		defer bobStopSyncing()
+
+		// both /user/devices (device list resyncs) and /user/keys/query, so hs1 has no cached copy of bob's devices
+		userQueriesToHS2 := mitm.All(mitm.Federation(), mitm.Host("hs2"), mitm.PathContains("/_matrix/federation/v1/user/"))
+		aliceKeysQueries := mitm.All(mitm.Client(), mitm.PathContains("/keys/query"), mitm.DeviceID(tc.Alice.DeviceID))
+		mark := tc.Deployment.MarkFlows(t)
+		var roomID string
+		var aliceStopSyncing func()
+		tc.Deployment.WithMITMAddons(t, []mitm.Addon{
+			mitm.StatusCodeOptions{
+				Filter:       userQueriesToHS2,
+				ReturnStatus: http.StatusBadGateway,
+				BlockRequest: true,
+			},
+		}, func() {
+			roomID = tc.CreateNewEncryptedRoom(t, tc.Alice, EncRoomOptions.Invite([]string{tc.Bob.UserID}))
+			tc.Bob.MustJoinRoom(t, roomID, []string{"hs1"})
+			mustSeeFederationFlows(t, tc.Deployment, mark)
+			// alice's client queries bob's keys when it sees him in the room
+			aliceStopSyncing = alice.MustStartSyncing(t)
+			waitForKeysQueryFailure(t, tc.Deployment, mark, aliceKeysQueries, "hs2")
+		})
+		defer aliceStopSyncing()
+
+		wantMsgBody := "Bob can see this once Alice's server gets his keys"
+		waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+		alice.SendMessage(t, roomID, wantMsgBody)
+		waiter.Waitf(t, timing.Get().Scale(30*time.Second), "bob did not see alice's message '%s' after hs2 became reachable", wantMsgBody)
+	})
+}
+
+// waitForKeysQueryFailure waits until a /keys/query response matching the filter reports that the server failed.
+func waitForKeysQueryFailure(t *testing.T, deployment *deploy.SlidingSyncDeployment, mark deploy.FlowMark, filter mitm.Filter, server string) {
+	t.Helper()
+	deployment.WaitForFlows(t, mark, filter, func(flows []deploy.CallbackData) bool {
+		for _, flow := range flows {
+			var res struct {
+				Failures map[string]json.RawMessage `json:"failures"`
+			}
+			if err := json.Unmarshal(flow.ResponseBody, &res); err != nil {
+				continue
+			}
+			if failure, ok := res.Failures[server]; ok {
+				t.Logf("saw /keys/query failure for %s: %s", server, string(failure))
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// skipIfFederationNotProxied skips tests which intercept federation traffic when homeservers are not configured
+// to send it via mitmproxy.
+func skipIfFederationNotProxied(t *testing.T) {
+	t.Helper()
+	if !complementCryptoConfig.FederationProxy {
+		t.Skipf("COMPLEMENT_CRYPTO_FEDERATION_PROXY is false, so federation traffic cannot be intercepted")
+	}
+}
+
+// mustSeeFederationFlows fails the test if no federation traffic has gone via mitmproxy since the mark. Call this
+// after something which must federate has completed, e.g a remote join, to catch homeserver images which ignore
+// HTTPS_PROXY, rather than failing later because interception silently did nothing.
+func mustSeeFederationFlows(t *testing.T, deployment *deploy.SlidingSyncDeployment, mark deploy.FlowMark) {
+	t.Helper()
+	if len(deployment.FlowsSince(t, mark, mitm.Federation())) == 0 {
+		t.Fatalf("no federation traffic went via mitmproxy: the homeserver images may ignore HTTPS_PROXY. " +
+			"Set COMPLEMENT_CRYPTO_FEDERATION_PROXY=false to skip tests which intercept federation traffic.")
+	}
+}
@@ -0,0 +1,71 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/deploy"
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that latency with the same seed delays the same requests by the same amounts, so failing runs can be
+// reproduced, and that the delay really happens before the request reaches the server.
+func TestLatencyJitterIsSeeded(t *testing.T) {
+	deployment := Deploy(t)
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{LocalpartSuffix: "alice"})
+	whoami := mitm.All(mitm.PathContains("/account/whoami"), mitm.AccessToken(alice.AccessToken))
+	opts := mitm.LatencyOptions{
+		Filter: whoami,
+		Target: mitm.TargetRequest,
+		Delay:  10 * time.Millisecond,
+		Jitter: 200 * time.Millisecond,
+		Seed:   42,
+	}
+	const numRequests = 5
+	delays := func() []float64 {
+		mark := deployment.MarkFlows(t)
+		deployment.WithLatency(t, opts, func() {
+			for i := 0; i < numRequests; i++ {
+				alice.MustDo(t, "GET", []string{"_matrix", "client", "v3", "account", "whoami"})
+			}
+		})
+		flows := deployment.FlowsSince(t, mark, whoami)
+		must.Equal(t, len(flows), numRequests, "number of /whoami flows")
+		var delays []float64
+		for _, flow := range flows {
+			assertLatencyBeforeResponse(t, flow, opts.Delay)
+			delays = append(delays, flow.LatencyMS)
+		}
+		return delays
+	}
+	first := delays()
+	second := delays()
+	t.Logf("delays: %v", first)
+	must.Equal(t, len(second), len(first), "number of delays")
+	varies := false
+	for i := range first {
+		must.Equal(t, second[i], first[i], "delay with the same seed")
+		if first[i] != first[0] {
+			varies = true
+		}
+	}
+	if !varies {
+		t.Errorf("jitter did not vary the delays: %v", first)
+	}
+}
+
+// assertLatencyBeforeResponse checks that the flow was delayed by at least minDelay, and that the server did not
+// respond until after the recorded delay.
+func assertLatencyBeforeResponse(t *testing.T, flow deploy.CallbackData, minDelay time.Duration) {
+	t.Helper()
+	if flow.LatencyMS < float64(minDelay.Milliseconds()) {
+		t.Fatalf("%s: delayed by %.1fms, want at least %v", flow, flow.LatencyMS, minDelay)
+	}
+	// allow for rounding of the timestamps
+	elapsedMS := (flow.ResponseTimestamp - flow.RequestTimestamp) * 1000
+	if elapsedMS+1 < flow.LatencyMS {
+		t.Fatalf("%s: server responded %.1fms after the request, but the request was delayed by %.1fms", flow, elapsedMS, flow.LatencyMS)
+	}
+}
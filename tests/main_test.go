@@ -12,6 +12,7 @@ import (
 	"github.com/matrix-org/complement-crypto/internal/api"
 	"github.com/matrix-org/complement-crypto/internal/api/langs"
 	"github.com/matrix-org/complement-crypto/internal/config"
+	"github.com/matrix-org/complement-crypto/internal/config/timing"
 	"github.com/matrix-org/complement-crypto/internal/deploy"
 	"github.com/matrix-org/complement/client"
 	"github.com/matrix-org/complement/helpers"
@@ -29,6 +30,13 @@ var (
 func TestMain(m *testing.M) {
 	complementCryptoConfig = config.NewComplementCryptoConfigFromEnvVars()
 	ssMutex = &sync.Mutex{}
+	timing.Set(complementCryptoConfig.TimingProfile)
+	fmt.Printf("Using %s\n", complementCryptoConfig.TimingProfile)
+	complementCryptoConfig.ExportHomeserverImages()
+	if complementCryptoConfig.FederationProxy {
+		// route federation traffic via mitmproxy so tests can intercept it
+		complementCryptoConfig.ExportHomeserverEnv(deploy.FederationProxyEnv())
+	}
 
 	for _, binding := range complementCryptoConfig.Bindings() {
 		binding.PreTestRun("")
@@ -47,20 +55,38 @@ func TestMain(m *testing.M) {
 }
 
 // Deploy a new network of HSes. If Deploy has been called before, returns the existing
-// deployment.
+// deployment. The traffic made by the calling test is written to a HAR file in ./logs.
 func Deploy(t *testing.T) *deploy.SlidingSyncDeployment {
+	deployment := deployOnce(t)
+	// write the traffic for this test to a HAR file
+	deployment.RecordHAR(t)
+	return deployment
+}
+
+func deployOnce(t *testing.T) *deploy.SlidingSyncDeployment {
 	ssMutex.Lock()
 	defer ssMutex.Unlock()
 	if ssDeployment != nil {
 		return ssDeployment
 	}
+	ssDeployment = deploy.RunNewDeployment(t, deploymentOpts(t))
+	return ssDeployment
+}
+
+// deploymentOpts returns the options used to make the deployment, as configured by environment variables.
+func deploymentOpts(t *testing.T) deploy.DeploymentOpts {
 	workingDir, err := os.Getwd()
 	if err != nil {
 		t.Fatalf("failed to find working directory: %s", err)
 	}
-	mitmProxyAddonsDir := filepath.Join(workingDir, "mitmproxy_addons")
-	ssDeployment = deploy.RunNewDeployment(t, mitmProxyAddonsDir, complementCryptoConfig.MITMDump)
-	return ssDeployment
+	return deploy.DeploymentOpts{
+		MITMProxyAddonsDir:  filepath.Join(workingDir, "mitmproxy_addons"),
+		MITMDumpFile:        complementCryptoConfig.MITMDump,
+		NativeSlidingSync:   complementCryptoConfig.SlidingSyncMode == config.SlidingSyncModeNative,
+		DeploymentStateFile: complementCryptoConfig.DeploymentStateFile,
+		HomeserverImages:    complementCryptoConfig.HomeserverImages,
+		NoFederationProxy:   !complementCryptoConfig.FederationProxy,
+	}
 }
 
 // ClientTypeMatrix enumerates all provided client permutations given by the test client
@@ -81,16 +107,22 @@ func ShouldTest(lang api.ClientTypeLang) bool {
 }
 
 // ForEachClientType enumerates all known client implementations and creates sub-tests for
-// each. Sub-tests are run in series. Always defaults to `hs1`.
+// each. Sub-tests are run in series. Always defaults to `hs1`. If the test client matrix contains
+// multiprocess clients, additional `_rpc` sub-tests are created which run the client via RPC.
 func ForEachClientType(t *testing.T, subTest func(t *testing.T, clientType api.ClientType)) {
 	for _, tc := range []api.ClientType{{Lang: api.ClientTypeRust, HS: "hs1"}, {Lang: api.ClientTypeJS, HS: "hs1"}} {
 		tc := tc
-		if !complementCryptoConfig.ShouldTest(tc.Lang) {
-			continue
+		if complementCryptoConfig.ShouldTestInProcess(tc.Lang) {
+			t.Run(string(tc.Lang), func(t *testing.T) {
+				subTest(t, tc)
+			})
+		}
+		if complementCryptoConfig.ShouldTestMultiprocess(tc.Lang) {
+			tc.Multiprocess = true
+			t.Run(string(tc.Lang)+"_rpc", func(t *testing.T) {
+				subTest(t, tc)
+			})
 		}
-		t.Run(string(tc.Lang), func(t *testing.T) {
-			subTest(t, tc)
-		})
 	}
 }
 
@@ -216,8 +248,19 @@ func (c *TestContext) MustCreateMultiprocessClient(t *testing.T, lang api.Client
 	return remoteBindings.MustCreateClient(t, opts)
 }
 
+// MustCreateMultiprocessClientInSameProcess creates a new client in the RPC process which hosts an existing
+// multiprocess client, so both clients share the same process e.g the same tokio runtime.
+func (c *TestContext) MustCreateMultiprocessClientInSameProcess(t *testing.T, existing api.Client, opts api.ClientCreationOpts) api.Client {
+	t.Helper()
+	rpcClient, ok := existing.(*deploy.RPCClient)
+	if !ok {
+		t.Fatalf("MustCreateMultiprocessClientInSameProcess: %T is not a multiprocess client", existing)
+	}
+	return rpcClient.MustCreateClientInSameProcess(t, opts)
+}
+
 // WithMultiprocessClientSyncing is the same as WithClientSyncing but it spins up the client in a separate process.
-// Communication is done via net/rpc internally.
+// Communication is done via JSON-RPC internally, see RPC.md.
 func (c *TestContext) WithMultiprocessClientSyncing(t *testing.T, lang api.ClientTypeLang, opts api.ClientCreationOpts, callback func(cli api.Client)) {
 	t.Helper()
 	remoteClient := c.MustCreateMultiprocessClient(t, lang, opts)
@@ -406,9 +449,13 @@ func (c *TestContext) ClientCreationOpts(t *testing.T, cli *client.CSAPI, hsName
 
 // MustCreateClient creates an api.Client from an existing Complement client and the specified client type. Additional options
 // can be set to configure the client beyond that of the Complement client e.g to add persistent storage.
+// If the client type is multiprocess, the client is created in a separate process.
 func (c *TestContext) MustCreateClient(t *testing.T, cli *client.CSAPI, clientType api.ClientType, options ...func(*api.ClientCreationOpts)) api.Client {
 	t.Helper()
 	opts := c.ClientCreationOpts(t, cli, clientType.HS, options...)
+	if clientType.Multiprocess {
+		return c.MustCreateMultiprocessClient(t, clientType.Lang, opts)
+	}
 	client := MustCreateClient(t, clientType, opts)
 	return client
 }
@@ -2,12 +2,28 @@ from mitmproxy.addons import asgiapp
 
 from callback import Callback
 from status_code import StatusCode
+from rewrite import Rewrite
+from hold import Hold
+from fault import Fault
+from latency import Latency
+from rate_limit import RateLimit
+from history import history
+from har import har
+from identity import identity
 from controller import MITM_DOMAIN_NAME, app
 
 addons = [
     asgiapp.WSGIApp(app, MITM_DOMAIN_NAME, 80), # requests to this host will be routed to the flask app
+    identity, # first, so other addons can match on the user/device of the request
+    har, # after identity, as flows are attributed to tests by user
+    Latency(),
+    RateLimit(),
     StatusCode(),
+    Rewrite(), # before Callback so callbacks see the rewritten bodies
     Callback(),
+    Hold(),
+    Fault(), # after addons which may respond early, as it may send the request via a relay
+    history, # last, so it records what the client saw
 ]
 # testcontainers will look for this log line
 print("loading complement crypto addons", flush=True)
@@ -1,12 +1,46 @@
-from typing import Optional
+import asyncio
 import json
+import re
+import threading
 
-from mitmproxy import ctx, flowfilter
-from mitmproxy.http import Response
-from controller import MITM_DOMAIN_NAME
+from controller import MITM_DOMAIN_NAME, app
+from layers import Layers
 from urllib.request import urlopen, Request
 from urllib.error import HTTPError, URLError
 
+# Return the JSON object sent to callbacks for this flow. The flow must have a response.
+def callback_data(flow) -> dict:
+    try: # e.g GET requests have no req body
+        req_body = flow.request.json()
+    except:
+        req_body = None
+    try: # e.g OPTIONS responses have no res body
+        res_body = flow.response.json()
+    except:
+        res_body = None
+    auth_header = flow.request.headers.get("Authorization", "")
+    federation = is_federation(flow)
+    x_matrix = {}
+    if federation:
+        x_matrix = dict(X_MATRIX_PARAM.findall(auth_header))
+    return {
+        "method": flow.request.method,
+        "access_token": "" if federation else auth_header.removeprefix("Bearer "),
+        "url": flow.request.url,
+        "response_code": flow.response.status_code,
+        "request_body": req_body,
+        "response_body": res_body,
+        "federation": federation,
+        "origin": x_matrix.get("origin", ""),
+        "destination": x_matrix.get("destination", ""),
+        "user_id": flow.metadata.get("user_id", ""),
+        "device_id": flow.metadata.get("device_id", ""),
+        "latency_ms": flow.metadata.get("latency_ms", 0),
+        "fault": flow.metadata.get("fault", ""),
+        "request_timestamp": flow.request.timestamp_end or 0,
+        "response_timestamp": flow.response.timestamp_start or 0,
+    }
+
 # Callback will intercept a response and send a POST request to the provided callback_url, with
 # the following JSON object. Supports filters: https://docs.mitmproxy.org/stable/concepts-filters/
 # {
@@ -16,81 +50,121 @@ from urllib.error import HTTPError, URLError
 #   request_body: { some json object or null if no body },
 #   response_body: { some json object },
 #   response_code: 200,
+#   federation: false,
+#   origin: "hs1", (federation requests only)
+#   destination: "hs2", (federation requests only)
+#   user_id: "@alice:hs1", (client requests only, if the access token could be resolved)
+#   device_id: "ALICEDEVICE", (client requests only, if the access token could be resolved)
+#   latency_ms: 123.4, (delay added by the Latency addon, or 0)
+#   fault: "truncate", (fault injected by the Fault addon, or "")
+#   request_timestamp: 1700000000.123, (when mitmproxy finished reading the request from the client, in seconds)
+#   response_timestamp: 1700000000.456, (when mitmproxy started reading the response from the server, in seconds)
+# }
+# The callback_url may return a verdict, which is applied to the response before it is forwarded:
+# {
+#   status_code: 500, (replace the response status code)
+#   body: { some json object }, (replace the response body)
+#   delay_ms: 1000, (delay delivery of the response)
 # }
-# Currently this is a read-only callback. The response cannot be modified, but side-effects can be
-# taken. For example, tests may wish to terminate a client prior to the delivery of a response but
-# after the server has processed the request, or the test may wish to use the response as a
-# synchronisation point for a Waiter.
+# If nothing is returned, the response is forwarded unmodified. Side-effects can also be taken. For
+# example, tests may wish to terminate a client prior to the delivery of a response but after the
+# server has processed the request, or the test may wish to use the response as a synchronisation
+# point for a Waiter.
 class Callback:
     def __init__(self):
-        self.reset()
-        self.matchall = flowfilter.parse(".")
-        self.filter: Optional[flowfilter.TFilter] = self.matchall
-
-    def reset(self):
-        self.config = {
-            "callback_url": "",
-            "filter": None,
-        }
+        self.layers = Layers("callback", {"callback_url": "", "filter": None}, lambda config: config["callback_url"] != "")
 
     def load(self, loader):
-        loader.add_option(
-            name="callback",
-            typespec=dict,
-            default={"callback_url": "", "filter": None},
-            help="Change the callback url, with an optional filter",
-        )
+        self.layers.add_option(loader, "Change the callback url, with an optional filter")
 
     def configure(self, updates):
-        if "callback" not in updates:
-            self.reset()
-            return
-        if ctx.options.callback is None or ctx.options.callback["callback_url"] == "":
-            self.reset()
-            return
-        self.config = ctx.options.callback
-        new_filter = self.config.get('filter', None)
-        print(f"callback will hit {self.config['callback_url']} filter={new_filter}")
-        if new_filter:
-            self.filter = flowfilter.parse(new_filter)
-        else:
-            self.filter = self.matchall
+        self.layers.configure(updates)
 
-    def response(self, flow):
+    async def response(self, flow):
         # always ignore the controller
         if flow.request.pretty_host == MITM_DOMAIN_NAME:
             return
-        if self.config["callback_url"] == "":
-            return # ignore responses if we aren't told a url
-        if flowfilter.match(self.filter, flow):
-            try: # e.g GET requests have no req body
-                req_body = flow.request.json()
-            except:
-                req_body = None
-            try: # e.g OPTIONS responses have no res body
-                res_body = flow.response.json()
-            except:
-                res_body = None
-            data = json.dumps({
-                "method": flow.request.method,
-                "access_token": flow.request.headers.get("Authorization", "").removeprefix("Bearer "),
-                "url": flow.request.url,
-                "response_code": flow.response.status_code,
-                "request_body": req_body,
-                "response_body": res_body,
-            })
-            request = Request(
-                self.config["callback_url"],
-                headers={"Content-Type": "application/json"},
-                data=data.encode("utf-8"),
-            )
-            try:
-                with urlopen(request, timeout=10) as response:
-                    print(f"callback returned HTTP {response.status}")
-                    return response.read(), response
-            except HTTPError as error:
-                print(f"ERR: callback returned {error.status} {error.reason}")
-            except URLError as error:
-                print(f"ERR: callback returned {error.reason}")
-            except TimeoutError:
-                print(f"ERR: callback request timed out")
+        for layer in self.layers.matching(flow):
+            data = json.dumps(callback_data(flow))
+            verdict = await await_callback(layer.config["callback_url"], data)
+            await apply_verdict(flow, verdict)
+
+# Return true if the flow is a server-server request, which homeservers send via mitmproxy as their egress proxy.
+def is_federation(flow) -> bool:
+    return flow.request.path.startswith(("/_matrix/federation/", "/_matrix/key/"))
+
+# e.g X-Matrix origin="hs1",destination="hs2",key="ed25519:a_abcd",sig="..."
+X_MATRIX_PARAM = re.compile(r'(origin|destination)="?([^",]+)"?')
+
+# Callbacks which are waiting for a response, as (event loop, task) pairs.
+pending_callbacks = set()
+pending_callbacks_lock = threading.Lock()
+
+# POST data to the url without blocking other flows, and return the JSON response. Returns {} if there was a
+# problem, or if callbacks are reset whilst waiting.
+async def await_callback(url: str, data: str, timeout_secs: int = 10) -> dict:
+    task = asyncio.ensure_future(asyncio.to_thread(post_callback, url, data, timeout_secs))
+    pending = (asyncio.get_running_loop(), task)
+    with pending_callbacks_lock:
+        pending_callbacks.add(pending)
+    try:
+        return await asyncio.shield(task)
+    except asyncio.CancelledError:
+        if not task.cancelled():
+            raise # the flow itself was cancelled
+        print(f"callback to {url} abandoned")
+        return {}
+    finally:
+        with pending_callbacks_lock:
+            pending_callbacks.discard(pending)
+
+# POST data to the url and return the JSON response, or {} if there was no response body or a problem.
+def post_callback(url: str, data: str, timeout_secs: int = 10) -> dict:
+    request = Request(
+        url,
+        headers={"Content-Type": "application/json"},
+        data=data.encode("utf-8"),
+    )
+    try:
+        with urlopen(request, timeout=timeout_secs) as response:
+            print(f"callback returned HTTP {response.status}")
+            body = response.read()
+            if len(body) == 0:
+                return {}
+            return json.loads(body)
+    except HTTPError as error:
+        print(f"ERR: callback returned {error.status} {error.reason}")
+    except URLError as error:
+        print(f"ERR: callback returned {error.reason}")
+    except TimeoutError:
+        print(f"ERR: callback request timed out")
+    except json.JSONDecodeError as error:
+        print(f"ERR: callback returned invalid JSON: {error}")
+    return {}
+
+# Stop waiting for all pending callbacks, so their flows continue as if the callbacks returned nothing. This is
+# used when reattaching to a long-lived deployment, as a previous test run may have exited whilst mitmproxy was
+# waiting for one of its callbacks.
+# POST /callbacks/reset
+# {}
+@app.route("/callbacks/reset", methods=["POST"])
+def reset_callbacks():
+    with pending_callbacks_lock:
+        print(f"abandoning {len(pending_callbacks)} pending callbacks")
+        for loop, task in pending_callbacks:
+            loop.call_soon_threadsafe(task.cancel)
+    return {}
+
+async def apply_verdict(flow, verdict: dict):
+    if len(verdict) == 0:
+        return
+    print(f"callback: applying verdict {verdict} to {flow.request.url}")
+    delay_ms = verdict.get("delay_ms", 0)
+    if delay_ms > 0:
+        await asyncio.sleep(delay_ms / 1000)
+    if verdict.get("status_code", 0) > 0:
+        flow.response.status_code = verdict["status_code"]
+    if "body" in verdict:
+        flow.response.headers["Content-Type"] = "application/json"
+        # this also updates the Content-Length header
+        flow.response.text = json.dumps(verdict["body"])
@@ -1,14 +1,39 @@
 import random
+import threading
 from mitmproxy import ctx
 from flask import Flask, request, make_response
 # must match code in deploy.go
 MITM_DOMAIN_NAME = "mitm.code"
 app = Flask("mitmoptset")
 
-prev_options = {
-    "lock_id": "",
-    "options": {},
-}
+# The options for these addons are layered, see layers.py. Must match the names of the Layers in this package.
+LAYERED_OPTIONS = {"callback", "fault", "hold", "latency", "ratelimit", "rewrite", "statuscode"}
+
+# Active option layers in the order they were locked: lock_id => { options: {...}, scope: {...} }
+# Python dicts preserve insertion order.
+layers = {}
+# The values of non-layered options before any layer modified them: name => value
+original_options = {}
+# Flask handles requests concurrently, so guard the above.
+layers_lock = threading.Lock()
+
+# Apply all active layers to mitmproxy. Layered options get a list of configs, one per layer which sets them.
+# For other options, the most recently locked layer which sets them wins, else they have their original value.
+def apply_layers():
+    updates = {name: {"layers": []} for name in LAYERED_OPTIONS}
+    for k in original_options:
+        updates[k] = original_options[k]
+    for lock_id, layer in layers.items():
+        for k, v in layer["options"].items():
+            if k in LAYERED_OPTIONS:
+                config = dict(v or {})
+                config["layer_id"] = lock_id
+                if layer["scope"]:
+                    config["scope"] = layer["scope"]
+                updates[k]["layers"].append(config)
+            else:
+                updates[k] = v
+    ctx.options.update(**updates)
 
 # Set options on mitmproxy. See https://docs.mitmproxy.org/stable/concepts-options/
 # This is intended to be used exclusively for our addons in this package, but nothing
@@ -17,32 +42,49 @@ prev_options = {
 # {
 #   "options": {
 #     "body_size_limit": "3m",
+#   },
+#   "scope": {
+#     "access_token": "syt_11...", (optional: only apply the options to requests with this access token)
+#     "user_id": "@alice:hs1", (optional: only apply the options to requests from this user, see identity.py)
+#     "device_id": "ALICEDEVICE", (optional: only apply the options to requests from this device, see identity.py)
 #   }
 # }
 # HTTP/1.1 200 OK
 # {
 #   "reset_id": "some_opaque_string"
 # }
-# Calling this endpoint locks the proxy from further option modification until /options/unlock
-# is called. This ensures that tests can't forget to reset options when they are done with them.
+# Calling this endpoint adds a layer of options which stays in effect until /options/unlock is called
+# with the returned ID. Many layers can be active at once, and are unlocked independently. The options
+# for our addons from each layer are all in effect at once. For other options, the most recently locked
+# layer wins. Scopes only apply to the options for our addons.
 @app.route("/options/lock", methods=["POST"])
 def lock_options():
-    if prev_options["lock_id"] != "":
-        return make_response(("options already locked, did you forget to unlock?", 400))
     body = request.json
     options = body.get("options", {})
-    prev_options["lock_id"] = bytes.hex(random.randbytes(8))
-    for k, v in ctx.options.items():
-        if k in options:
-            prev_options["options"][k] = v.current()
-    print(f"locking options {options}")
-    ctx.options.update(**options)
+    scope = body.get("scope", None)
+    lock_id = bytes.hex(random.randbytes(8))
+    with layers_lock:
+        for k in options:
+            if k not in LAYERED_OPTIONS and k not in original_options:
+                if k not in ctx.options:
+                    return make_response((f"unknown option {k}", 400))
+                original_options[k] = getattr(ctx.options, k)
+        layers[lock_id] = {
+            "options": options,
+            "scope": scope,
+        }
+        print(f"locking options {lock_id} {options} scope={scope}")
+        try:
+            apply_layers()
+        except Exception as error:
+            del layers[lock_id]
+            apply_layers()
+            return make_response((f"failed to set options: {error}", 400))
     return {
-        "reset_id": prev_options["lock_id"]
+        "reset_id": lock_id
     }
 
-# Unlock previously set options on mitmproxy. Must be called after a call to POST /options/lock
-# to allow further option modifications.
+# Unlock previously set options on mitmproxy. Must be called after a call to POST /options/lock.
 # POST /options/unlock
 # {
 #   "reset_id": "some_opaque_string"
@@ -51,13 +93,22 @@ def lock_options():
 def unlock_options() -> str:
     body = request.json
     reset_id = body.get("reset_id", "")
-    if prev_options["lock_id"] == "":
-        return make_response(("options were not locked, mismatched lock/unlock calls", 400))
-    if prev_options["lock_id"] != reset_id:
-        return make_response(("refusing to unlock, wrong id supplied", 400))
-    print(f"unlocking options back to {prev_options['options']}")
-    ctx.options.update(**prev_options["options"])
-    # apply AFTER update so if we fail to reset them back we won't unlock, indicating a problem.
-    prev_options["lock_id"] = ""
-    prev_options["options"] = {}
+    with layers_lock:
+        if reset_id not in layers:
+            return make_response(("options were not locked with this id, mismatched lock/unlock calls", 400))
+        print(f"unlocking options {reset_id}")
+        del layers[reset_id]
+        apply_layers()
+    return {}
+
+# Forcibly unlock all options, restoring them to the values they had prior to being locked. This is used
+# when reattaching to a long-lived deployment, as a previous test run may have exited without unlocking.
+# POST /options/reset
+# {}
+@app.route("/options/reset", methods=["POST"])
+def reset_options():
+    with layers_lock:
+        print(f"resetting {len(layers)} option layers")
+        layers.clear()
+        apply_layers()
     return {}
@@ -0,0 +1,186 @@
+import asyncio
+import random
+import socket
+import ssl
+import struct
+
+from controller import MITM_DOMAIN_NAME
+from layers import Layers
+
+# The header used to tell the relay which fault to apply to a request. It is not sent to the server.
+FAULT_HEADER = b"x-complement-crypto-fault"
+
+# Fault will inject connection-level faults into responses which match the filter. Supports filters: https://docs.mitmproxy.org/stable/concepts-filters/
+# {
+#   mode: "reset|truncate|drip",
+#   filter: "~u .*/sync.*",
+#   after_bytes: 100, (reset: close the connection after this many bytes of the response body, truncate: cut the body to this many bytes)
+#   drip_bytes: 1, (drip: how many bytes of the response body to send at a time)
+#   drip_interval_ms: 100, (drip: how long to wait between each send)
+#   count: 1, (how many flows to fault, 0 = all)
+# }
+# Truncated responses are otherwise well-formed: the Content-Length matches the truncated body. Resets and drips
+# happen below HTTP: the request is sent to the server via a TCP relay in this process, which applies the fault to
+# the bytes of the response body, and the response is streamed to the client as it arrives. When the relay resets
+# the connection, mitmproxy closes the connection to the client mid-body. Other addons do not see the bodies of
+# streamed responses. The mode of the fault applied to a flow is recorded in its "fault" metadata, which callbacks
+# and history report.
+class Fault:
+    def __init__(self):
+        self.layers = Layers("fault", {
+            "mode": "",
+            "after_bytes": 0,
+            "drip_bytes": 1,
+            "drip_interval_ms": 0,
+            "count": 0,
+            "filter": None,
+        }, lambda config: config["mode"] != "")
+        self.relay = None # asyncio.Server
+        self.relay_lock = asyncio.Lock()
+        self.pending = {} # fault_id => { address: (host, port), tls: bool, config: {...} }
+
+    def load(self, loader):
+        self.layers.add_option(loader, "Inject connection-level faults into responses, with an optional filter")
+
+    def configure(self, updates):
+        self.layers.configure(updates)
+
+    async def request(self, flow):
+        # always ignore the controller, and requests which another addon has already responded to
+        if flow.request.pretty_host == MITM_DOMAIN_NAME or flow.response is not None:
+            return
+        layer = self.pick(flow, ("reset", "drip"))
+        if layer is None:
+            return
+        port = await self.relay_port()
+        fault_id = bytes.hex(random.randbytes(8))
+        self.pending[fault_id] = {
+            "address": (flow.request.host, flow.request.port),
+            "tls": flow.request.scheme == "https",
+            "config": layer.config,
+        }
+        print(f"fault: sending {flow.request.url} via relay for {layer.config['mode']}")
+        flow.metadata["fault"] = layer.config["mode"]
+        flow.metadata["fault_upstream"] = (flow.request.scheme, flow.request.host, flow.request.port)
+        # keep the Host header the server would have seen
+        host_header = flow.request.host_header
+        flow.request.scheme = "http"
+        flow.request.host = "127.0.0.1"
+        flow.request.port = port
+        flow.request.host_header = host_header
+        flow.request.headers[FAULT_HEADER.decode()] = fault_id
+        # the relay only handles a single request per connection
+        flow.request.headers["Connection"] = "close"
+
+    def responseheaders(self, flow):
+        if flow.metadata.get("fault_upstream", None) is None:
+            return
+        flow.response.stream = True
+        # the connection to the relay has been made, so restore the URL for other addons and the flow history
+        scheme, host, port = flow.metadata.pop("fault_upstream")
+        host_header = flow.request.host_header
+        flow.request.scheme = scheme
+        flow.request.host = host
+        flow.request.port = port
+        flow.request.host_header = host_header
+        del flow.request.headers[FAULT_HEADER.decode()]
+
+    def response(self, flow):
+        # always ignore the controller, and flows which have already been faulted
+        if flow.request.pretty_host == MITM_DOMAIN_NAME or "fault" in flow.metadata:
+            return
+        layer = self.pick(flow, ("truncate",))
+        if layer is None:
+            return
+        content = flow.response.content or b""
+        after_bytes = layer.config["after_bytes"]
+        print(f"fault: truncating response to {flow.request.url} from {len(content)} to {after_bytes} bytes")
+        flow.metadata["fault"] = "truncate"
+        flow.response.content = content[:after_bytes]
+
+    # Return the first layer which matches this flow with one of the given modes and has not faulted enough flows.
+    def pick(self, flow, modes):
+        for layer in self.layers.matching(flow):
+            if layer.config["mode"] not in modes:
+                continue
+            seen = layer.state.get("seen", 0)
+            if layer.config["count"] > 0 and seen >= layer.config["count"]:
+                continue
+            layer.state["seen"] = seen + 1
+            return layer
+        return None
+
+    async def relay_port(self) -> int:
+        async with self.relay_lock:
+            if self.relay is None:
+                self.relay = await asyncio.start_server(self.handle_relay, "127.0.0.1", 0)
+        return self.relay.sockets[0].getsockname()[1]
+
+    # Relay a single request to the server, applying the fault to the response body.
+    async def handle_relay(self, reader, writer):
+        upstream_writer = None
+        try:
+            head = await reader.readuntil(b"\r\n\r\n")
+            fault = None
+            lines = []
+            for line in head.split(b"\r\n"):
+                name, _, value = line.partition(b":")
+                if name.strip().lower() == FAULT_HEADER:
+                    fault = self.pending.pop(value.strip().decode(), None)
+                    continue
+                lines.append(line)
+            if fault is None:
+                print("fault: relay received a request with an unknown fault ID")
+                return
+            ssl_context = None
+            if fault["tls"]:
+                ssl_context = ssl.create_default_context()
+                ssl_context.check_hostname = False
+                ssl_context.verify_mode = ssl.CERT_NONE
+            host, port = fault["address"]
+            upstream_reader, upstream_writer = await asyncio.open_connection(host, port, ssl=ssl_context)
+            upstream_writer.write(b"\r\n".join(lines))
+            # send the request body, if any, in the background
+            asyncio.create_task(pipe(reader, upstream_writer))
+            writer.write(await upstream_reader.readuntil(b"\r\n\r\n"))
+            config = fault["config"]
+            if config["mode"] == "reset":
+                remaining = config["after_bytes"]
+                while remaining > 0:
+                    data = await upstream_reader.read(remaining)
+                    if not data:
+                        break
+                    writer.write(data)
+                    remaining -= len(data)
+                await writer.drain()
+                print(f"fault: resetting connection after {config['after_bytes']} bytes")
+                # send a TCP RST rather than a FIN
+                writer.get_extra_info("socket").setsockopt(socket.SOL_SOCKET, socket.SO_LINGER, struct.pack("ii", 1, 0))
+                writer.transport.abort()
+                return
+            # drip
+            while True:
+                data = await upstream_reader.read(max(1, config["drip_bytes"]))
+                if not data:
+                    break
+                writer.write(data)
+                await writer.drain()
+                await asyncio.sleep(config["drip_interval_ms"] / 1000)
+        except (asyncio.IncompleteReadError, asyncio.LimitOverrunError, ConnectionError, OSError) as error:
+            print(f"fault: relay failed: {error}")
+        finally:
+            if upstream_writer is not None:
+                upstream_writer.close()
+            if not writer.transport.is_closing():
+                writer.close()
+
+async def pipe(reader, writer):
+    try:
+        while True:
+            data = await reader.read(65536)
+            if not data:
+                break
+            writer.write(data)
+            await writer.drain()
+    except (ConnectionError, OSError):
+        pass
@@ -0,0 +1,97 @@
+import threading
+
+from mitmproxy.addons.savehar import SaveHar
+from flask import request
+from controller import MITM_DOMAIN_NAME, app
+
+# HAR tags flows with the name of the test which made them, and exports the flows for a test as a HAR file
+# (http://www.softwareishard.com/blog/har-12-spec/) when the test ends. HAR files can be opened in any browser's
+# devtools. As tests run in parallel, flows are attributed to tests by the user who made them: tests claim the
+# users they register, and users are resolved from access tokens by the Identity addon. Flows which cannot be
+# attributed to a user, such as federation requests, are not recorded.
+class HAR:
+    def __init__(self):
+        self.lock = threading.Lock()
+        self.users = {} # user_id => test name
+        self.flows = {} # test name => [flow]
+        self.saver = SaveHar()
+
+    def response(self, flow):
+        # always ignore the controller
+        if flow.request.pretty_host == MITM_DOMAIN_NAME:
+            return
+        user_id = flow.metadata.get("user_id", "")
+        if user_id == "":
+            return
+        with self.lock:
+            test_name = self.users.get(user_id, None)
+            if test_name is None or test_name not in self.flows:
+                return
+            flow.metadata["test_name"] = test_name
+            self.flows[test_name].append(flow)
+
+    def start(self, test_name: str):
+        with self.lock:
+            self.flows.setdefault(test_name, [])
+
+    # Attribute flows made by this user to the test. A user belongs to at most one test.
+    def claim(self, test_name: str, user_id: str):
+        with self.lock:
+            self.users[user_id] = test_name
+
+    # End the test, returning its flows as HAR.
+    def end(self, test_name: str) -> dict:
+        with self.lock:
+            self.users = {user_id: name for user_id, name in self.users.items() if name != test_name}
+            flows = self.flows.pop(test_name, [])
+        return self.saver.make_har(flows)
+
+    def reset(self):
+        with self.lock:
+            self.users.clear()
+            self.flows.clear()
+
+har = HAR()
+
+# Start recording flows for this test. Only flows made by users the test claims are recorded.
+# POST /tests/start
+# {
+#   "test_name": "TestFoo/bar"
+# }
+@app.route("/tests/start", methods=["POST"])
+def start_test():
+    har.start(request.json.get("test_name", ""))
+    return {}
+
+# Tag flows made by this user with the test name, until the test ends.
+# POST /tests/claim
+# {
+#   "test_name": "TestFoo/bar",
+#   "user_id": "@alice:hs1"
+# }
+@app.route("/tests/claim", methods=["POST"])
+def claim_user():
+    har.claim(request.json.get("test_name", ""), request.json.get("user_id", ""))
+    return {}
+
+# Stop tagging flows with this test name, and return the flows made during the test as HAR.
+# POST /tests/end
+# {
+#   "test_name": "TestFoo/bar"
+# }
+# HTTP/1.1 200 OK
+# {
+#   "log": { ... }
+# }
+@app.route("/tests/end", methods=["POST"])
+def end_test():
+    return har.end(request.json.get("test_name", ""))
+
+# Forget all running tests and their flows. This is used when reattaching to a long-lived deployment,
+# as a previous test run may have exited without ending its tests.
+# POST /tests/reset
+# {}
+@app.route("/tests/reset", methods=["POST"])
+def reset_tests():
+    har.reset()
+    return {}
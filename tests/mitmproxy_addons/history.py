@@ -0,0 +1,81 @@
+from collections import deque
+import threading
+
+from mitmproxy import flowfilter
+from flask import request, make_response
+from controller import MITM_DOMAIN_NAME, app
+from callback import callback_data
+
+# how many flows to remember. Older flows are forgotten.
+MAX_FLOWS = 5000
+
+# History records every completed flow with a sequence number, so tests can make assertions about
+# traffic after the fact via the controller HTTP API.
+class History:
+    def __init__(self):
+        self.lock = threading.Lock()
+        self.seq = 0
+        self.flows = deque(maxlen=MAX_FLOWS) # (seq, flow)
+
+    def response(self, flow):
+        # always ignore the controller
+        if flow.request.pretty_host == MITM_DOMAIN_NAME:
+            return
+        with self.lock:
+            self.seq += 1
+            self.flows.append((self.seq, flow))
+
+    def mark(self) -> int:
+        with self.lock:
+            return self.seq
+
+    def since(self, seq: int, filter) -> list:
+        with self.lock:
+            flows = [(s, f) for (s, f) in self.flows if s > seq]
+        result = []
+        for s, f in flows:
+            if filter is not None and not flowfilter.match(filter, f):
+                continue
+            data = callback_data(f)
+            data["seq"] = s
+            result.append(data)
+        return result
+
+history = History()
+
+# Return the sequence number of the most recently completed flow.
+# POST /flows/mark
+# {}
+# HTTP/1.1 200 OK
+# {
+#   "seq": 42
+# }
+@app.route("/flows/mark", methods=["POST"])
+def mark_flows():
+    return {
+        "seq": history.mark(),
+    }
+
+# Return all flows which completed after the given sequence number, in order, with an optional filter.
+# Each flow has the same JSON object as the Callback addon, along with a "seq" field.
+# POST /flows/since
+# {
+#   "seq": 42,
+#   "filter": "~u .*/sendToDevice.*"
+# }
+# HTTP/1.1 200 OK
+# {
+#   "flows": [ ... ]
+# }
+@app.route("/flows/since", methods=["POST"])
+def flows_since():
+    body = request.json
+    filter = None
+    if body.get("filter", None):
+        try:
+            filter = flowfilter.parse(body["filter"])
+        except ValueError as error:
+            return make_response((f"invalid filter: {error}", 400))
+    return {
+        "flows": history.since(body.get("seq", 0), filter),
+    }
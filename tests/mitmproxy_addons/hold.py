@@ -0,0 +1,44 @@
+import json
+
+from controller import MITM_DOMAIN_NAME
+from layers import Layers
+from callback import callback_data, await_callback
+
+# how long to hold a response for before releasing it, in case the test never does
+HOLD_TIMEOUT_SECS = 300
+
+# Hold will intercept a response and send a POST request to the provided callback_url, with the same JSON
+# object as the Callback addon. The response is held until the callback_url returns, which allows tests
+# to park responses after the server has processed the request but before the client sees the response.
+# Supports filters: https://docs.mitmproxy.org/stable/concepts-filters/
+# The callback_url may return the following JSON object:
+# {
+#   abort: true, (kill the connection instead of delivering the response)
+# }
+class Hold:
+    def __init__(self):
+        self.layers = Layers("hold", {"callback_url": "", "filter": None}, lambda config: config["callback_url"] != "")
+
+    def load(self, loader):
+        self.layers.add_option(loader, "Hold responses until the callback url returns, with an optional filter")
+
+    def configure(self, updates):
+        self.layers.configure(updates)
+
+    async def response(self, flow):
+        # always ignore the controller
+        if flow.request.pretty_host == MITM_DOMAIN_NAME:
+            return
+        layers = self.layers.matching(flow)
+        if len(layers) == 0:
+            return
+        # only the first matching layer holds the response
+        data = json.dumps(callback_data(flow))
+        print(f"hold: holding response for {flow.request.url}")
+        # don't block other flows whilst this one is held. Resetting callbacks releases the response.
+        verdict = await await_callback(layers[0].config["callback_url"], data, HOLD_TIMEOUT_SECS)
+        if verdict.get("abort", False):
+            print(f"hold: aborting response for {flow.request.url}")
+            flow.kill()
+        else:
+            print(f"hold: releasing response for {flow.request.url}")
@@ -0,0 +1,56 @@
+import asyncio
+import random
+
+from controller import MITM_DOMAIN_NAME
+from layers import Layers
+
+# Latency will delay requests or responses which match the filter. Supports filters: https://docs.mitmproxy.org/stable/concepts-filters/
+# The total delay applied to a flow is recorded in its "latency_ms" metadata, which callbacks and history report.
+# {
+#   target: "request|response", (delay the request before it reaches the server, or the response before it reaches the client)
+#   filter: "~u .*/keys/claim.*",
+#   delay_ms: 1000, (fixed delay to apply)
+#   jitter_ms: 500, (random extra delay between 0 and jitter_ms, uniformly distributed)
+#   seed: 42, (seed for the random jitter, so runs are reproducible)
+# }
+class Latency:
+    def __init__(self):
+        self.layers = Layers("latency", {
+            "target": "response",
+            "delay_ms": 0,
+            "jitter_ms": 0,
+            "seed": 0,
+            "filter": None,
+        }, lambda config: config["delay_ms"] > 0 or config["jitter_ms"] > 0)
+
+    def load(self, loader):
+        self.layers.add_option(loader, "Delay requests or responses, with an optional filter")
+
+    def configure(self, updates):
+        self.layers.configure(updates)
+
+    async def request(self, flow):
+        await self.delay(flow, "request")
+
+    async def response(self, flow):
+        await self.delay(flow, "response")
+
+    async def delay(self, flow, target):
+        # always ignore the controller
+        if flow.request.pretty_host == MITM_DOMAIN_NAME:
+            return
+        # delays from each matching layer add up
+        delay_ms = 0
+        for layer in self.layers.matching(flow):
+            if layer.config["target"] != target:
+                continue
+            delay_ms += layer.config["delay_ms"]
+            if layer.config["jitter_ms"] > 0:
+                if "random" not in layer.state:
+                    layer.state["random"] = random.Random(layer.config["seed"])
+                delay_ms += layer.state["random"].uniform(0, layer.config["jitter_ms"])
+        if delay_ms == 0:
+            return
+        flow.metadata["latency_ms"] = flow.metadata.get("latency_ms", 0) + delay_ms
+        print(f"latency: delaying {target} for {flow.request.url} by {delay_ms:.0f}ms")
+        await asyncio.sleep(delay_ms / 1000)
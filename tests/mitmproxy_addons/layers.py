@@ -0,0 +1,80 @@
+from typing import Callable, Optional
+
+from mitmproxy import ctx, flowfilter
+
+# The controller can have many option layers active at once, so the options for each of our addons are a list
+# of configs, one per layer, in the order the layers were locked:
+# {
+#   layers: [
+#     { filter: "~u .*/sync.*", layer_id: "abcd", scope: { access_token: "syt_11..." }, ...addon specific config },
+#   ]
+# }
+# A scope can match on the access_token, user_id and/or device_id of the request. User and device IDs are
+# resolved from the access token by the Identity addon, so they keep matching when the access token changes.
+# For convenience, the option can also be set to a single addon specific config, which is treated as a single layer.
+
+# A Layer is a single config for an addon, along with any state the addon needs to keep for it e.g how many flows
+# it has modified. State is preserved when other layers are locked or unlocked.
+class Layer:
+    def __init__(self, config: dict):
+        self.config = config
+        self.id = config.get("layer_id", "")
+        scope = config.get("scope", None) or {}
+        self.access_token = scope.get("access_token", "")
+        self.user_id = scope.get("user_id", "")
+        self.device_id = scope.get("device_id", "")
+        self.filter: Optional[flowfilter.TFilter] = None
+        if config.get("filter", None):
+            self.filter = flowfilter.parse(config["filter"])
+        self.state = {}
+
+    # Return true if the flow is in scope for this layer and matches its filter.
+    def matches(self, flow) -> bool:
+        if self.access_token != "":
+            if flow.request.headers.get("Authorization", "") != "Bearer " + self.access_token:
+                return False
+        if self.user_id != "" and flow.metadata.get("user_id", "") != self.user_id:
+            return False
+        if self.device_id != "" and flow.metadata.get("device_id", "") != self.device_id:
+            return False
+        return self.filter is None or flowfilter.match(self.filter, flow)
+
+# Layers tracks the active layers for a single addon option.
+class Layers:
+    def __init__(self, name: str, defaults: dict, is_enabled: Callable[[dict], bool]):
+        self.name = name
+        self.defaults = defaults
+        self.is_enabled = is_enabled
+        self.layers: list[Layer] = []
+
+    def add_option(self, loader, help: str):
+        loader.add_option(
+            name=self.name,
+            typespec=dict,
+            default={"layers": []},
+            help=help,
+        )
+
+    def configure(self, updates):
+        if self.name not in updates:
+            return
+        value = getattr(ctx.options, self.name, None) or {}
+        configs = value.get("layers", None)
+        if configs is None:
+            configs = [value]
+        existing = {layer.id: layer for layer in self.layers if layer.id != ""}
+        layers = []
+        for config in configs:
+            config = {**self.defaults, **config}
+            if not self.is_enabled(config):
+                continue
+            layer = existing.get(config.get("layer_id", ""), None)
+            if layer is None or layer.config != config:
+                layer = Layer(config)
+            layers.append(layer)
+        self.layers = layers
+        print(f"{self.name}: {len(self.layers)} active layers: {[layer.config for layer in self.layers]}")
+
+    # Return all layers which match this flow, in the order they were locked.
+    def matching(self, flow) -> list:
+        return [layer for layer in self.layers if layer.matches(flow)]
@@ -0,0 +1,86 @@
+from typing import Optional
+import json
+import math
+import time
+
+from mitmproxy.http import Response
+from controller import MITM_DOMAIN_NAME
+from layers import Layers
+
+# RateLimit will emulate per-user token bucket rate limits on requests which match the filter, returning
+# HTTP 429 M_LIMIT_EXCEEDED with retry_after_ms and a Retry-After header when a bucket is empty. Rate limited
+# requests do not reach the server. Supports filters: https://docs.mitmproxy.org/stable/concepts-filters/
+# {
+#   filter: "~u .*/keys/upload.*",
+#   limits: [
+#     { user_id: "@alice:hs1", per_second: 0.5, burst: 1 },
+#     { user_id: "", per_second: 10, burst: 5 }, (applies to users not otherwise listed)
+#   ]
+# }
+# Each user has its own bucket, which holds up to `burst` requests and refills at `per_second`. Users are
+# resolved from access tokens by the Identity addon, so all of a user's devices share a bucket. Requests
+# whose user is unknown are only limited by the fallback limit, with a bucket per access token.
+class RateLimit:
+    def __init__(self):
+        self.layers = Layers("ratelimit", {
+            "limits": [],
+            "filter": None,
+        }, lambda config: len(config["limits"]) > 0)
+
+    def load(self, loader):
+        self.layers.add_option(loader, "Rate limit requests per user, with an optional filter")
+
+    def configure(self, updates):
+        self.layers.configure(updates)
+
+    def request(self, flow):
+        # always ignore the controller
+        if flow.request.pretty_host == MITM_DOMAIN_NAME:
+            return
+        user_id = flow.metadata.get("user_id", "")
+        bucket = user_id
+        if bucket == "":
+            bucket = "token:" + flow.request.headers.get("Authorization", "").removeprefix("Bearer ")
+        for layer in self.layers.matching(flow):
+            limit = find_limit(layer, user_id)
+            if limit is None:
+                continue
+            retry_after_ms = self.take(layer, bucket, limit)
+            if retry_after_ms == 0:
+                continue
+            print(f"ratelimit: limiting {flow.request.method} {flow.request.url} retry_after_ms={retry_after_ms}")
+            flow.response = Response.make(429, json.dumps({
+                "errcode": "M_LIMIT_EXCEEDED",
+                "error": "Too many requests",
+                "retry_after_ms": retry_after_ms,
+            }).encode("utf-8"), {
+                "Content-Type": "application/json",
+                "Retry-After": str(math.ceil(retry_after_ms / 1000)),
+                "MITM-Proxy": "yes",
+            })
+            return
+
+    # Take a token from the named bucket. Returns 0 if a token was taken, else how many
+    # milliseconds until a token will be available.
+    def take(self, layer, bucket: str, limit: dict) -> int:
+        now = time.monotonic()
+        buckets = layer.state.setdefault("buckets", {}) # user_id or token:access_token => (tokens, last_refill_time)
+        tokens, last = buckets.get(bucket, (limit.get("burst", 1), now))
+        tokens = min(limit.get("burst", 1), tokens + (now - last) * limit["per_second"])
+        if tokens >= 1:
+            buckets[bucket] = (tokens - 1, now)
+            return 0
+        buckets[bucket] = (tokens, now)
+        if limit["per_second"] <= 0:
+            return 60 * 60 * 1000 # never refills
+        return max(1, math.ceil((1 - tokens) / limit["per_second"] * 1000))
+
+# Return the limit for this user, falling back to the limit with an empty user ID.
+def find_limit(layer, user_id: str) -> Optional[dict]:
+    fallback = None
+    for limit in layer.config["limits"]:
+        if user_id != "" and limit.get("user_id", "") == user_id:
+            return limit
+        if limit.get("user_id", "") == "":
+            fallback = limit
+    return fallback
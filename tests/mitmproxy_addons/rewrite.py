@@ -0,0 +1,142 @@
+import json
+
+from controller import MITM_DOMAIN_NAME
+from layers import Layers
+
+# Rewrite will modify the JSON body of requests or responses which match the filter, by applying a list of
+# JSON patch operations (RFC 6902) to them. Supports filters: https://docs.mitmproxy.org/stable/concepts-filters/
+# {
+#   target: "request|response",
+#   filter: "~u .*/sync.*",
+#   count: 0, (how many flows to rewrite, 0 means unlimited)
+#   patches: [
+#     { op: "remove", path: "/device_one_time_keys_count" },
+#     { op: "replace", path: "/device_keys/*/*/signatures", value: {} },
+#     { op: "add", path: "/to_device/events/-", value: { ... } },
+#   ]
+# }
+# Paths are JSON pointers (RFC 6901). As an extension, a path segment of "*" matches every key of an object or every
+# element of an array. Operations on paths which do not exist are skipped. Bodies which are not JSON are not modified.
+class Rewrite:
+    def __init__(self):
+        self.layers = Layers("rewrite", {
+            "target": "response",
+            "patches": [],
+            "count": 0,
+            "filter": None,
+        }, lambda config: len(config["patches"]) > 0)
+
+    def load(self, loader):
+        self.layers.add_option(loader, "Apply JSON patch operations to request or response bodies, with an optional filter")
+
+    def configure(self, updates):
+        self.layers.configure(updates)
+
+    def request(self, flow):
+        self.rewrite(flow, flow.request, "request")
+
+    def response(self, flow):
+        if flow.response.headers.get("MITM-Proxy", None) is not None:
+            return # ignore responses generated by mitm proxy e.g by the statuscode addon
+        self.rewrite(flow, flow.response, "response")
+
+    def rewrite(self, flow, message, target):
+        # always ignore the controller
+        if flow.request.pretty_host == MITM_DOMAIN_NAME:
+            return
+        layers = [
+            layer for layer in self.layers.matching(flow)
+            if layer.config["target"] == target and not exceeded_count(layer)
+        ]
+        if len(layers) == 0:
+            return
+        try:
+            body = message.json()
+        except:
+            return # not JSON, e.g GET requests have no req body
+        for layer in layers:
+            for patch in layer.config["patches"]:
+                body = apply_patch(body, patch)
+            layer.state["seen"] = layer.state.get("seen", 0) + 1
+            print(f'rewrite: patched {target} body: count {layer.state["seen"]}/{layer.config["count"]}')
+        # this also updates the Content-Length header
+        message.text = json.dumps(body)
+
+def exceeded_count(layer) -> bool:
+    return layer.config["count"] > 0 and layer.state.get("seen", 0) >= layer.config["count"]
+
+def parse_pointer(path: str) -> list:
+    if path == "":
+        return []
+    if not path.startswith("/"):
+        raise ValueError(f"JSON pointer must start with '/': {path}")
+    return [seg.replace("~1", "/").replace("~0", "~") for seg in path[1:].split("/")]
+
+def apply_patch(body, patch):
+    op = patch["op"]
+    segments = parse_pointer(patch["path"])
+    if len(segments) == 0:
+        # operating on the whole document
+        if op == "remove":
+            return None
+        return patch.get("value", None)
+    for parent in resolve(body, segments[:-1]):
+        apply_op(parent, op, segments[-1], patch.get("value", None))
+    return body
+
+# Return all containers which match the JSON pointer segments, expanding "*".
+def resolve(node, segments: list) -> list:
+    if len(segments) == 0:
+        return [node]
+    seg, rest = segments[0], segments[1:]
+    if isinstance(node, dict):
+        if seg == "*":
+            children = list(node.values())
+        elif seg in node:
+            children = [node[seg]]
+        else:
+            return []
+    elif isinstance(node, list):
+        if seg == "*":
+            children = list(node)
+        elif seg.isdigit() and int(seg) < len(node):
+            children = [node[int(seg)]]
+        else:
+            return []
+    else:
+        return []
+    result = []
+    for child in children:
+        result.extend(resolve(child, rest))
+    return result
+
+def apply_op(parent, op: str, key: str, value):
+    if isinstance(parent, dict):
+        keys = list(parent.keys()) if key == "*" else [key]
+        for k in keys:
+            if op == "add":
+                parent[k] = value
+            elif op == "replace" and k in parent:
+                parent[k] = value
+            elif op == "remove" and k in parent:
+                del parent[k]
+    elif isinstance(parent, list):
+        if key == "*":
+            if op == "remove":
+                parent.clear()
+            elif op == "replace":
+                for i in range(len(parent)):
+                    parent[i] = value
+            return
+        if op == "add" and key == "-":
+            parent.append(value)
+            return
+        if not key.isdigit():
+            return
+        i = int(key)
+        if op == "add" and i <= len(parent):
+            parent.insert(i, value)
+        elif op == "replace" and i < len(parent):
+            parent[i] = value
+        elif op == "remove" and i < len(parent):
+            del parent[i]
@@ -1,81 +1,95 @@
-from typing import Optional
+import json
+import random
 
-from mitmproxy import ctx, flowfilter
 from mitmproxy.http import Response
 from controller import MITM_DOMAIN_NAME
+from layers import Layers
 
 # StatusCode will intercept a response and return the provided status code in its place, with
 # no response body. Supports filters: https://docs.mitmproxy.org/stable/concepts-filters/
+# Alternatively, a chaos mode can be enabled which fails a percentage of matching flows at random.
+# Chaos responses have no body either, unless limit_exceeded is set, in which case 429 responses
+# have an M_LIMIT_EXCEEDED JSON body so clients back off for retry_after_ms:
+# {
+#   chaos: {
+#     percent: 20, (chance of failing each matching flow)
+#     status_codes: [429, 500, 502], (the status code is picked at random from this list)
+#     limit_exceeded: true, (return an M_LIMIT_EXCEEDED body with 429 responses)
+#     retry_after_ms: 1000, (the retry_after_ms in the M_LIMIT_EXCEEDED body)
+#     seed: 42, (seed for the random choices, so runs are reproducible)
+#   }
+# }
 class StatusCode:
     def __init__(self):
-        self.reset()
-        print(MITM_DOMAIN_NAME)
-        self.matchall = flowfilter.parse(".")
-        self.filter: Optional[flowfilter.TFilter] = self.matchall
-        self._seen_count = 0
-
-    def reset(self):
-        self.config = {
+        self.layers = Layers("statuscode", {
             "return_status": 0,
             "block_request": False,
             "count": 0,
             "filter": None,
-        }
-        self._seen_count = 0
-    
-    def exceeded_count(self):
-        return self.config["count"] > 0 and self._seen_count >= self.config["count"]
+            "chaos": None,
+        }, lambda config: config["return_status"] != 0 or config["chaos"] is not None)
 
     def load(self, loader):
-        loader.add_option(
-            name="statuscode",
-            typespec=dict,
-            default={"return_status": 0, "filter": None, "block_request": False, "count": 0},
-            help="Change the response status code, with an optional filter",
-        )
+        self.layers.add_option(loader, "Change the response status code, with an optional filter")
 
     def configure(self, updates):
-        if "statuscode" not in updates:
-            self.reset()
-            return
-        if ctx.options.statuscode is None or ctx.options.statuscode["return_status"] == 0:
-            self.reset()
-            return
-        self.config = ctx.options.statuscode
-        # ensure optional fields are set
-        self.config.setdefault("count", 0)
-        self.config.setdefault("block_request", False)
-
-        new_filter = self.config.get('filter', None)
-        print(f"statuscode will return HTTP {self.config['return_status']} filter={new_filter} count={self.config['count']}")
-        if new_filter:
-            self.filter = flowfilter.parse(new_filter)
-        else:
-            self.filter = self.matchall
+        self.layers.configure(updates)
 
     def request(self, flow):
         # always ignore the controller
         if flow.request.pretty_host == MITM_DOMAIN_NAME:
             return
-        if self.config["return_status"] == 0:
-            return # ignore responses if we aren't told a code
-        if self.config["block_request"] and flowfilter.match(self.filter, flow) and not self.exceeded_count():
-            self._seen_count += 1
-            print(f'statuscode: blocking request and sending back {self.config["return_status"]}: count {self._seen_count}/{self.config["count"]}')
-            flow.response = Response.make(self.config["return_status"], headers={
-                "MITM-Proxy": "yes",
-            })
+        for layer in self.layers.matching(flow):
+            if not layer.config["block_request"] or exceeded_count(layer):
+                continue
+            status, body = pick_response(layer)
+            if status == 0:
+                continue
+            print(f'statuscode: blocking request and sending back {status}: count {layer.state["seen"]}/{layer.config["count"]}')
+            headers = {"MITM-Proxy": "yes"}
+            if len(body) > 0:
+                headers["Content-Type"] = "application/json"
+            flow.response = Response.make(status, body, headers)
+            return
 
     def response(self, flow):
         # always ignore the controller
         if flow.request.pretty_host == MITM_DOMAIN_NAME:
             return
-        if self.config["return_status"] == 0:
-            return # ignore responses if we aren't told a code
         if flow.response.headers.get("MITM-Proxy", None) is not None:
-            print(f'not modifying mitm response!')
             return # ignore responses generated by mitm proxy (i.e the one in `def request` above
-        if flowfilter.match(self.filter, flow) and not self.exceeded_count():
-            self._seen_count += 1
-            print(f'statuscode: blocking response and sending back {self.config["return_status"]}: count {self._seen_count}/{self.config["count"]}')
-            flow.response = Response.make(self.config["return_status"])
+        for layer in self.layers.matching(flow):
+            if layer.config["block_request"] or exceeded_count(layer):
+                continue # blocked requests are handled in `def request` above
+            status, body = pick_response(layer)
+            if status == 0:
+                continue
+            print(f'statuscode: blocking response and sending back {status}: count {layer.state["seen"]}/{layer.config["count"]}')
+            flow.response = Response.make(status, body, {"Content-Type": "application/json"} if len(body) > 0 else {})
+            return
+
+def exceeded_count(layer) -> bool:
+    return layer.config["count"] > 0 and layer.state.get("seen", 0) >= layer.config["count"]
+
+# Return the status code and body to replace the flow with, or a status of 0 to leave it alone.
+def pick_response(layer):
+    chaos = layer.config["chaos"]
+    if chaos is None:
+        layer.state["seen"] = layer.state.get("seen", 0) + 1
+        return layer.config["return_status"], b""
+    chaos = {"percent": 0, "status_codes": [500], "limit_exceeded": False, "retry_after_ms": 0, "seed": 0, **chaos}
+    if "random" not in layer.state:
+        layer.state["random"] = random.Random(chaos["seed"])
+        print(f"statuscode: chaos mode enabled: failing {chaos['percent']}% of flows with {chaos['status_codes']} seed={chaos['seed']}")
+    rng = layer.state["random"]
+    if rng.uniform(0, 100) >= chaos["percent"]:
+        return 0, b""
+    layer.state["seen"] = layer.state.get("seen", 0) + 1
+    status = rng.choice(chaos["status_codes"])
+    if status == 429 and chaos["limit_exceeded"]:
+        return status, json.dumps({
+            "errcode": "M_LIMIT_EXCEEDED",
+            "error": "Too many requests (complement-crypto chaos mode)",
+            "retry_after_ms": chaos["retry_after_ms"],
+        }).encode("utf-8")
+    return status, b""
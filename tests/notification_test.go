@@ -3,12 +3,15 @@ package tests
 import (
 	"fmt"
 	"math/rand"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/config/timing"
 	"github.com/matrix-org/complement-crypto/internal/deploy"
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
 	"github.com/matrix-org/complement/must"
 )
 
@@ -503,6 +506,197 @@ func TestMultiprocessDupeOTKUpload(t *testing.T) {
 	}
 }
 
+// Test that if the NSE process is suspended mid-request, as iOS does, whilst it may hold the cross-process lock,
+// the main app can still decrypt messages. When the NSE process is resumed, it can still decrypt messages.
+func TestMultiprocessNSESuspendedMidRequest(t *testing.T) {
+	if !ShouldTest(api.ClientTypeRust) {
+		t.Skipf("rust only")
+		return
+	}
+	tc, roomID := createAndJoinRoom(t)
+	alice := tc.MustLoginClient(t, tc.Alice, tc.AliceClientType, WithPersistentStorage(), WithCrossProcessLock("main"))
+	stopSyncing := alice.MustStartSyncing(t)
+	accessToken := alice.Opts().AccessToken
+	tc.WithClientSyncing(t, tc.BobClientType, tc.Bob, func(bob api.Client) {
+		bob.SendMessage(t, roomID, "before NSE")
+		alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody("before NSE")).Waitf(t, timing.Get().Scale(5*time.Second), "alice did not see 'before NSE'")
+		// the app goes into the background
+		stopSyncing()
+		alice.Close(t)
+
+		// a push notification wakes up the NSE process, which is suspended mid-request
+		eventID := bob.SendMessage(t, roomID, "NSE suspended")
+		nseAlice := tc.MustCreateMultiprocessClient(t, tc.AliceClientType.Lang, tc.ClientCreationOpts(t, tc.Alice, tc.AliceClientType.HS,
+			WithPersistentStorage(), WithAccessToken(accessToken), WithCrossProcessLock(api.ProcessNameNSE),
+		))
+		defer nseAlice.Close(t)
+		// hold the responses to the NSE's requests, so it is suspended whilst it is waiting for one
+		release, _, held := tc.Deployment.HoldResponses(t, mitm.All(
+			mitm.AccessToken(accessToken), mitm.Any(mitm.PathContains("/sync"), mitm.PathContains("/keys/")),
+		))
+		notifDone := make(chan error, 1)
+		go func() {
+			_, err := nseAlice.GetNotification(t, roomID, eventID)
+			notifDone <- err
+		}()
+		select {
+		case <-held:
+		case <-time.After(timing.Get().Scale(10 * time.Second)):
+			t.Fatalf("NSE did not make a request for the notification")
+		}
+		nseAlice.Suspend(t)
+		// the app uses the same access token, so its requests must not be held
+		release()
+
+		// the app comes into the foreground, and must not be blocked by the suspended NSE process
+		alice = MustCreateClient(t, tc.AliceClientType, tc.ClientCreationOpts(t, tc.Alice, tc.AliceClientType.HS,
+			WithPersistentStorage(), WithAccessToken(accessToken), WithCrossProcessLock("main"),
+		))
+		defer alice.Close(t)
+		stopSyncing = alice.MustStartSyncing(t)
+		defer stopSyncing()
+		bob.SendMessage(t, roomID, "NSE is suspended")
+		alice.WaitUntilEventInRoom(t, roomID, api.MatchAll(
+			api.MatchBody("NSE is suspended"), api.MatchFailedToDecrypt(false),
+		)).Waitf(t, timing.Get().Scale(10*time.Second), "alice did not decrypt a message whilst the NSE process was suspended")
+
+		// the NSE process is resumed, and can finish its work
+		nseAlice.Resume(t)
+		select {
+		case err := <-notifDone:
+			// the NSE process may have lost the lock whilst suspended, so this can fail
+			t.Logf("GetNotification whilst suspended returned err=%v", err)
+		case <-time.After(timing.Get().Scale(10 * time.Second)):
+			t.Fatalf("GetNotification did not return after the NSE process was resumed")
+		}
+		msg := "NSE resumed"
+		eventID = bob.SendMessage(t, roomID, msg)
+		notif, err := nseAlice.GetNotification(t, roomID, eventID)
+		must.NotError(t, "failed to get notification after the NSE process was resumed", err)
+		must.Equal(t, notif.Text, msg, "NSE failed to decrypt event after it was resumed")
+	})
+}
+
+// Test that when the app is terminated gracefully, its clients are closed rather than killed, so anything the
+// test is waiting for ends with the client being closed, and the client's state is persisted for the next launch.
+func TestMultiprocessGracefulTerminate(t *testing.T) {
+	if !ShouldTest(api.ClientTypeRust) {
+		t.Skipf("rust only")
+		return
+	}
+	tc, roomID := createAndJoinRoom(t)
+	alice := tc.MustCreateMultiprocessClient(t, tc.AliceClientType.Lang, tc.ClientCreationOpts(t, tc.Alice, tc.AliceClientType.HS,
+		WithPersistentStorage(),
+	))
+	must.NotError(t, "failed to login alice", alice.Login(t, alice.Opts()))
+	accessToken := alice.CurrentAccessToken(t)
+	alice.MustStartSyncing(t)
+	tc.WithClientSyncing(t, tc.BobClientType, tc.Bob, func(bob api.Client) {
+		// alice is still waiting when the app is terminated, after she has decrypted bob's message
+		body := "before terminate"
+		decrypted := make(chan struct{})
+		var once sync.Once
+		waiter := alice.WaitUntilEventInRoom(t, roomID, api.CheckerFunc(func(e api.Event) bool {
+			if e.Text == body && !e.FailedToDecrypt {
+				once.Do(func() { close(decrypted) })
+			}
+			return false
+		}))
+		waitErr := make(chan error, 1)
+		go func() {
+			waitErr <- waiter.TryWaitf(t, timing.Get().Scale(30*time.Second), "alice waiting whilst terminated")
+		}()
+		eventID := bob.SendMessage(t, roomID, body)
+		select {
+		case <-decrypted:
+		case <-time.After(timing.Get().Scale(10 * time.Second)):
+			t.Fatalf("alice did not decrypt '%s'", body)
+		}
+
+		// the OS asks the app to exit
+		alice.Terminate(t, true)
+		select {
+		case err := <-waitErr:
+			must.NotEqual(t, err, nil, "waiter error after terminating")
+			if !strings.Contains(err.Error(), "client was closed") {
+				t.Fatalf("waiter did not see the client being closed: %s", err)
+			}
+		case <-time.After(timing.Get().Scale(10 * time.Second)):
+			t.Fatalf("waiter did not return after the client was terminated")
+		}
+
+		// the app is launched again, and can still decrypt the message with the room key from its store, as bob
+		// will not send it again
+		alice = MustCreateClient(t, tc.AliceClientType, tc.ClientCreationOpts(t, tc.Alice, tc.AliceClientType.HS,
+			WithPersistentStorage(), WithAccessToken(accessToken),
+		))
+		defer alice.Close(t)
+		stopSyncing := alice.MustStartSyncing(t)
+		defer stopSyncing()
+		alice.MustBackpaginate(t, roomID, 5) // get the old message
+		ev := alice.MustGetEvent(t, roomID, eventID)
+		must.Equal(t, ev.FailedToDecrypt, false, "alice failed to decrypt the message after being terminated: state not persisted?")
+		must.Equal(t, ev.Text, body, "alice failed to see the message after being terminated")
+	})
+}
+
+// Test that the main app and the NSE can be clients in the same process, as they share a process on Android.
+// Each client has its own sync loop and waiters, and closing one client leaves the other working.
+func TestNSEInSameProcessAsMainApp(t *testing.T) {
+	if !ShouldTest(api.ClientTypeRust) {
+		t.Skipf("rust only")
+		return
+	}
+	tc, roomID := createAndJoinRoom(t)
+	alice := tc.MustCreateMultiprocessClient(t, tc.AliceClientType.Lang, tc.ClientCreationOpts(t, tc.Alice, tc.AliceClientType.HS,
+		WithPersistentStorage(), WithCrossProcessLock("main"),
+	))
+	must.NotError(t, "failed to login alice", alice.Login(t, alice.Opts()))
+	defer alice.Close(t)
+	stopAliceSyncing := alice.MustStartSyncing(t)
+	accessToken := alice.CurrentAccessToken(t)
+	mustCreateNSE := func() api.Client {
+		return tc.MustCreateMultiprocessClientInSameProcess(t, alice, tc.ClientCreationOpts(t, tc.Alice, tc.AliceClientType.HS,
+			WithPersistentStorage(), WithAccessToken(accessToken), WithCrossProcessLock(api.ProcessNameNSE),
+		)) // this should login already as we provided an access token
+	}
+	checkNSECanDecryptEvent := func(nseAlice api.Client, eventID, msg string) {
+		notif, err := nseAlice.GetNotification(t, roomID, eventID)
+		must.NotError(t, fmt.Sprintf("failed to get notification for event %s '%s'", eventID, msg), err)
+		must.Equal(t, notif.Text, msg, fmt.Sprintf("NSE failed to decrypt event %s '%s' => %+v", eventID, msg, notif))
+	}
+
+	tc.WithClientSyncing(t, tc.BobClientType, tc.Bob, func(bob api.Client) {
+		// both clients can decrypt
+		nseAlice := mustCreateNSE()
+		msg := "both clients can decrypt this"
+		eventID := bob.SendMessage(t, roomID, msg)
+		alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(msg)).Waitf(t, timing.Get().Scale(5*time.Second), "alice did not decrypt '%s'", msg)
+		checkNSECanDecryptEvent(nseAlice, eventID, msg)
+
+		// closing the NSE does not stop the main app's sync loop or its waiters
+		msg = "sent after the NSE closed"
+		waiter := alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(msg))
+		nseAlice.Close(t)
+		bob.SendMessage(t, roomID, msg)
+		waiter.Waitf(t, timing.Get().Scale(5*time.Second), "alice did not decrypt '%s' after the NSE closed", msg)
+
+		// stopping the main app's sync loop does not affect a new NSE
+		nseAlice = mustCreateNSE()
+		defer nseAlice.Close(t)
+		stopAliceSyncing()
+		msg = "sent whilst the main app is not syncing"
+		eventID = bob.SendMessage(t, roomID, msg)
+		checkNSECanDecryptEvent(nseAlice, eventID, msg)
+		must.Equal(t, nseAlice.UserID(), tc.Alice.UserID, "NSE user ID")
+
+		// the main app can sync again and sees the message
+		stopAliceSyncing = alice.MustStartSyncing(t)
+		alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(msg)).Waitf(t, timing.Get().Scale(5*time.Second), "alice did not decrypt '%s' after syncing again", msg)
+	})
+	stopAliceSyncing()
+}
+
 func createAndJoinRoom(t *testing.T) (tc *TestContext, roomID string) {
 	t.Helper()
 	clientType := api.ClientType{
@@ -9,6 +9,7 @@ import (
 
 	"github.com/matrix-org/complement-crypto/internal/api"
 	"github.com/matrix-org/complement-crypto/internal/deploy"
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
 	"github.com/matrix-org/complement/b"
 	"github.com/matrix-org/complement/client"
 	"github.com/matrix-org/complement/ct"
@@ -107,11 +108,11 @@ func TestFallbackKeyIsUsedIfOneTimeKeysRunOut(t *testing.T) {
 			var roomID string
 			var waiter api.Waiter
 			// Block all /keys/upload requests for Alice
-			tc.Deployment.WithMITMOptions(t, map[string]interface{}{
-				"statuscode": map[string]interface{}{
-					"return_status": http.StatusGatewayTimeout,
-					"block_request": true,
-					"filter":        "~u .*/keys/upload.* ~hq " + alice.CurrentAccessToken(t),
+			tc.Deployment.WithMITMAddons(t, []mitm.Addon{
+				mitm.StatusCodeOptions{
+					Filter:       mitm.All(mitm.PathContains("/keys/upload"), mitm.DeviceID(tc.Alice.DeviceID)),
+					ReturnStatus: http.StatusGatewayTimeout,
+					BlockRequest: true,
 				},
 			}, func() {
 				// claim all OTKs
@@ -0,0 +1,85 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/config/timing"
+	"github.com/matrix-org/complement-crypto/internal/deploy"
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+	"github.com/tidwall/gjson"
+)
+
+// Test that if the server rate limits /sendToDevice and /send, clients respect the backoff and retry
+// rather than giving up, such that all messages are eventually decrypted. Retries must not be sent
+// before retry_after_ms has elapsed.
+func TestClientRespectsRateLimits(t *testing.T) {
+	ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, EncRoomOptions.PresetPublicChat())
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.Client) {
+			// lets device keys be exchanged
+			time.Sleep(time.Second)
+
+			var eventIDs []string
+			sends := mitm.URLRegex("/(sendToDevice|send)/")
+			mark := tc.Deployment.MarkFlows(t)
+			tc.Deployment.WithRateLimits(t, mitm.RateLimitOptions{
+				Filter: sends,
+				Limits: []mitm.RateLimit{
+					deploy.RateLimitClient(alice, 1, 1),
+				},
+			}, func() {
+				for i := 0; i < 3; i++ {
+					eventIDs = append(eventIDs, alice.SendMessage(t, roomID, fmt.Sprintf("Rate limited message %d", i)))
+				}
+			})
+
+			for i, eventID := range eventIDs {
+				body := fmt.Sprintf("Rate limited message %d", i)
+				bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(body)).Waitf(t, timing.Get().Scale(5*time.Second), "bob did not see event %s with body '%s'", eventID, body)
+			}
+			assertRetriesRespectRetryAfter(t, tc.Deployment.FlowsSince(t, mark, mitm.All(sends, mitm.UserID(alice.UserID()))))
+		})
+	})
+}
+
+// assertRetriesRespectRetryAfter checks that every request which was rate limited was retried, and not before
+// the retry_after_ms in the M_LIMIT_EXCEEDED response. Retries are identified by having the same method and URL,
+// which is unique per request as the URL contains the transaction ID.
+func assertRetriesRespectRetryAfter(t *testing.T, flows []deploy.CallbackData) {
+	t.Helper()
+	rateLimited := 0
+	for i, flow := range flows {
+		if flow.ResponseCode != 429 {
+			continue
+		}
+		rateLimited++
+		retryAfter := gjson.GetBytes(flow.ResponseBody, "retry_after_ms")
+		if !retryAfter.Exists() {
+			t.Fatalf("%s: no retry_after_ms in response: %s", flow, flow.ResponseBody)
+		}
+		retryAt := flow.ResponseTimestamp + retryAfter.Float()/1000
+		retried := false
+		for _, next := range flows[i+1:] {
+			if next.Method != flow.Method || next.URL != flow.URL {
+				continue
+			}
+			retried = true
+			if next.RequestTimestamp < retryAt {
+				t.Errorf("%s: retried %.0fms after a 429, but retry_after_ms was %d", flow, (next.RequestTimestamp-flow.ResponseTimestamp)*1000, retryAfter.Int())
+			}
+			break
+		}
+		if !retried {
+			t.Errorf("%s: was not retried after a 429", flow)
+		}
+	}
+	if rateLimited == 0 {
+		t.Fatalf("no requests were rate limited in %d flows", len(flows))
+	}
+	t.Logf("%d of %d requests were rate limited", rateLimited, len(flows))
+}
@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/config/timing"
+	"github.com/matrix-org/complement-crypto/internal/deploy"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that a later `go test` run reattaches to a reusable deployment rather than making a new one, and that
+// reattaching resets mitmproxy state left behind by a previous run which died mid-test: its option layers are
+// removed, and mitmproxy stops waiting for callbacks to it.
+func TestReattachReusableDeployment(t *testing.T) {
+	if complementCryptoConfig.DeploymentStateFile == "" {
+		t.Skipf("COMPLEMENT_CRYPTO_DEPLOYMENT_STATE_FILE is not set")
+	}
+	// no HAR recording, as reattaching forgets all running tests
+	deployment := deployOnce(t)
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{LocalpartSuffix: "alice"})
+
+	// a callback server which never returns, as if the test process which owned it had frozen
+	callbackEntered := make(chan struct{}, 1)
+	unblockCallback := make(chan struct{})
+	callbackURL, closeCallbackServer := deploy.NewCallbackServer(t, deployment, func(cd deploy.CallbackData) {
+		callbackEntered <- struct{}{}
+		<-unblockCallback
+	})
+	defer closeCallbackServer()
+	defer close(unblockCallback)
+
+	// lock the callback directly via the controller, as a previous run would have done before dying
+	controllerURL, err := url.Parse(deployment.ControllerURL)
+	must.NotError(t, "failed to parse controller URL", err)
+	controllerClient := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(controllerURL)}}
+	lockBody, err := json.Marshal(map[string]interface{}{
+		"options": map[string]interface{}{
+			"callback": map[string]interface{}{
+				"callback_url": callbackURL,
+				"filter":       "~u account/whoami",
+			},
+		},
+	})
+	must.NotError(t, "failed to marshal lock body", err)
+	res, err := controllerClient.Post("http://mitm.code/options/lock", "application/json", bytes.NewBuffer(lockBody))
+	must.NotError(t, "failed to lock options", err)
+	res.Body.Close()
+	must.Equal(t, res.StatusCode, 200, "lock status code")
+
+	whoamiDone := make(chan error, 1)
+	go func() {
+		req, err := http.NewRequest("GET", alice.BaseURL+"/_matrix/client/v3/account/whoami", nil)
+		if err != nil {
+			whoamiDone <- err
+			return
+		}
+		req.Header.Set("Authorization", "Bearer "+alice.AccessToken)
+		res, err := http.DefaultClient.Do(req)
+		if err == nil {
+			res.Body.Close()
+		}
+		whoamiDone <- err
+	}()
+	select {
+	case <-callbackEntered:
+	case <-time.After(timing.Get().Scale(5 * time.Second)):
+		t.Fatalf("callback was not called for /whoami")
+	}
+
+	reattached := deploy.RunNewDeployment(t, deploymentOpts(t))
+	must.Equal(t, reattached.ControllerURL, deployment.ControllerURL, "reattached deployment has a different controller")
+	must.Equal(t, reattached.ContainerID(t, "hs1"), deployment.ContainerID(t, "hs1"), "reattached deployment has a different hs1")
+
+	// mitmproxy would otherwise wait 10s for the callback to time out
+	select {
+	case err := <-whoamiDone:
+		must.NotError(t, "/whoami failed", err)
+	case <-time.After(timing.Get().Scale(5 * time.Second)):
+		t.Fatalf("/whoami is still waiting for a callback to the previous run after reattaching")
+	}
+	// the layer from the previous run was removed, so the callback is not called again
+	alice.MustDo(t, "GET", []string{"_matrix", "client", "v3", "account", "whoami"})
+	select {
+	case <-callbackEntered:
+		t.Fatalf("callback from the previous run is still locked after reattaching")
+	default:
+	}
+}
@@ -7,9 +7,13 @@ import (
 	"time"
 
 	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/config/timing"
 	"github.com/matrix-org/complement-crypto/internal/deploy"
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
 	"github.com/matrix-org/complement/ct"
 	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/must"
+	"github.com/tidwall/gjson"
 )
 
 func TestSigkillBeforeKeysUploadResponse(t *testing.T) {
@@ -149,3 +153,72 @@ func testSigkillBeforeKeysUploadResponseJS(t *testing.T, clientType api.ClientTy
 		seenSecondKeysUploadWaiter.Wait(t, 3*time.Second)
 	})
 }
+
+// Test that if the client is killed AFTER the server has processed a /keys/upload request which contains its
+// device keys, but BEFORE it sees the response, it re-uploads the same device keys on startup rather than
+// generating new ones. Holding the response makes the kill land at exactly that point. Requires persistent storage.
+func TestForceCloseBeforeDeviceKeysUploadResponse(t *testing.T) {
+	ForEachClientType(t, func(t *testing.T, clientType api.ClientType) {
+		tc := CreateTestContext(t, clientType)
+		mark := tc.Deployment.MarkFlows(t)
+		keysUpload := mitm.All(mitm.PathContains("/keys/upload"), mitm.UserID(tc.Alice.UserID))
+		release, _, held := tc.Deployment.HoldResponses(t, keysUpload)
+
+		opts := tc.ClientCreationOpts(t, tc.Alice, clientType.HS, WithPersistentStorage())
+		var clientWhichWillBeKilled api.Client
+		if clientType.Lang == api.ClientTypeRust {
+			// in a different process, so it can be SIGKILLed
+			clientWhichWillBeKilled = tc.MustCreateMultiprocessClient(t, api.ClientTypeRust, opts)
+		} else {
+			clientWhichWillBeKilled = MustCreateClient(t, clientType, opts)
+		}
+		// login will upload keys, and not return until it sees the response, so don't wait for it.
+		// The error is dropped as the client will be killed.
+		go func() {
+			_ = clientWhichWillBeKilled.Login(t, opts)
+		}()
+		select {
+		case cd := <-held:
+			t.Logf("holding %s", cd)
+		case <-time.After(timing.Get().Scale(5 * time.Second)):
+			t.Fatalf("did not see /keys/upload")
+		}
+		clientWhichWillBeKilled.ForceClose(t)
+		release()
+
+		// now make the same client
+		alice := MustCreateClient(t, clientType, opts)
+		must.NotError(t, "failed to login", alice.Login(t, opts))
+		stopSyncing := alice.MustStartSyncing(t)
+		defer alice.Close(t)
+		defer stopSyncing()
+
+		deviceKeyUploads := waitForDeviceKeysUploads(t, tc.Deployment, mark, keysUpload, 2)
+		for i, upload := range deviceKeyUploads {
+			if upload.ResponseCode != 200 {
+				t.Fatalf("/keys/upload %d did not 200 OK => got %d", i, upload.ResponseCode)
+			}
+		}
+		first := gjson.GetBytes(deviceKeyUploads[0].RequestBody, "device_keys")
+		second := gjson.GetBytes(deviceKeyUploads[1].RequestBody, "device_keys")
+		must.Equal(t, second.Get("keys").Raw, first.Get("keys").Raw, "re-uploaded device keys differ from the keys the server has")
+		must.Equal(t, second.Get("device_id").Str, first.Get("device_id").Str, "re-uploaded device keys are for a different device")
+	})
+}
+
+// waitForDeviceKeysUploads waits until at least `count` /keys/upload requests matching the filter have included
+// device keys, and returns them in the order they were sent.
+func waitForDeviceKeysUploads(t *testing.T, deployment *deploy.SlidingSyncDeployment, mark deploy.FlowMark, filter mitm.Filter, count int) []deploy.CallbackData {
+	t.Helper()
+	var uploads []deploy.CallbackData
+	deployment.WaitForFlows(t, mark, filter, func(flows []deploy.CallbackData) bool {
+		uploads = uploads[:0]
+		for _, flow := range flows {
+			if gjson.GetBytes(flow.RequestBody, "device_keys").Exists() {
+				uploads = append(uploads, flow)
+			}
+		}
+		return len(uploads) >= count
+	})
+	return uploads
+}
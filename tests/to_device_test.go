@@ -8,6 +8,7 @@ import (
 
 	"github.com/matrix-org/complement-crypto/internal/api"
 	"github.com/matrix-org/complement-crypto/internal/deploy"
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
 	"github.com/matrix-org/complement/helpers"
 	"github.com/matrix-org/complement/must"
 	"github.com/tidwall/gjson"
@@ -272,40 +273,40 @@ func TestToDeviceMessagesAreBatched(t *testing.T) {
 			clientUnderTest := tc.MustLoginClient(t, cli, tc.AliceClientType)
 			clientUnderTest.Close(t)
 		}
-		waiter := helpers.NewWaiter()
 		tc.WithAliceSyncing(t, func(alice api.Client) {
-			// intercept /sendToDevice and check we are sending 100 messages per request
-			tc.Deployment.WithSniffedEndpoint(t, "/sendToDevice", func(cd deploy.CallbackData) {
-				if cd.Method != "PUT" {
-					return
-				}
-				// format is:
-				/*
-					{
-					  "messages": {
-					    "@alice:example.com": {
-					      "TLLBEANAAG": {
-					        "example_content_key": "value"
-					      }
-					    }
-					  }
+			mark := tc.Deployment.MarkFlows(t)
+			alice.SendMessage(t, roomID, "this should cause to-device msgs to be sent")
+			// check we are sending 100 messages per request
+			aliceSendToDevice := mitm.All(mitm.Method("PUT"), mitm.PathContains("/sendToDevice"), mitm.DeviceID(tc.Alice.DeviceID))
+			var batches []deploy.CallbackData
+			tc.Deployment.WaitForFlows(t, mark, aliceSendToDevice, func(flows []deploy.CallbackData) bool {
+				batches = batches[:0]
+				for _, flow := range flows {
+					// format is:
+					/*
+						{
+						  "messages": {
+						    "@alice:example.com": {
+						      "TLLBEANAAG": {
+						        "example_content_key": "value"
+						      }
+						    }
+						  }
+						}
+					*/
+					if gjson.GetBytes(flow.RequestBody, "messages").Exists() {
+						batches = append(batches, flow)
 					}
-				*/
-				usersMap := gjson.GetBytes(cd.RequestBody, "messages")
-				if !usersMap.Exists() {
-					t.Logf("intercepted PUT /sendToDevice but no messages existed")
-					return
 				}
+				return len(batches) > 0
+			})
+			for _, batch := range batches {
+				usersMap := gjson.GetBytes(batch.RequestBody, "messages")
 				if len(usersMap.Map()) != 100 {
 					t.Errorf("PUT /sendToDevice did not batch messages, got %d want 100", len(usersMap.Map()))
 					t.Logf(usersMap.Raw)
 				}
-				waiter.Finish()
-			}, func() {
-				alice.SendMessage(t, roomID, "this should cause to-device msgs to be sent")
-				time.Sleep(time.Second)
-				waiter.Waitf(t, 5*time.Second, "did not see /sendToDevice")
-			})
+			}
 		})
 
 	})
@@ -345,18 +346,16 @@ func TestToDeviceMessagesArentLostWhenKeysQueryFails(t *testing.T) {
 			})
 			defer closeCallbackServer()
 			var eventID string
-			bobAccessToken := bob.CurrentAccessToken(t)
-			t.Logf("Bob's token => %s", bobAccessToken)
-			tc.Deployment.WithMITMOptions(t, map[string]interface{}{
-				"statuscode": map[string]interface{}{
-					"return_status": http.StatusGatewayTimeout,
-					"block_request": true,
-					"count":         3,
-					"filter":        "~u .*/keys/query.* ~hq " + bobAccessToken,
+			tc.Deployment.WithMITMAddons(t, []mitm.Addon{
+				mitm.StatusCodeOptions{
+					Filter:       mitm.All(mitm.PathContains("/keys/query"), mitm.DeviceID(tc.Bob.DeviceID)),
+					ReturnStatus: http.StatusGatewayTimeout,
+					BlockRequest: true,
+					Count:        3,
 				},
-				"callback": map[string]interface{}{
-					"callback_url": callbackURL,
-					"filter":       "~u .*/keys/query.*",
+				mitm.CallbackOptions{
+					CallbackURL: callbackURL,
+					Filter:      mitm.PathContains("/keys/query"),
 				},
 			}, func() {
 				// Alice logs in on a new device.